@@ -0,0 +1,245 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"kagami/pkg/builder"
+	"kagami/pkg/config"
+	"kagami/pkg/proxy"
+	"kagami/pkg/system"
+)
+
+type subcommand struct {
+	usage string
+	run   func(args []string) int
+}
+
+const (
+	proxyUsage         = "proxy serve [--listen addr] [--cache-dir dir]"
+	checkUsage         = "check [--mirror url] [--offline] <config.json>"
+	cleanupMountsUsage = "cleanup-mounts [--workdir dir] [--force]"
+	lockUsage          = "lock update [--mirror url] [--lockfile path] <config.json>"
+	analyzeUsage       = "analyze [--top n] [--compare workdir|iso|report] <workdir|iso|report>"
+)
+
+var subcommands = map[string]subcommand{
+	"proxy":          {proxyUsage, runProxyCommand},
+	"check":          {checkUsage, runCheckCommand},
+	"cleanup-mounts": {cleanupMountsUsage, runCleanupMountsCommand},
+	"lock":           {lockUsage, runLockCommand},
+	"analyze":        {analyzeUsage, runAnalyzeCommand},
+}
+
+func printSubcommandUsage() {
+	fmt.Printf("\nCommands:\n")
+	for _, name := range sortedSubcommands() {
+		fmt.Printf("  %s %s\n", os.Args[0], subcommands[name].usage)
+	}
+}
+
+func sortedSubcommands() []string {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func runProxyCommand(args []string) int {
+	if len(args) == 0 || args[0] != "serve" {
+		fmt.Printf("Usage: %s %s\n", os.Args[0], proxyUsage)
+		return 2
+	}
+
+	_, workDir := system.GetAppPaths()
+
+	fs := flag.NewFlagSet("proxy serve", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:3142", "Address for the caching APT proxy to listen on")
+	cacheDir := fs.String("cache-dir", builder.DefaultProxyCacheDir(workDir), "Directory holding cached packages and indices")
+	fs.Parse(args[1:])
+
+	srv := proxy.NewServer(*cacheDir)
+	srv.OnLog = func(msg string) { fmt.Print(msg) }
+
+	addr, err := srv.Start(*listen)
+	if err != nil {
+		fatal("Proxy startup failed: %v", err)
+	}
+
+	fmt.Printf("[INFO] Caching APT proxy listening on http://%s/\n", addr)
+	fmt.Printf("[INFO] Cache directory: %s\n", *cacheDir)
+	fmt.Println("[INFO] Reference it from a configuration via \"repository\": {\"proxy\": {\"url\": \"http://" + addr + "/\"}}")
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
+
+	fmt.Println("\n[INFO] Shutting down caching APT proxy...")
+	srv.Close()
+	return 0
+}
+
+func runCheckCommand(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	mirrorURL := fs.String("mirror", "", "Override APT repository mirror URL")
+	offline := fs.Bool("offline", false, "Resolve packages against a local mirror only")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Printf("Usage: %s %s\n", os.Args[0], checkUsage)
+		return 2
+	}
+
+	cfg, err := config.LoadFromFile(fs.Arg(0))
+	if err != nil {
+		fatal("Configuration loading failed: %v", err)
+	}
+	if *mirrorURL != "" {
+		cfg.Repository.Mirror = *mirrorURL
+	}
+	if *offline {
+		cfg.Build.Offline = true
+	}
+	if err := cfg.Validate(); err != nil {
+		fatal("Configuration validation failed: %v", err)
+	}
+
+	fmt.Printf("[INFO] Resolving packages for %s %s (%s)...\n", cfg.Distro, cfg.Release, cfg.System.Architecture)
+
+	b := builder.NewBuilder(cfg, "", "")
+	result, err := b.CheckPackages()
+	if err != nil {
+		fatal("Package check failed: %v", err)
+	}
+
+	fmt.Print(result.Report())
+	if len(result.Missing) > 0 || len(result.PinProblems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func runCleanupMountsCommand(args []string) int {
+	_, defaultWorkDir := system.GetAppPaths()
+
+	fs := flag.NewFlagSet("cleanup-mounts", flag.ExitOnError)
+	workDir := fs.String("workdir", defaultWorkDir, "Build workspace whose leftover mounts should be released")
+	force := fs.Bool("force", false, "Release mounts even while a build holds the workspace lock")
+	fs.Parse(args)
+
+	if os.Geteuid() != 0 {
+		fatal("%s cleanup-mounts must be executed with elevated privileges (sudo)", config.AppName)
+	}
+
+	if holder := builder.WorkspaceLockHolder(*workDir); holder != nil {
+		fmt.Printf("[INFO] Workspace lock held by %s\n", holder)
+		if holder.Output != "" {
+			fmt.Printf("       building %s\n", holder.Output)
+		}
+		if !*force {
+			fmt.Println("[ERROR] Refusing to release mounts of a running build; pass --force to override")
+			return 1
+		}
+	} else {
+		fmt.Println("[INFO] Workspace lock: free")
+	}
+
+	fmt.Printf("[INFO] Releasing leftover mounts below %s...\n", *workDir)
+
+	released, err := builder.CleanupMounts(*workDir)
+	for _, target := range released {
+		fmt.Printf("  - unmounted %s\n", target)
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		return 1
+	}
+
+	if len(released) == 0 {
+		fmt.Println("[OK] No leftover mounts found")
+	} else {
+		fmt.Printf("[OK] Released %d mount(s); the workspace can now be removed safely\n", len(released))
+	}
+	return 0
+}
+
+func runLockCommand(args []string) int {
+	if len(args) == 0 || args[0] != "update" {
+		fmt.Printf("Usage: %s %s\n", os.Args[0], lockUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("lock update", flag.ExitOnError)
+	mirrorURL := fs.String("mirror", "", "Override APT repository mirror URL")
+	lockfile := fs.String("lockfile", "", "Lockfile path (default: <config>.lock next to the configuration)")
+	fs.Parse(args[1:])
+
+	if fs.NArg() != 1 {
+		fmt.Printf("Usage: %s %s\n", os.Args[0], lockUsage)
+		return 2
+	}
+
+	cfg, err := config.LoadFromFile(fs.Arg(0))
+	if err != nil {
+		fatal("Configuration loading failed: %v", err)
+	}
+	if *mirrorURL != "" {
+		cfg.Repository.Mirror = *mirrorURL
+	}
+	if err := cfg.Validate(); err != nil {
+		fatal("Configuration validation failed: %v", err)
+	}
+
+	b := builder.NewBuilder(cfg, "", "")
+	b.LockfilePath = lockfilePath(*lockfile, fs.Arg(0), "")
+	b.ConfigFile = fs.Arg(0)
+
+	fmt.Printf("[INFO] Refreshing %s from the current repositories...\n", b.LockfilePath)
+	changes, err := b.UpdateLockfile()
+	if err != nil {
+		fatal("Lockfile update failed: %v", err)
+	}
+
+	for _, c := range changes {
+		if c.To == "" {
+			fmt.Printf("  - %-40s %s (no longer available; removed)\n", c.Name, c.From)
+		} else {
+			fmt.Printf("  ~ %-40s %s -> %s\n", c.Name, c.From, c.To)
+		}
+	}
+	fmt.Printf("[OK] %d package(s) changed\n", len(changes))
+	return 0
+}
+
+func runAnalyzeCommand(args []string) int {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	top := fs.Int("top", 25, "Number of packages, directories and changes to list")
+	compare := fs.String("compare", "", "Earlier workspace, ISO or size report to compare against")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Printf("Usage: %s %s\n", os.Args[0], analyzeUsage)
+		return 2
+	}
+
+	report, err := builder.LoadSizeReport(fs.Arg(0))
+	if err != nil {
+		fatal("Size report unavailable: %v", err)
+	}
+	fmt.Print(report.Format(*top))
+
+	if *compare != "" {
+		previous, err := builder.LoadSizeReport(*compare)
+		if err != nil {
+			fatal("Comparison report unavailable: %v", err)
+		}
+		fmt.Print(builder.CompareSizeReports(previous, report).Format(*top))
+	}
+	return 0
+}
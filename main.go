@@ -20,6 +20,14 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			log.SetFlags(0)
+			log.SetOutput(new(formalLogger))
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+
 	var (
 		configFile    = flag.String("config", "", "Path to the JSON configuration file")
 		release       = flag.String("release", "noble", "Target release codename (e.g. noble, jammy, bookworm, trixie, sid)")
@@ -32,6 +40,15 @@ func main() {
 		checkDeps     = flag.Bool("check-deps", false, "Verify system build dependencies")
 		installDeps   = flag.Bool("install-deps", false, "Install missing build dependencies (requires elevated privileges)")
 		mirrorURL     = flag.String("mirror", "", "Override APT repository mirror URL")
+		offline       = flag.Bool("offline", false, "Build without network access from a local (file:// or local HTTP) mirror")
+		assetsDir     = flag.String("assets-dir", "", "Directory holding local build assets such as Memtest86+ binaries")
+		backend       = flag.String("backend", "", "Command execution backend inside the target: chroot or nspawn")
+		waitLock      = flag.Bool("wait-lock", false, "Wait for another build holding the workspace lock instead of failing")
+		locked        = flag.Bool("locked", false, "Install exactly the package versions recorded in the lockfile")
+		lockfile      = flag.String("lockfile", "", "Package lockfile path (default: <config>.lock next to the configuration)")
+		dryRun        = flag.Bool("dry-run", false, "Print the configuration files the build would write into the image, without building")
+		skipPreflight = flag.Bool("skip-preflight", false, "Continue even if disk, memory or mount preflight checks report problems")
+		rootless      = flag.Bool("rootless", false, "Build without root inside a user namespace (requires uidmap, mmdebstrap and /etc/subuid entries)")
 		wizardMode    = flag.Bool("wizard", false, "Launch the interactive configuration wizard (TUI)")
 		wizardCLIMode = flag.Bool("wizard-cli", false, "Launch the classic CLI configuration wizard")
 	)
@@ -78,6 +95,7 @@ func main() {
 		fmt.Printf("  sudo %s [options]\n", os.Args[0])
 		fmt.Printf("\nOptions:\n")
 		flag.PrintDefaults()
+		printSubcommandUsage()
 		fmt.Printf("\nExamples:\n")
 		fmt.Printf("  sudo %s --wizard\n", os.Args[0])
 		fmt.Printf("  sudo %s --wizard-cli\n", os.Args[0])
@@ -98,35 +116,163 @@ func main() {
 		fatal("%s requires an APT-based distribution (Debian or Ubuntu)", config.AppName)
 	}
 
-	if os.Geteuid() != 0 {
-		fatal("%s must be executed with elevated privileges (sudo)", config.AppName)
+	if os.Geteuid() != 0 && !*rootless && !*dryRun {
+		fatal("%s must be executed with elevated privileges (sudo) or with --rootless", config.AppName)
+	}
+
+	// resolveConfig loads the configuration and applies command-line
+	// overrides; dependency checks and builds both resolve it the same way.
+	resolveConfig := func() (*config.Config, string, string) {
+		var selectedRelease string
+		releaseAliases := map[string]string{
+			"lts":      "noble",
+			"rolling":  "devel",
+			"unstable": "devel",
+		}
+
+		releaseExplicit := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "release" {
+				releaseExplicit = true
+			}
+		})
+
+		inputRelease := *release
+		if mapped, ok := releaseAliases[inputRelease]; ok {
+			fmt.Printf("[INFO] Release alias '%s' resolved to '%s'\n", inputRelease, mapped)
+			inputRelease = mapped
+		}
+		selectedRelease = inputRelease
+
+		_, defaultWorkDir := system.GetAppPaths()
+
+		var baseWorkDir string
+		if *workDir != "" {
+			baseWorkDir = *workDir
+		} else if *configFile != "" {
+			absPath, err := filepath.Abs(*configFile)
+			if err != nil {
+				fatal("Failed to resolve configuration file path: %v", err)
+			}
+			baseWorkDir = filepath.Join(filepath.Dir(absPath), "kagami-workspace")
+		} else {
+			baseWorkDir = defaultWorkDir
+		}
+
+		var isoPath string
+		if *outputISO != "" {
+			isoPath = *outputISO
+		} else {
+			isoPath = ""
+		}
+
+		var cfg *config.Config
+		var err error
+
+		if *configFile != "" {
+			cfg, err = config.LoadFromFile(*configFile)
+			if err != nil {
+				fatal("Configuration loading failed: %v", err)
+			}
+			if releaseExplicit {
+				cfg.Release = selectedRelease
+			}
+		} else {
+			cfg = config.NewDefaultConfig(selectedRelease)
+			cfg.System.Hostname = *hostname
+			cfg.System.BlockSnapd = *noSnapd
+		}
+
+		if isoPath == "" {
+			isoPath = filepath.Join(baseWorkDir, fmt.Sprintf("kagami-%s-%s.iso", cfg.Distro, cfg.Release))
+		}
+
+		if *mirrorURL != "" {
+			cfg.Repository.Mirror = *mirrorURL
+		}
+
+		if *offline {
+			cfg.Build.Offline = true
+		}
+		if *assetsDir != "" {
+			cfg.Build.AssetsDir = *assetsDir
+		}
+		if *backend != "" {
+			cfg.Build.Backend = *backend
+		}
+		if *skipPreflight {
+			cfg.Build.SkipPreflight = true
+		}
+
+		if err := cfg.Validate(); err != nil {
+			fatal("Configuration validation failed: %v", err)
+		}
+
+		return cfg, baseWorkDir, isoPath
+	}
+
+	// resolveBuildConfig returns the configuration as the build will see it,
+	// so the host requirements include what snap replacements add.
+	resolveBuildConfig := func() *config.Config {
+		cfg, baseWorkDir, isoPath := resolveConfig()
+		if err := builder.NewBuilder(cfg, baseWorkDir, isoPath).PrepareConfig(); err != nil {
+			fatal("Configuration preparation failed: %v", err)
+		}
+		return cfg
 	}
 
 	if *checkDeps {
+		cfg := resolveBuildConfig()
 		fmt.Println("\n[INFO] Verifying build dependencies...")
-		deps := system.CheckDependencies()
+		deps := system.CheckDependencies(cfg, *rootless)
+		for _, dep := range deps.MissingOptional {
+			fmt.Printf("[INFO] Optional: %s (%s) for %s\n", dep.Name, dep.Package, dep.Reason)
+		}
 		if len(deps.Missing) == 0 {
 			fmt.Println("[OK] All required dependencies are present")
 			os.Exit(0)
 		}
 		fmt.Println("\n[INFO] Absent dependencies:")
 		for _, dep := range deps.Missing {
-			fmt.Printf("  - %s\n", dep)
+			fmt.Printf("  - %-20s %-48s %s\n", dep.Package, dep.Name, dep.Reason)
 		}
-		fmt.Printf("\nInstall command: sudo apt-get install %s\n", system.GetInstallCommand(deps.Missing))
+		fmt.Printf("\nInstall command: sudo apt-get install %s\n", system.GetInstallCommand(deps.MissingPackages(false)))
 		fmt.Println("Alternatively: sudo kagami --install-deps")
 		os.Exit(1)
 	}
 
 	if *installDeps {
+		cfg := resolveBuildConfig()
 		fmt.Println("\n[INFO] Installing build dependencies...")
-		if err := system.InstallDependencies(); err != nil {
+		if err := system.InstallDependencies(cfg, *rootless); err != nil {
 			fatal("Dependency installation failed: %v", err)
 		}
 		fmt.Println("[OK] All dependencies installed successfully")
 		os.Exit(0)
 	}
 
+	if *dryRun {
+		cfg, baseWorkDir, isoPath := resolveConfig()
+		b := builder.NewBuilder(cfg, baseWorkDir, isoPath)
+		b.LockfilePath = lockfilePath(*lockfile, *configFile, baseWorkDir)
+		b.ConfigFile = *configFile
+		b.Locked = *locked
+		files, err := b.RenderConfiguration()
+		if err != nil {
+			fatal("Dry run failed: %v", err)
+		}
+		printRenderedFiles(files)
+		os.Exit(0)
+	}
+
+	if *rootless {
+		if code, ok := system.RunRootless(); ok {
+			os.Exit(code)
+		}
+	} else if code, ok := system.RunInMountNamespace(); ok {
+		os.Exit(code)
+	}
+
 	if *wizardMode || *wizardCLIMode {
 		var cfg *config.Config
 		var outputPath string
@@ -154,6 +300,13 @@ func main() {
 		wizardIsoPath := filepath.Join(wizardWorkDir, fmt.Sprintf("kagami-%s.iso", cfg.Release))
 
 		b := builder.NewBuilder(cfg, wizardWorkDir, wizardIsoPath)
+		b.LockfilePath = lockfilePath(*lockfile, outputPath, wizardWorkDir)
+		b.ConfigFile = outputPath
+		b.RelocatedISO = relocationTarget(wizardIsoPath, wizardWorkDir)
+		b.Locked = *locked
+		if err := b.LockWorkspace(*waitLock); err != nil {
+			fatal("%v", err)
+		}
 		stopSignals := setupSignalHandler(b)
 		defer close(stopSignals)
 
@@ -161,6 +314,7 @@ func main() {
 			if err := tui.ShowBuild(b); err != nil {
 				fmt.Printf("\n[ERROR] %v\n", err)
 				offerCleanup(b, false)
+				b.UnlockWorkspace()
 				os.Exit(1)
 			}
 		} else {
@@ -168,99 +322,28 @@ func main() {
 			if err := b.Build(); err != nil {
 				fmt.Printf("\n[ERROR] %v\n", err)
 				offerCleanup(b, false)
+				b.UnlockWorkspace()
 				os.Exit(1)
 			}
 		}
 
 		wizardIsoPath = relocateISO(wizardIsoPath, wizardWorkDir)
-		printBuildSuccess(wizardIsoPath)
+		printBuildSuccess(wizardIsoPath, b)
 		offerCleanup(b, true)
+		b.UnlockWorkspace()
 		os.Exit(0)
 	}
 
-	deps := system.CheckDependencies()
-	if len(deps.Missing) > 0 {
-		fmt.Println("\n[ERROR] Absent build dependencies:")
-		for _, dep := range deps.Missing {
-			fmt.Printf("  - %s\n", dep)
-		}
-		fmt.Println("\nExecute: sudo kagami --install-deps")
-		os.Exit(1)
-	}
-
-	var selectedRelease string
-	releaseAliases := map[string]string{
-		"lts":      "noble",
-		"rolling":  "devel",
-		"unstable": "devel",
-	}
-
-	releaseExplicit := false
-	flag.Visit(func(f *flag.Flag) {
-		if f.Name == "release" {
-			releaseExplicit = true
-		}
-	})
-
-	inputRelease := *release
-	if mapped, ok := releaseAliases[inputRelease]; ok {
-		fmt.Printf("[INFO] Release alias '%s' resolved to '%s'\n", inputRelease, mapped)
-		inputRelease = mapped
-	}
-	selectedRelease = inputRelease
-
-	_, defaultWorkDir := system.GetAppPaths()
-
-	var baseWorkDir string
-	if *workDir != "" {
-		baseWorkDir = *workDir
-	} else if *configFile != "" {
-		absPath, err := filepath.Abs(*configFile)
-		if err != nil {
-			fatal("Failed to resolve configuration file path: %v", err)
-		}
-		baseWorkDir = filepath.Join(filepath.Dir(absPath), "kagami-workspace")
-	} else {
-		baseWorkDir = defaultWorkDir
-	}
-
-	var isoPath string
-	if *outputISO != "" {
-		isoPath = *outputISO
-	} else {
-		isoPath = ""
-	}
-
-	var cfg *config.Config
-	var err error
-
-	if *configFile != "" {
-		cfg, err = config.LoadFromFile(*configFile)
-		if err != nil {
-			fatal("Configuration loading failed: %v", err)
-		}
-		if releaseExplicit {
-			cfg.Release = selectedRelease
-		}
-	} else {
-		cfg = config.NewDefaultConfig(selectedRelease)
-		cfg.System.Hostname = *hostname
-		cfg.System.BlockSnapd = *noSnapd
-	}
-
-	if isoPath == "" {
-		isoPath = filepath.Join(baseWorkDir, fmt.Sprintf("kagami-%s-%s.iso", cfg.Distro, cfg.Release))
-	}
-
-	if *mirrorURL != "" {
-		cfg.Repository.Mirror = *mirrorURL
-	}
-
-	if err := cfg.Validate(); err != nil {
-		fatal("Configuration validation failed: %v", err)
-	}
+	cfg, baseWorkDir, isoPath := resolveConfig()
 
 	b := builder.NewBuilder(cfg, baseWorkDir, isoPath)
+	b.LockfilePath = lockfilePath(*lockfile, *configFile, baseWorkDir)
+	b.ConfigFile = *configFile
+	b.RelocatedISO = relocationTarget(isoPath, baseWorkDir)
+	b.Locked = *locked
+	if err := b.LockWorkspace(*waitLock); err != nil {
+		fatal("%v", err)
+	}
 	stopSignals := setupSignalHandler(b)
 	defer close(stopSignals)
 
@@ -275,12 +358,29 @@ func main() {
 	if err := b.Build(); err != nil {
 		fmt.Printf("\n[ERROR] %v\n", err)
 		offerCleanup(b, false)
+		b.UnlockWorkspace()
 		os.Exit(1)
 	}
 
 	isoPath = relocateISO(isoPath, baseWorkDir)
-	printBuildSuccess(isoPath)
+	printBuildSuccess(isoPath, b)
 	offerCleanup(b, true)
+	b.UnlockWorkspace()
+}
+
+// lockfilePath names the lockfile after its configuration, so configurations
+// sharing a directory keep separate lockfiles. Builds without one keep it in
+// the workspace.
+func lockfilePath(explicit, configFile, workDir string) string {
+	if explicit != "" {
+		return explicit
+	}
+	if configFile != "" {
+		if abs, err := filepath.Abs(configFile); err == nil {
+			return strings.TrimSuffix(abs, filepath.Ext(abs)) + ".lock"
+		}
+	}
+	return filepath.Join(workDir, builder.LockfileName)
 }
 
 func printBuildInfo(cfg *config.Config, workDir, isoPath string) {
@@ -295,21 +395,69 @@ func printBuildInfo(cfg *config.Config, workDir, isoPath string) {
 	fmt.Printf("  Snapd Block:  %v\n", cfg.System.BlockSnapd)
 	fmt.Printf("  Desktop:      %s\n", resolveDesktopLabel(cfg))
 	fmt.Printf("  Installer:    %s\n", cfg.Installer.Type)
+	if system.IsRootless() {
+		fmt.Printf("  Mounts:       private namespace (rootless)\n")
+	} else if system.InPrivateMountNamespace() {
+		fmt.Printf("  Mounts:       private namespace\n")
+	} else {
+		fmt.Printf("  Mounts:       host namespace\n")
+	}
+	if cfg.Build.Backend != "" {
+		fmt.Printf("  Backend:      %s\n", cfg.Build.Backend)
+	}
+	if cfg.Build.Offline {
+		fmt.Printf("  Offline:      %v (mirror: %s)\n", cfg.Build.Offline, cfg.Repository.Mirror)
+	}
+	if cfg.Repository.Snapshot != "" {
+		fmt.Printf("  Snapshot:     %s\n", cfg.Repository.Snapshot)
+	}
 	fmt.Println()
 }
 
-func printBuildSuccess(isoPath string) {
+func printBuildSuccess(isoPath string, b *builder.Builder) {
 	fmt.Println("\n---------------------------------------------------------------")
 	fmt.Println("  [OK] Build process concluded successfully")
 	fmt.Println("---------------------------------------------------------------")
 	fmt.Printf("\n[OUTPUT] ISO path:  %s\n", isoPath)
 	fmt.Printf("[OUTPUT] ISO size:  %s\n", computeFileSize(isoPath))
+	fmt.Printf("[OUTPUT] Report:    %s\n", builder.ReportPath(isoPath))
+	if subs := b.SnapSubstitutions(); len(subs) > 0 {
+		fmt.Println("\n[INFO] Snap packages replaced:")
+		for _, sub := range subs {
+			fmt.Printf("  %s\n", sub)
+		}
+	}
+	if failures := b.InstallFailures(); len(failures) > 0 {
+		fmt.Println("\n[WARNING] Packages that failed to install:")
+		for _, f := range failures {
+			fmt.Printf("  %-12s %s\n", f.Group+":", strings.Join(f.Packages, ", "))
+		}
+	}
 	fmt.Println("\n[INFO] Recommended next steps:")
 	fmt.Println("  Virtualised validation: qemu-system-x86_64 -cdrom <iso> -m 2048")
 	fmt.Println("  Physical media write:   sudo dd if=<iso> of=/dev/sdX bs=4M status=progress")
 	fmt.Println()
 }
 
+func printRenderedFiles(files []builder.RenderedFile) {
+	for _, f := range files {
+		switch f.Op {
+		case "write", "append":
+			fmt.Printf("[%s] %s (%04o)\n", f.Op, f.Path, f.Mode)
+			for _, line := range strings.Split(strings.TrimSuffix(f.Content, "\n"), "\n") {
+				fmt.Printf("    %s\n", line)
+			}
+		case "symlink", "divert", "copy":
+			fmt.Printf("[%s] %s -> %s\n", f.Op, f.Path, f.Target)
+		case "chmod":
+			fmt.Printf("[%s] %s (%04o)\n", f.Op, f.Path, f.Mode)
+		default:
+			fmt.Printf("[%s] %s\n", f.Op, f.Path)
+		}
+	}
+	fmt.Printf("\n[INFO] %d file operation(s); steps that need a populated chroot or network access are not shown\n", len(files))
+}
+
 func printBanner() {
 	fmt.Printf("%s - Debian/Ubuntu ISO Builder %s\n", config.AppName, config.Version)
 	fmt.Println("Vanilla Desktop Environment Synthesis")
@@ -381,7 +529,7 @@ func offerCleanup(b *builder.Builder, success bool) {
 		fmt.Print("  Unmount and remove workspace? [Y/n]: ")
 		input, _ = reader.ReadString('\n')
 		if strings.ToLower(strings.TrimSpace(input)) != "n" {
-			b.RemoveWorkspace()
+			removeWorkspace(b)
 		}
 		return
 	}
@@ -389,17 +537,40 @@ func offerCleanup(b *builder.Builder, success bool) {
 	fmt.Print("\nRemove build workspace and chroot? [y/N]: ")
 	input, _ = reader.ReadString('\n')
 	if strings.ToLower(strings.TrimSpace(input)) == "y" {
-		b.RemoveWorkspace()
+		removeWorkspace(b)
 	}
 }
 
-func relocateISO(isoPath, workDir string) string {
+func removeWorkspace(b *builder.Builder) {
+	if err := b.RemoveWorkspace(); err != nil {
+		fmt.Printf("[ERROR] Workspace not removed: %v\n", err)
+	}
+}
+
+func relocateReport(from, to string) {
+	if err := os.Rename(from, to); err == nil || os.IsNotExist(err) {
+		return
+	}
+	data, err := os.ReadFile(from)
+	if err == nil {
+		err = os.WriteFile(to, data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("[WARNING] Build report could not be relocated: %v\n", err)
+		return
+	}
+	os.Remove(from)
+}
+
+// relocationTarget returns where relocateISO moves an ISO built inside the
+// workspace, or an empty string when it stays where it is.
+func relocationTarget(isoPath, workDir string) string {
 	absISO, _ := filepath.Abs(isoPath)
 	absWork, _ := filepath.Abs(workDir)
 
 	rel, err := filepath.Rel(absWork, absISO)
 	if err != nil || strings.HasPrefix(rel, "..") {
-		return isoPath
+		return ""
 	}
 
 	var destDir string
@@ -422,11 +593,23 @@ func relocateISO(isoPath, workDir string) string {
 	absNew, _ := filepath.Abs(newPath)
 
 	if absISO == absNew {
+		return ""
+	}
+	return absNew
+}
+
+func relocateISO(isoPath, workDir string) string {
+	absNew := relocationTarget(isoPath, workDir)
+	if absNew == "" {
 		return isoPath
 	}
+	absISO, _ := filepath.Abs(isoPath)
 
 	fmt.Printf("\n[INFO] Relocating ISO from workspace to: %s\n", absNew)
 
+	relocateReport(builder.ReportPath(absISO), builder.ReportPath(absNew))
+	relocateReport(builder.SizeReportPath(absISO), builder.SizeReportPath(absNew))
+
 	if err := os.Rename(absISO, absNew); err == nil {
 		return absNew
 	}
@@ -469,7 +652,7 @@ func setupSignalHandler(b *builder.Builder) chan struct{} {
 			// Disable callbacks to prevent logging back to a potentially closed TUI
 			b.OnLog = nil
 			b.OnProgress = nil
-			b.RemoveWorkspace()
+			removeWorkspace(b)
 			fmt.Println("[OK] Cleanup complete. Exiting.")
 			os.Exit(128 + int(sig.(syscall.Signal)))
 		case <-stop:
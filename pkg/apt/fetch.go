@@ -0,0 +1,225 @@
+package apt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Source struct {
+	Name       string
+	URI        string
+	Suite      string
+	Components []string
+}
+
+// Fetcher downloads Packages indices into an on-disk cache. Cached copies
+// younger than MaxAge are used without contacting the repository, and stale
+// copies are used as a fallback when the repository is unreachable.
+type Fetcher struct {
+	CacheDir string
+	MaxAge   time.Duration
+	Client   *http.Client
+	OnLog    func(msg string)
+}
+
+func NewFetcher(cacheDir string) *Fetcher {
+	return &Fetcher{
+		CacheDir: cacheDir,
+		MaxAge:   6 * time.Hour,
+		Client:   &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// DefaultCacheDir is shared by `kagami check` and builds so an unprivileged
+// check warms the cache for the subsequent build.
+func DefaultCacheDir() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "kagami", "indices")
+}
+
+func (f *Fetcher) LoadIndex(sources []Source, arch string) (*Index, []error) {
+	idx := NewIndex()
+	var errs []error
+
+	for _, src := range sources {
+		archive, codename := f.releaseFields(src)
+		for _, base := range indexBases(src, arch) {
+			pkgs, err := f.fetchPackages(base, src.Name)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", base, err))
+				continue
+			}
+			for _, p := range pkgs {
+				p.Suite = src.Suite
+				p.Origin = SourceOrigin(src.URI)
+				p.Archive = archive
+				p.Codename = codename
+			}
+			idx.Add(pkgs...)
+		}
+	}
+
+	return idx, errs
+}
+
+// SourceOrigin returns the host name APT matches "Pin: origin" against, which
+// is empty for file: and other local sources.
+func SourceOrigin(uri string) string {
+	if u, err := url.Parse(uri); err == nil {
+		return u.Hostname()
+	}
+	return ""
+}
+
+// releaseFields reads the Suite and Codename fields of the source's Release
+// file. A dist such as noble-updates has archive noble-updates and codename
+// noble, while bookworm-backports has archive stable-backports and codename
+// bookworm-backports. Without a Release file both are the configured suite.
+func (f *Fetcher) releaseFields(src Source) (archive, codename string) {
+	archive, codename = strings.TrimSuffix(src.Suite, "/"), strings.TrimSuffix(src.Suite, "/")
+
+	uri := strings.TrimSuffix(src.URI, "/")
+	releaseURL := fmt.Sprintf("%s/dists/%s/Release", uri, src.Suite)
+	if strings.HasSuffix(src.Suite, "/") {
+		releaseURL = fmt.Sprintf("%s/%sRelease", uri, strings.TrimPrefix(src.Suite, "./"))
+	}
+
+	data, err := f.fetchCached(releaseURL)
+	if err != nil {
+		return archive, codename
+	}
+	stanzas, err := ParseStanzas(bytes.NewReader(data))
+	if err != nil || len(stanzas) == 0 {
+		return archive, codename
+	}
+
+	if v := stanzas[0]["Suite"]; v != "" {
+		archive = v
+	}
+	if v := stanzas[0]["Codename"]; v != "" {
+		codename = v
+	}
+	return archive, codename
+}
+
+func indexBases(src Source, arch string) []string {
+	uri := strings.TrimSuffix(src.URI, "/")
+
+	if strings.HasSuffix(src.Suite, "/") {
+		return []string{fmt.Sprintf("%s/%sPackages", uri, strings.TrimPrefix(src.Suite, "./"))}
+	}
+
+	var bases []string
+	for _, comp := range src.Components {
+		bases = append(bases, fmt.Sprintf("%s/dists/%s/%s/binary-%s/Packages", uri, src.Suite, comp, arch))
+	}
+	return bases
+}
+
+func (f *Fetcher) fetchPackages(base, repo string) ([]*Package, error) {
+	var lastErr error
+
+	for _, ext := range []string{".gz", ".xz", ""} {
+		data, err := f.fetchCached(base + ext)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		r, err := decompress(data, ext)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		return ParsePackages(r, repo)
+	}
+
+	return nil, lastErr
+}
+
+func (f *Fetcher) fetchCached(rawURL string) ([]byte, error) {
+	if strings.HasPrefix(rawURL, "file:") {
+		return f.download(rawURL)
+	}
+
+	cachePath := filepath.Join(f.CacheDir, cacheKey(rawURL))
+
+	if info, err := os.Stat(cachePath); err == nil && time.Since(info.ModTime()) < f.MaxAge {
+		return os.ReadFile(cachePath)
+	}
+
+	data, err := f.download(rawURL)
+	if err != nil {
+		if cached, cacheErr := os.ReadFile(cachePath); cacheErr == nil {
+			f.log(fmt.Sprintf("[WARNING] Using stale cached index for %s: %v\n", rawURL, err))
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err == nil {
+		os.WriteFile(cachePath, data, 0644)
+	}
+	return data, nil
+}
+
+func (f *Fetcher) download(rawURL string) ([]byte, error) {
+	if strings.HasPrefix(rawURL, "file:") {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(u.Path)
+	}
+
+	resp, err := f.Client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (f *Fetcher) log(msg string) {
+	if f.OnLog != nil {
+		f.OnLog(msg)
+	}
+}
+
+func decompress(data []byte, ext string) (io.Reader, error) {
+	switch ext {
+	case ".gz":
+		return gzip.NewReader(bytes.NewReader(data))
+	case ".xz":
+		cmd := exec.Command("xz", "-dc")
+		cmd.Stdin = bytes.NewReader(data)
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("xz decompression failed: %v", err)
+		}
+		return bytes.NewReader(out), nil
+	}
+	return bytes.NewReader(data), nil
+}
+
+func cacheKey(rawURL string) string {
+	replacer := strings.NewReplacer("://", "_", "/", "_", ":", "_", "?", "_", "&", "_")
+	return replacer.Replace(rawURL)
+}
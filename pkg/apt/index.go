@@ -0,0 +1,175 @@
+package apt
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Package struct {
+	Name          string
+	Version       string
+	Architecture  string
+	Provides      []string
+	Depends       string
+	PreDepends    string
+	Recommends    string
+	InstalledSize int64
+	Filename      string
+	Repo          string
+	Suite         string
+	Origin        string
+
+	// Archive and Codename come from the source's Release file, which is
+	// what "Pin: release a=" and "n=" match. Both fall back to Suite.
+	Archive  string
+	Codename string
+}
+
+type Index struct {
+	packages map[string][]*Package
+	provides map[string][]*Package
+}
+
+func NewIndex() *Index {
+	return &Index{
+		packages: make(map[string][]*Package),
+		provides: make(map[string][]*Package),
+	}
+}
+
+// ParseStanzas splits a deb822 control stream (Packages, status, Release)
+// into field maps. Continuation lines are joined with newlines.
+func ParseStanzas(r io.Reader) ([]map[string]string, error) {
+	var stanzas []map[string]string
+	current := make(map[string]string)
+	var lastKey string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.TrimSpace(line) == "" {
+			if len(current) > 0 {
+				stanzas = append(stanzas, current)
+				current = make(map[string]string)
+			}
+			lastKey = ""
+			continue
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && lastKey != "" {
+			current[lastKey] += "\n" + strings.TrimSpace(line)
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		lastKey = strings.TrimSpace(key)
+		current[lastKey] = strings.TrimSpace(value)
+	}
+
+	if len(current) > 0 {
+		stanzas = append(stanzas, current)
+	}
+
+	return stanzas, scanner.Err()
+}
+
+func ParsePackages(r io.Reader, repo string) ([]*Package, error) {
+	stanzas, err := ParseStanzas(r)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgs := make([]*Package, 0, len(stanzas))
+	for _, st := range stanzas {
+		name := st["Package"]
+		if name == "" {
+			continue
+		}
+		size, _ := strconv.ParseInt(st["Installed-Size"], 10, 64)
+		pkgs = append(pkgs, &Package{
+			Name:          name,
+			Version:       st["Version"],
+			Architecture:  st["Architecture"],
+			Provides:      RelationNames(st["Provides"]),
+			Depends:       st["Depends"],
+			PreDepends:    st["Pre-Depends"],
+			Recommends:    st["Recommends"],
+			InstalledSize: size,
+			Filename:      st["Filename"],
+			Repo:          repo,
+		})
+	}
+	return pkgs, nil
+}
+
+// RelationNames extracts the package names from a relationship field such
+// as Depends or Provides, discarding version constraints, architecture
+// qualifiers and alternatives markers.
+func RelationNames(field string) []string {
+	var names []string
+	for _, clause := range strings.Split(field, ",") {
+		for _, alt := range strings.Split(clause, "|") {
+			name := strings.TrimSpace(alt)
+			if i := strings.IndexAny(name, " (["); i >= 0 {
+				name = name[:i]
+			}
+			if i := strings.Index(name, ":"); i >= 0 {
+				name = name[:i]
+			}
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func (idx *Index) Add(pkgs ...*Package) {
+	for _, p := range pkgs {
+		idx.packages[p.Name] = append(idx.packages[p.Name], p)
+		for _, prov := range p.Provides {
+			idx.provides[prov] = append(idx.provides[prov], p)
+		}
+	}
+}
+
+func (idx *Index) Len() int {
+	return len(idx.packages)
+}
+
+func (idx *Index) Lookup(name string) []*Package {
+	return idx.packages[name]
+}
+
+func (idx *Index) Providers(name string) []*Package {
+	return idx.provides[name]
+}
+
+// Has reports whether name is installable, either as a real package or as
+// a virtual package provided by one.
+func (idx *Index) Has(name string) bool {
+	return len(idx.packages[name]) > 0 || len(idx.provides[name]) > 0
+}
+
+func (idx *Index) Names() []string {
+	names := make([]string, 0, len(idx.packages)+len(idx.provides))
+	for n := range idx.packages {
+		names = append(names, n)
+	}
+	for n := range idx.provides {
+		if _, real := idx.packages[n]; !real {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
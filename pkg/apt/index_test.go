@@ -0,0 +1,88 @@
+package apt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStanzas(t *testing.T) {
+	input := `Package: hello
+Version: 2.10-3
+Description: example package
+ that greets
+	the world
+
+` + "\n\n" + `Package: bye
+Depends: libc6 (>= 2.34)
+not a field
+Installed-Size:  12
+`
+	stanzas, err := ParseStanzas(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []map[string]string{
+		{"Package": "hello", "Version": "2.10-3", "Description": "example package\nthat greets\nthe world"},
+		{"Package": "bye", "Depends": "libc6 (>= 2.34)", "Installed-Size": "12"},
+	}
+	if !reflect.DeepEqual(stanzas, want) {
+		t.Errorf("ParseStanzas:\n got %q\nwant %q", stanzas, want)
+	}
+}
+
+func TestRelationNames(t *testing.T) {
+	cases := []struct {
+		field string
+		want  []string
+	}{
+		{"", nil},
+		{"libc6", []string{"libc6"}},
+		{"libc6 (>= 2.34), libgcc-s1", []string{"libc6", "libgcc-s1"}},
+		{"firefox | www-browser", []string{"firefox", "www-browser"}},
+		{"python3:any (>= 3.11~), perl:native", []string{"python3", "perl"}},
+		{"grub-pc [amd64 i386] | grub-efi-arm64 [arm64]", []string{"grub-pc", "grub-efi-arm64"}},
+		{"libfoo (<< 2) <!nocheck>,\n libbar", []string{"libfoo", "libbar"}},
+		{" , ", nil},
+	}
+	for _, c := range cases {
+		if got := RelationNames(c.field); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("RelationNames(%q) = %q, want %q", c.field, got, c.want)
+		}
+	}
+}
+
+func TestParsePackages(t *testing.T) {
+	input := `Package: firefox
+Version: 1:1snap1-0ubuntu5
+Architecture: amd64
+Provides: gnome-www-browser, www-browser (= 1)
+Pre-Depends: debconf
+Depends: snapd
+Installed-Size: 60
+Filename: pool/main/f/firefox/firefox.deb
+
+Version: 1.0
+`
+	pkgs, err := ParsePackages(strings.NewReader(input), "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 1 {
+		t.Fatalf("parsed %d packages, want 1", len(pkgs))
+	}
+	p := pkgs[0]
+	if p.Name != "firefox" || p.Version != "1:1snap1-0ubuntu5" || p.InstalledSize != 60 || p.Repo != "archive" {
+		t.Errorf("unexpected package %+v", p)
+	}
+	if !reflect.DeepEqual(p.Provides, []string{"gnome-www-browser", "www-browser"}) {
+		t.Errorf("Provides = %q", p.Provides)
+	}
+
+	idx := NewIndex()
+	idx.Add(pkgs...)
+	if !idx.Has("firefox") || !idx.Has("www-browser") || idx.Has("chromium") {
+		t.Error("index lookups do not match the parsed package")
+	}
+}
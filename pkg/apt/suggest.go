@@ -0,0 +1,76 @@
+package apt
+
+import (
+	"sort"
+	"strings"
+)
+
+// Suggest returns up to limit names from the index that are close to name,
+// preferring small edit distances and shared prefixes.
+func (idx *Index) Suggest(name string, limit int) []string {
+	type candidate struct {
+		name string
+		dist int
+	}
+
+	maxDist := 2
+	if len(name) > 10 {
+		maxDist = 3
+	}
+
+	var matches []candidate
+	for _, n := range idx.Names() {
+		if abs(len(n)-len(name)) > maxDist && !strings.HasPrefix(n, name) {
+			continue
+		}
+		d := levenshtein(name, n)
+		if strings.HasPrefix(n, name) && d > maxDist {
+			d = maxDist
+		}
+		if d <= maxDist {
+			matches = append(matches, candidate{n, d})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].dist != matches[j].dist {
+			return matches[i].dist < matches[j].dist
+		}
+		return matches[i].name < matches[j].name
+	})
+
+	var out []string
+	for i := 0; i < len(matches) && i < limit; i++ {
+		out = append(out, matches[i].name)
+	}
+	return out
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,51 @@
+package apt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLevenshtein(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"vim", "vim", 0},
+		{"vim", "vin", 1},
+		{"vim", "vi", 1},
+		{"kitten", "sitting", 3},
+	}
+	for _, c := range cases {
+		if got := levenshtein(c.a, c.b); got != c.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	idx := NewIndex()
+	for _, name := range []string{"vim", "vim-gtk3", "vim-tiny", "nvim", "neovim", "emacs", "gvim", "vino"} {
+		idx.Add(&Package{Name: name})
+	}
+	idx.Add(&Package{Name: "neovim-runtime", Provides: []string{"vi"}})
+
+	cases := []struct {
+		name  string
+		limit int
+		want  []string
+	}{
+		// Closest first, ties in name order; prefixed names count as at
+		// most the maximum distance.
+		{"vimm", 3, []string{"vim", "gvim", "nvim"}},
+		{"vim", 10, []string{"vim", "gvim", "nvim", "vi", "vim-gtk3", "vim-tiny", "vino"}},
+		{"emcas", 5, []string{"emacs"}},
+		{"libreoffice", 3, nil},
+	}
+	for _, c := range cases {
+		if got := idx.Suggest(c.name, c.limit); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Suggest(%q, %d) = %q, want %q", c.name, c.limit, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package apt
+
+import (
+	"strings"
+)
+
+// CompareVersions orders two Debian version strings the way dpkg does,
+// returning -1, 0 or 1.
+func CompareVersions(a, b string) int {
+	aEpoch, aUpstream, aRevision := splitVersion(a)
+	bEpoch, bUpstream, bRevision := splitVersion(b)
+
+	if c := compareNumeric(aEpoch, bEpoch); c != 0 {
+		return c
+	}
+	if c := compareFragment(aUpstream, bUpstream); c != 0 {
+		return c
+	}
+	return compareFragment(aRevision, bRevision)
+}
+
+func splitVersion(v string) (epoch, upstream, revision string) {
+	v = strings.TrimSpace(v)
+	epoch = "0"
+	if i := strings.Index(v, ":"); i >= 0 {
+		epoch, v = v[:i], v[i+1:]
+	}
+	if i := strings.LastIndex(v, "-"); i >= 0 {
+		v, revision = v[:i], v[i+1:]
+	}
+	return epoch, v, revision
+}
+
+// compareFragment alternates between non-digit runs, compared with dpkg's
+// character order, and digit runs, compared numerically.
+func compareFragment(a, b string) int {
+	for a != "" || b != "" {
+		var aText, bText string
+		aText, a = splitRun(a, false)
+		bText, b = splitRun(b, false)
+		if c := compareText(aText, bText); c != 0 {
+			return c
+		}
+
+		var aNum, bNum string
+		aNum, a = splitRun(a, true)
+		bNum, b = splitRun(b, true)
+		if c := compareNumeric(aNum, bNum); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func splitRun(s string, digits bool) (run, rest string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func compareNumeric(a, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareText(a, b string) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var ac, bc int
+		if i < len(a) {
+			ac = charOrder(a[i])
+		}
+		if i < len(b) {
+			bc = charOrder(b[i])
+		}
+		if ac != bc {
+			if ac < bc {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// charOrder ranks '~' before the end of a string, and letters before all
+// other characters.
+func charOrder(c byte) int {
+	switch {
+	case c == '~':
+		return -1
+	case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
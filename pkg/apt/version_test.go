@@ -0,0 +1,35 @@
+package apt
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1:0.1", "2.0", 1},
+		{"1.0-1", "1.0a-1", -1},
+		{"1.0+b1", "1.0", 1},
+		{"1.0", "0:1.0", 0},
+		{"0:1.0-1", "1.0-1", 0},
+		{"1.0", "1.0", 0},
+		{"1.10", "1.9", 1},
+		{"1.001", "1.1", 0},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-1ubuntu1", "1.0-1", 1},
+		{"2:1.0", "1:9.9", 1},
+		{"1.0a", "1.0+", -1},
+		{"1.0.0", "1.0", 1},
+	}
+	for _, c := range cases {
+		if got := CompareVersions(c.a, c.b); got != c.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+		if got := CompareVersions(c.b, c.a); got != -c.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", c.b, c.a, got, -c.want)
+		}
+	}
+}
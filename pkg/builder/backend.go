@@ -0,0 +1,65 @@
+package builder
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	BackendChroot = "chroot"
+	BackendNspawn = "nspawn"
+)
+
+func (b *Builder) backend() string {
+	if b.Config.Build.Backend == "" {
+		return BackendChroot
+	}
+	return b.Config.Build.Backend
+}
+
+func (b *Builder) usesNspawn() bool {
+	return b.backend() == BackendNspawn
+}
+
+func (b *Builder) execCommand(command string) *exec.Cmd {
+	if !b.usesNspawn() {
+		return exec.Command("chroot", b.ChrootDir, "/bin/bash", "-c", command)
+	}
+
+	args := append(b.nspawnArgs(), "/bin/bash", "-c", command)
+	cmd := exec.Command("systemd-nspawn", args...)
+	// Keep /tmp on disk as with chroot, so files staged there by earlier
+	// steps remain visible.
+	cmd.Env = append(os.Environ(), "SYSTEMD_NSPAWN_TMPFS_TMP=0")
+	return cmd
+}
+
+// nspawnArgs runs each command in a throwaway container: /proc, /sys, /dev
+// and /run are private and vanish with it, and the host's /run is never
+// visible to package scripts.
+func (b *Builder) nspawnArgs() []string {
+	args := []string{
+		"--quiet",
+		"--directory=" + b.ChrootDir,
+		"--register=no",
+		"--as-pid2",
+		"--console=pipe",
+		"--link-journal=no",
+		"--timezone=off",
+		"--resolv-conf=bind-host",
+		"--setenv=HOME=/root",
+		"--setenv=LC_ALL=C",
+	}
+
+	if b.Config.System.Hostname != "" {
+		args = append(args, "--hostname="+b.Config.System.Hostname)
+	}
+
+	for _, m := range b.localRepoBinds() {
+		target := "/" + strings.TrimPrefix(strings.TrimPrefix(m.target, b.ChrootDir), "/")
+		args = append(args, "--bind-ro="+m.source+":"+target)
+	}
+
+	return args
+}
@@ -0,0 +1,232 @@
+package builder
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type BootstrapOptions struct {
+	Arch       string
+	Suite      string
+	Target     string
+	Mirrors    []string
+	Components []string
+	Keyrings   []string
+	Include    []string
+	AptOptions []string
+	Mode       string
+	Tarball    string
+	Rootless   bool
+	Env        []string
+}
+
+// Bootstrapper creates the initial root filesystem at opts.Target. When
+// opts.Tarball is set the implementation may write a tarball there instead,
+// which the builder extracts into the target.
+type Bootstrapper interface {
+	Name() string
+	Available() bool
+	Bootstrap(b *Builder, opts BootstrapOptions) error
+}
+
+type debootstrapBootstrapper struct{}
+
+func (debootstrapBootstrapper) Name() string { return "debootstrap" }
+
+func (debootstrapBootstrapper) Available() bool {
+	_, err := exec.LookPath("debootstrap")
+	return err == nil
+}
+
+func (debootstrapBootstrapper) Bootstrap(b *Builder, opts BootstrapOptions) error {
+	args := []string{
+		"--arch=" + opts.Arch,
+		"--variant=minbase",
+	}
+
+	if len(opts.Components) > 0 {
+		args = append(args, "--components="+strings.Join(opts.Components, ","))
+	}
+	if len(opts.Include) > 0 {
+		args = append(args, "--include="+strings.Join(opts.Include, ","))
+	}
+	if len(opts.Keyrings) > 0 {
+		args = append(args, "--keyring="+opts.Keyrings[0])
+		if len(opts.Keyrings) > 1 {
+			log.Printf("[WARNING] debootstrap accepts a single keyring; ignoring %s", strings.Join(opts.Keyrings[1:], ", "))
+		}
+	}
+	if len(opts.Mirrors) > 1 {
+		log.Printf("[WARNING] debootstrap accepts a single mirror; ignoring %s", strings.Join(opts.Mirrors[1:], ", "))
+	}
+	if len(opts.AptOptions) > 0 {
+		log.Printf("[WARNING] debootstrap does not support APT options; ignoring %d option(s)", len(opts.AptOptions))
+	}
+
+	args = append(args, opts.Suite, opts.Target, opts.Mirrors[0])
+	return b.runCommandEnv(opts.Env, "debootstrap", args...)
+}
+
+type mmdebstrapBootstrapper struct{}
+
+func (mmdebstrapBootstrapper) Name() string { return "mmdebstrap" }
+
+func (mmdebstrapBootstrapper) Available() bool {
+	_, err := exec.LookPath("mmdebstrap")
+	return err == nil
+}
+
+func (mmdebstrapBootstrapper) Bootstrap(b *Builder, opts BootstrapOptions) error {
+	mode := opts.Mode
+	if mode == "" {
+		mode = "auto"
+	}
+
+	args := []string{
+		"--arch=" + opts.Arch,
+		"--variant=minbase",
+	}
+
+	// Inside a rootless user namespace mmdebstrap already runs as root but
+	// can neither create device nodes nor mount sysfs.
+	if opts.Rootless {
+		args = append(args, "--skip=output/mknod,chroot/mount/sys")
+	}
+	args = append(args, "--mode="+mode)
+
+	if len(opts.Components) > 0 {
+		args = append(args, "--components="+strings.Join(opts.Components, ","))
+	}
+	if len(opts.Include) > 0 {
+		args = append(args, "--include="+strings.Join(opts.Include, ","))
+	}
+	for _, keyring := range opts.Keyrings {
+		args = append(args, "--keyring="+keyring)
+	}
+	for _, opt := range opts.AptOptions {
+		args = append(args, "--aptopt="+opt)
+	}
+
+	target := opts.Target
+	if opts.Tarball != "" {
+		target = opts.Tarball
+	}
+
+	args = append(args, opts.Suite, target)
+	args = append(args, opts.Mirrors...)
+	return b.runCommandEnv(opts.Env, "mmdebstrap", args...)
+}
+
+func (b *Builder) bootstrapper() Bootstrapper {
+	if b.bootstrap == nil {
+		b.bootstrap = b.selectBootstrapper()
+	}
+	return b.bootstrap
+}
+
+func (b *Builder) selectBootstrapper() Bootstrapper {
+	var debootstrap, mmdebstrap Bootstrapper = debootstrapBootstrapper{}, mmdebstrapBootstrapper{}
+
+	if b.isRootless() {
+		return mmdebstrap
+	}
+
+	if b.Config.Build.Bootstrap.Tool != "mmdebstrap" {
+		return debootstrap
+	}
+	if !mmdebstrap.Available() {
+		log.Printf("[WARNING] mmdebstrap is not installed; falling back to debootstrap")
+		return debootstrap
+	}
+	return mmdebstrap
+}
+
+func (b *Builder) bootstrapOptions(bs Bootstrapper) BootstrapOptions {
+	cfg := b.Config.Build.Bootstrap
+
+	opts := BootstrapOptions{
+		Arch:       b.Config.System.Architecture,
+		Suite:      b.bootstrapRelease(),
+		Target:     b.ChrootDir,
+		Mirrors:    append([]string{b.buildMirror()}, cfg.Mirrors...),
+		Keyrings:   cfg.Keyrings,
+		AptOptions: cfg.AptOptions,
+		Mode:       cfg.Mode,
+		Rootless:   b.isRootless(),
+		Env:        b.proxyEnv(),
+	}
+
+	if bs.Name() == "mmdebstrap" || cfg.IncludeEssential {
+		opts.Components = b.sourceEntries(b.buildMirror(), b.buildMirror())[0].Components
+	}
+
+	// debootstrap does not check Valid-Until, so only mmdebstrap's apt needs
+	// telling that an expired snapshot Release file is fine.
+	if b.snapshotTimestamp() != "" && bs.Name() == "mmdebstrap" {
+		opts.AptOptions = append(append([]string{}, opts.AptOptions...), snapshotAptOption)
+	}
+
+	if cfg.IncludeEssential {
+		opts.Include = append(append(opts.Include, b.basePackages()...), b.Config.Packages.Essential...)
+		if bs.Name() == "debootstrap" {
+			opts.Include = debootstrapIncludes(opts.Include)
+		}
+	}
+
+	// The rootless namespace already maps ownership, so mmdebstrap runs
+	// there as plain root.
+	if opts.Rootless {
+		opts.Mode = "root"
+	}
+
+	// mmdebstrap's unshare mode maps ownership through subordinate ids, which
+	// only survives intact in a tarball, so unshare always goes via tar.
+	if bs.Name() == "mmdebstrap" && (cfg.Format == "tar" || opts.Mode == "unshare") {
+		opts.Tarball = b.bootstrapTarball()
+	}
+
+	return opts
+}
+
+// debootstrapIncludes reduces package specs to the bare names debootstrap's
+// --include accepts. Versions, releases and architectures still apply when
+// the install pass installs packages.essential.
+func debootstrapIncludes(specs []string) []string {
+	var names, qualified []string
+	for _, spec := range specs {
+		name := packageName(spec)
+		if name != strings.TrimSpace(spec) {
+			qualified = append(qualified, spec)
+		}
+		names = append(names, name)
+	}
+	if len(qualified) > 0 {
+		log.Printf("[WARNING] debootstrap --include takes bare package names; bootstrapping %s by name only", strings.Join(qualified, ", "))
+	}
+	return dedupe(names)
+}
+
+func (b *Builder) bootstrapTarball() string {
+	if b.Config.Build.Bootstrap.Output != "" {
+		return b.Config.Build.Bootstrap.Output
+	}
+	return filepath.Join(b.WorkDir, "bootstrap.tar")
+}
+
+func (b *Builder) extractBootstrapTarball(tarball string) error {
+	fmt.Printf("[INFO] Extracting bootstrap tarball %s\n", tarball)
+
+	if err := os.MkdirAll(b.ChrootDir, 0755); err != nil {
+		return err
+	}
+	return b.runCommand("tar",
+		"--numeric-owner",
+		"--xattrs", "--xattrs-include=*",
+		"-xpf", tarball,
+		"-C", b.ChrootDir,
+	)
+}
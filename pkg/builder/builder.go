@@ -7,11 +7,14 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 
+	"kagami/pkg/apt"
 	"kagami/pkg/config"
+	"kagami/pkg/proxy"
 	"kagami/pkg/system"
 )
 
@@ -25,6 +28,37 @@ type Builder struct {
 	PrettyName  string
 	OnProgress  func(step, total int, name string)
 	OnLog       func(msg string)
+	DryRun      bool
+
+	// LockfilePath is where the package lockfile is written after a build
+	// and, with Locked set, read from to install exactly those versions.
+	LockfilePath string
+	Locked       bool
+	// ConfigFile is the configuration the build was loaded from, which the
+	// lockfile records so it is never applied to another configuration.
+	ConfigFile string
+	// RelocatedISO is where the finished ISO is moved out of the workspace,
+	// if anywhere; the previous build's size report is looked up there too.
+	RelocatedISO string
+
+	proxyServer *proxy.Server
+	proxyURL    string
+	suiteCache  map[string]bool
+
+	packageIndex    *apt.Index
+	localDebs       []localDeb
+	installFailures []PackageFailure
+	removals        *RemovalAudit
+	flatpaks        []string
+
+	snapResolved      bool
+	snapSubstitutions []SnapSubstitution
+	snapdApplied      []string
+	rendered          []RenderedFile
+	mounts            mountManager
+	bootstrap         Bootstrapper
+	lockFile          *os.File
+	started           time.Time
 }
 
 func NewBuilder(cfg *config.Config, workDir, outputISO string) *Builder {
@@ -75,14 +109,32 @@ func (b *Builder) getDistName() string {
 	}
 }
 
-func (b *Builder) Build() error {
+// PrepareConfig applies the configuration changes a build makes before it
+// starts: Debian alias resolution and snap replacements, which may add
+// repositories, pins and Flatpak apps. Anything derived from the
+// configuration, such as the host requirements, should see them.
+func (b *Builder) PrepareConfig() error {
 	b.resolveDebianRelease()
+	return b.applySnapReplacements()
+}
+
+func (b *Builder) Build() error {
+	b.started = time.Now()
+
+	if err := b.PrepareConfig(); err != nil {
+		return err
+	}
+
+	if err := b.startAptProxy(); err != nil {
+		return err
+	}
+	defer b.stopAptProxy()
 
 	steps := []struct {
 		name string
 		fn   func() error
 	}{
-		{"Verifying prerequisites", b.checkPrerequisites},
+		{"Running preflight checks", b.preflight},
 		{"Initialising directory structure", b.createDirectories},
 		{"Bootstrapping base system", b.bootstrapSystem},
 		{"Mounting filesystems", b.mountFilesystems},
@@ -90,11 +142,14 @@ func (b *Builder) Build() error {
 		{"Applying snapd suppression", b.blockSnapd},
 		{"Installing package manifest", b.installPackages},
 		{"Installing desktop environment", b.installDesktop},
+		{"Installing baseline metapackage", b.installMetapackage},
 		{"Configuring Flatpak support", b.setupFlatpak},
 		{"Configuring bootloader", b.configureBootloader},
 		{"Cleaning chroot environment", b.cleanupChroot},
+		{"Recording package lockfile", b.recordLockfile},
 		{"Creating compressed filesystem", b.createFilesystem},
 		{"Synthesising ISO image", b.createISO},
+		{"Writing build report", b.writeBuildReport},
 		{"Finalising build", b.cleanup},
 	}
 
@@ -121,7 +176,12 @@ func (b *Builder) log(msg string) {
 }
 
 func (b *Builder) runCommand(name string, args ...string) error {
+	return b.runCommandEnv(nil, name, args...)
+}
+
+func (b *Builder) runCommandEnv(env []string, name string, args ...string) error {
 	cmd := exec.Command(name, args...)
+	cmd.Env = env
 	if b.OnLog != nil {
 		cmd.Stdout = &logWriter{b}
 		cmd.Stderr = &logWriter{b}
@@ -133,18 +193,17 @@ func (b *Builder) runCommand(name string, args ...string) error {
 }
 
 func (b *Builder) checkPrerequisites() error {
-	required := []string{
-		"debootstrap",
-		"mksquashfs",
-		"xorriso",
-		"grub-mkstandalone",
-		"gpg",
-		"wget",
-	}
-
-	for _, tool := range required {
-		if _, err := exec.LookPath(tool); err != nil {
-			return fmt.Errorf("required tool '%s' not found; install with: sudo apt-get install %s", tool, tool)
+	deps := system.CheckDependencies(b.Config, b.isRootless())
+	if len(deps.Missing) > 0 {
+		for _, dep := range deps.Missing {
+			fmt.Printf("[ERROR] Required %s not found (%s)\n", dep.Name, dep.Reason)
+		}
+		return fmt.Errorf("missing build dependencies; install with: sudo apt-get install %s", system.GetInstallCommand(deps.MissingPackages(false)))
+	}
+
+	if b.isRootless() {
+		if err := b.checkRootlessPrerequisites(); err != nil {
+			return err
 		}
 	}
 
@@ -152,11 +211,20 @@ func (b *Builder) checkPrerequisites() error {
 		return fmt.Errorf("elevated privileges are required; re-execute with sudo")
 	}
 
+	if ts := b.snapshotTimestamp(); ts != "" {
+		fmt.Printf("[INFO] Building from archive snapshot %s (%s)\n", ts, b.buildMirror())
+		b.warnUnsnapshotted()
+	}
+
 	if system.IsContainer() {
 		fmt.Println("[INFO] Container environment detected (Docker/Podman/Distrobox).")
 		fmt.Println("       Ensure the container has SYS_ADMIN capability for bind mounts.")
 	}
 
+	if b.isOffline() {
+		return b.verifyOfflineArtifacts()
+	}
+
 	return nil
 }
 
@@ -185,386 +253,173 @@ func (b *Builder) bootstrapSystem() error {
 		return nil
 	}
 
-	mirror := b.Config.Repository.Mirror
-	if mirror == "" {
-		if b.isDebian() {
-			mirror = "http://deb.debian.org/debian/"
-		} else {
-			mirror = "http://archive.ubuntu.com/ubuntu/"
-		}
-	}
-
-	bootstrapRelease := b.Config.Release
-	if bootstrapRelease == "devel" {
-		bootstrapRelease = "noble"
+	if b.Config.Release == "devel" {
 		fmt.Println("[INFO] Bootstrapping with 'noble' as base for development target")
 	}
 
-	err := b.runCommand("debootstrap",
-		"--arch="+b.Config.System.Architecture,
-		"--variant=minbase",
-		bootstrapRelease,
-		b.ChrootDir,
-		mirror,
-	)
+	bs := b.bootstrapper()
+	opts := b.bootstrapOptions(bs)
+	fmt.Printf("[INFO] Bootstrapping %s with %s\n", opts.Suite, bs.Name())
 
-	if err != nil {
-		if system.IsContainer() {
-			return fmt.Errorf("debootstrap failed: %v\n[TIP] Container environments require '--privileged' or CAP_MKNOD for device node creation", err)
+	if err := bs.Bootstrap(b, opts); err != nil {
+		if system.IsContainer() && !b.isRootless() {
+			return fmt.Errorf("%s failed: %v\n[TIP] Container environments require '--privileged' or CAP_MKNOD for device node creation", bs.Name(), err)
 		}
-		return err
+		return fmt.Errorf("%s failed: %v", bs.Name(), err)
+	}
+
+	if opts.Tarball != "" {
+		return b.extractBootstrapTarball(opts.Tarball)
 	}
 	return nil
 }
 
 func (b *Builder) mountFilesystems() error {
-	mounts := []struct {
-		source string
-		target string
-		flags  string
-	}{
-		{"/dev", filepath.Join(b.ChrootDir, "dev"), "bind"},
-		{"/run", filepath.Join(b.ChrootDir, "run"), "bind"},
+	if b.usesNspawn() {
+		return nil
+	}
+	if b.isRootless() {
+		return b.mountRootless()
 	}
 
-	for _, m := range mounts {
-		if isMounted(m.target) {
-			continue
-		}
-		if err := os.MkdirAll(m.target, 0755); err != nil {
-			return fmt.Errorf("failed to create mount target %s: %v", m.target, err)
-		}
-
-		cmd := exec.Command("mount", "--bind", m.source, m.target)
-		if err := cmd.Run(); err != nil {
-			errMsg := fmt.Errorf("failed to mount %s: %v", m.target, err)
+	binds := []string{"/dev", "/run"}
+	for _, dir := range binds {
+		if err := b.mounts.bind(dir, filepath.Join(b.ChrootDir, dir), false); err != nil {
 			if system.IsContainer() {
-				return fmt.Errorf("%v\n[TIP] Container environments require '--privileged' or CAP_SYS_ADMIN", errMsg)
+				return fmt.Errorf("%v\n[TIP] Container environments require '--privileged' or CAP_SYS_ADMIN", err)
 			}
-			return errMsg
+			return err
 		}
 	}
 
-	return nil
+	pseudo := []struct {
+		fstype string
+		target string
+	}{
+		{"proc", "/proc"},
+		{"sysfs", "/sys"},
+		{"devpts", "/dev/pts"},
+	}
+	for _, m := range pseudo {
+		if err := b.mounts.mount(m.fstype, m.fstype, filepath.Join(b.ChrootDir, m.target)); err != nil {
+			return err
+		}
+	}
+
+	return b.mountLocalRepos()
 }
 
-func (b *Builder) configureSystem() error {
-	initScripts := []string{
-		fmt.Sprintf("echo '%s' > /etc/hostname", b.Config.System.Hostname),
-		b.generateSourcesList(),
-		"mount none -t proc /proc 2>/dev/null || true",
-		"mount none -t sysfs /sys 2>/dev/null || true",
-		"mount none -t devpts /dev/pts 2>/dev/null || true",
-		"export HOME=/root",
-		"export LC_ALL=C",
+func (b *Builder) writeBaseConfig() error {
+	files := []chrootFile{
+		{"/etc/hostname", b.Config.System.Hostname + "\n", 0644},
+		{"/etc/apt/sources.list", renderSourcesList(b.buildSourceEntries(), !b.isOffline()), 0644},
 	}
+	return b.writeFiles(files)
+}
 
-	for _, script := range initScripts {
-		if err := b.chrootExec(script); err != nil {
-			return err
-		}
+func (b *Builder) configureSystem() error {
+	if err := b.writeBaseConfig(); err != nil {
+		return err
 	}
 
 	if err := b.configureAdditionalRepos(); err != nil {
 		log.Printf("[WARNING] Additional repository configuration failed: %v", err)
 	}
 
-	basePackages := "systemd-sysv"
-	if !b.isDebian() {
-		basePackages = "libterm-readline-gnu-perl systemd-sysv"
+	if err := b.stageLocalDebs(); err != nil {
+		return fmt.Errorf("failed to stage local packages: %v", err)
 	}
 
-	postScripts := []string{
-		"apt-get update",
-		fmt.Sprintf("DEBIAN_FRONTEND=noninteractive apt-get install -y %s", basePackages),
-		"dbus-uuidgen > /etc/machine-id",
-		"ln -fs /etc/machine-id /var/lib/dbus/machine-id",
-		"dpkg-divert --local --rename --add /sbin/initctl",
-		"ln -s /bin/true /sbin/initctl",
+	if err := b.writeSnapshotAptConfig(); err != nil {
+		return fmt.Errorf("failed to configure snapshot sources: %v", err)
 	}
 
-	for _, script := range postScripts {
-		if err := b.chrootExec(script); err != nil {
-			return err
-		}
+	if err := b.writeAptPreferences(); err != nil {
+		return fmt.Errorf("failed to write APT preferences: %v", err)
 	}
 
-	return nil
-}
-
-func (b *Builder) installPackages() error {
-	if err := b.chrootExec("DEBIAN_FRONTEND=noninteractive apt-get -y dist-upgrade"); err != nil {
+	if err := b.writeLockPreferences(); err != nil {
 		return err
 	}
 
-	essentialPkgs := strings.Join(b.Config.Packages.Essential, " ")
-	if err := b.chrootExec(fmt.Sprintf("DEBIAN_FRONTEND=noninteractive apt-get install -y %s", essentialPkgs)); err != nil {
-		return err
+	if err := b.writeChrootProxyConfig(); err != nil {
+		return fmt.Errorf("failed to configure APT proxy in chroot: %v", err)
 	}
 
-	kernelPkg := b.Config.Packages.Kernel
-	if kernelPkg == "" {
-		kernelPkg = "linux-generic"
-		if b.isDebian() {
-			kernelPkg = "linux-image-amd64"
-			if b.Config.System.Architecture == "arm64" {
-				kernelPkg = "linux-image-arm64"
-			}
-		}
+	if err := b.installServiceGuards(); err != nil {
+		return fmt.Errorf("failed to install service guards: %v", err)
 	}
 
-	headersPkg := ""
-	if strings.HasPrefix(kernelPkg, "linux-image-") {
-		headersPkg = strings.Replace(kernelPkg, "linux-image-", "linux-headers-", 1)
-	} else if strings.HasPrefix(kernelPkg, "linux-") {
-		headersPkg = "linux-headers-" + strings.TrimPrefix(kernelPkg, "linux-")
-	}
-
-	installKernelCmd := fmt.Sprintf("DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends %s", kernelPkg)
-	if headersPkg != "" {
-		installKernelCmd += " " + headersPkg
-	}
+	basePackages := strings.Join(b.basePackages(), " ")
 
-	if err := b.chrootExec(installKernelCmd); err != nil {
-		return err
+	postScripts := []string{
+		"apt-get update",
+		b.aptGetCommand("install") + " " + basePackages,
+		"dbus-uuidgen > /etc/machine-id",
+		"ln -fs /etc/machine-id /var/lib/dbus/machine-id",
 	}
 
-	if len(b.Config.Packages.Additional) > 0 {
-		additionalPkgs := strings.Join(b.Config.Packages.Additional, " ")
-		if err := b.chrootExec(fmt.Sprintf("DEBIAN_FRONTEND=noninteractive apt-get install -y %s", additionalPkgs)); err != nil {
-			log.Printf("[WARNING] Some additional packages failed to install: %v", err)
+	for _, script := range postScripts {
+		if err := b.chrootExec(script); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (b *Builder) blockSnapd() error {
-	if !b.Config.Security.BlockSnapdForever && !b.Config.System.BlockSnapd {
-		return nil
+func (b *Builder) installPackages() error {
+	if err := b.chrootExec(b.aptGetCommand("dist-upgrade")); err != nil {
+		return err
 	}
 
-	fmt.Println("[INFO] Implementing multi-layer snapd suppression...")
-
-	scripts := []string{
-		"apt-get purge -y snapd snap-confine ubuntu-core-launcher snapd-xdg-open || true",
-		"apt-get autoremove -y || true",
-		"rm -rf /var/cache/snapd /var/lib/snapd /var/snap /snap",
-		`cat > /etc/apt/preferences.d/nosnapd.pref <<'EOF'
-Explanation: Snapd package installation is permanently prohibited on this system.
-Package: snapd
-Pin: release *
-Pin-Priority: -1
-
-Package: snapd:*
-Pin: release *
-Pin-Priority: -1
-
-Package: snap-confine
-Pin: release *
-Pin-Priority: -1
-
-Package: ubuntu-core-launcher
-Pin: release *
-Pin-Priority: -1
-
-Package: snapd-xdg-open
-Pin: release *
-Pin-Priority: -1
-EOF`,
-		"mkdir -p /etc/systemd/system/snapd.service.d",
-		`cat > /etc/systemd/system/snapd.service.d/override.conf <<'EOF'
-[Unit]
-ConditionPathExists=!/etc/snapd-blocked
-
-[Service]
-ExecStart=
-ExecStart=/bin/false
-EOF`,
-		"touch /etc/snapd-blocked",
-		`echo "Snapd is permanently suppressed on this system." > /etc/snapd-blocked`,
-		"mkdir -p /etc/systemd/system/snapd.socket.d",
-		`cat > /etc/systemd/system/snapd.socket.d/override.conf <<'EOF'
-[Unit]
-ConditionPathExists=!/etc/snapd-blocked
-
-[Socket]
-ListenStream=
-EOF`,
-		"mkdir -p /etc/apt/apt.conf.d",
-		`cat > /etc/apt/apt.conf.d/99-block-snapd <<'EOF'
-DPkg::Pre-Install-Pkgs {
-  "/usr/local/bin/block-snapd-hook";
-};
-EOF`,
-		`cat > /usr/local/bin/block-snapd-hook <<'EOFSCRIPT'
-#!/bin/sh
-while read pkg; do
-    case "$pkg" in
-        *snapd*)
-            echo "Installation of snapd is permanently prohibited on this system." >&2
-            exit 1
-            ;;
-    esac
-done
-EOFSCRIPT`,
-		"chmod +x /usr/local/bin/block-snapd-hook",
-		"mkdir -p /etc/update-motd.d",
-		`cat > /etc/update-motd.d/99-snapd-blocked <<'EOF'
-#!/bin/sh
-echo ""
-echo "-----------------------------------------------------------"
-echo "  NOTICE: Snapd is permanently suppressed on this system.  "
-echo "  Snap package installation is not permitted.              "
-echo "-----------------------------------------------------------"
-echo ""
-EOF`,
-		"chmod +x /etc/update-motd.d/99-snapd-blocked",
-		"dpkg-divert --local --rename --add /usr/bin/snap || true",
-		"ln -sf /bin/false /usr/bin/snap || true",
-		"rm -rf /snap /var/snap /var/lib/snapd ~/snap || true",
-		`cat >> /etc/profile.d/block-snapd.sh <<'EOF'
-export SNAPD_BLOCKED=1
-snap() {
-    echo "Snapd is permanently suppressed on this system." >&2
-    return 1
-}
-EOF`,
-		"chmod +x /etc/profile.d/block-snapd.sh",
+	groups := []packageGroup{
+		{"essential", b.Config.Packages.Essential},
+		{"kernel", b.kernelPackages()},
+		{"additional", b.Config.Packages.Additional},
+		{"local", b.localPackageNames()},
 	}
 
-	for _, script := range scripts {
-		if err := b.chrootExec(script); err != nil {
-			log.Printf("[WARNING] Snapd suppression step encountered an error: %v", err)
+	for _, group := range groups {
+		if err := b.installGroup(group.Name, group.Packages); err != nil {
+			return err
 		}
 	}
 
-	fmt.Println("[OK] Snapd suppression applied across all protection layers")
-	return nil
+	if err := b.installFirmware(); err != nil {
+		return err
+	}
+
+	return b.installFirmwareReport()
 }
 
 func (b *Builder) installDesktop() error {
 	if b.Config.Packages.Desktop == "none" {
 		log.Println("Desktop mode is 'none'; packages must be specified in the additional list")
-
-		if b.Config.Installer.Type == "ubiquity" {
-			installerPkgs := []string{
-				"ubiquity",
-				"ubiquity-casper",
-				"ubiquity-frontend-gtk",
-				"ubiquity-ubuntu-artwork",
-			}
-
-			slideshowMap := map[string]string{
-				"ubuntu":      "ubiquity-slideshow-ubuntu",
-				"kubuntu":     "ubiquity-slideshow-kubuntu",
-				"xubuntu":     "ubiquity-slideshow-xubuntu",
-				"lubuntu":     "ubiquity-slideshow-lubuntu",
-				"ubuntu-mate": "ubiquity-slideshow-ubuntu-mate",
-			}
-
-			if slideshow, ok := slideshowMap[b.Config.Installer.Slideshow]; ok {
-				installerPkgs = append(installerPkgs, slideshow)
-			}
-
-			installerList := strings.Join(installerPkgs, " ")
-			if err := b.chrootExec(fmt.Sprintf("DEBIAN_FRONTEND=noninteractive apt-get install -y %s", installerList)); err != nil {
-				log.Printf("[WARNING] Some installer packages failed to install: %v", err)
-			}
-		}
-
-		if b.Config.Installer.Type == "calamares" {
-			if err := b.setupCalamares(); err != nil {
-				log.Printf("[WARNING] Calamares configuration failed: %v", err)
-			}
+	} else {
+		pkgs, err := b.desktopPackages()
+		if err != nil {
+			return err
 		}
-
-		if len(b.Config.Packages.RemoveList) > 0 {
-			removeList := strings.Join(b.Config.Packages.RemoveList, " ")
-			b.chrootExec(fmt.Sprintf("apt-get purge -y %s || true", removeList))
+		if err := b.installGroup("desktop", pkgs); err != nil {
+			return err
 		}
-
-		b.chrootExec("apt-get autoremove -y")
-		return nil
-	}
-
-	ubuntuDesktopPackages := map[string][]string{
-		"gnome": {
-			"vanilla-gnome-desktop",
-			"vanilla-gnome-default-settings",
-			"gnome-session",
-			"gnome-tweaks",
-			"gnome-shell-extension-manager",
-			"gnome-backgrounds",
-			"fonts-cantarell",
-			"adwaita-icon-theme",
-			"plymouth-themes",
-		},
-		"kde":  {"kde-plasma-desktop"},
-		"xfce": {"xfce4", "xfce4-goodies"},
-		"lxde": {"lxde"},
-		"lxqt": {"lxqt"},
-		"mate": {"mate-desktop-environment"},
-	}
-
-	debianDesktopPackages := map[string][]string{
-		"gnome": {"task-gnome-desktop"},
-		"kde":   {"task-kde-desktop"},
-		"xfce":  {"task-xfce-desktop"},
-		"lxde":  {"task-lxde-desktop"},
-		"lxqt":  {"task-lxqt-desktop"},
-		"mate":  {"task-mate-desktop"},
-	}
-
-	var desktopPackages map[string][]string
-	if b.isDebian() {
-		desktopPackages = debianDesktopPackages
-	} else {
-		desktopPackages = ubuntuDesktopPackages
-	}
-
-	pkgs, ok := desktopPackages[b.Config.Packages.Desktop]
-	if !ok {
-		return fmt.Errorf("unsupported desktop environment identifier: %s", b.Config.Packages.Desktop)
-	}
-
-	pkgList := strings.Join(pkgs, " ")
-	installCmd := "DEBIAN_FRONTEND=noninteractive apt-get install -y"
-	if b.isDebian() {
-		installCmd += " --no-install-recommends"
 	}
 
-	if err := b.chrootExec(fmt.Sprintf("%s %s", installCmd, pkgList)); err != nil {
+	if err := b.installGroup("installer", b.installerPackages()); err != nil {
 		return err
 	}
 
-	if b.Config.Installer.Type == "ubiquity" && !b.isDebian() {
-		installerPkgs := []string{
-			"ubiquity",
-			"ubiquity-casper",
-			"ubiquity-frontend-gtk",
-			"ubiquity-ubuntu-artwork",
-		}
-
-		installerList := strings.Join(installerPkgs, " ")
-		if err := b.chrootExec(fmt.Sprintf("DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends %s", installerList)); err != nil {
-			log.Printf("[WARNING] Some installer packages failed to install: %v", err)
-		}
-	}
-
 	if b.Config.Installer.Type == "calamares" {
 		if err := b.setupCalamares(); err != nil {
 			log.Printf("[WARNING] Calamares configuration failed: %v", err)
 		}
 	}
 
-	if len(b.Config.Packages.RemoveList) > 0 {
-		removeList := strings.Join(b.Config.Packages.RemoveList, " ")
-		b.chrootExec(fmt.Sprintf("apt-get purge -y %s || true", removeList))
+	if err := b.purgeRemoveList(); err != nil {
+		return err
 	}
 
-	b.chrootExec("apt-get autoremove -y")
-
 	if b.Config.Packages.Desktop == "gnome" && !b.isDebian() {
 		b.refineVanillaGNOME()
 	}
@@ -578,7 +433,7 @@ func (b *Builder) refineVanillaGNOME() error {
 	scripts := []string{
 		"apt-get purge -y ubuntu-session yaru-theme-gnome-shell yaru-theme-gtk yaru-theme-icon yaru-theme-sound || true",
 		"update-alternatives --set gdm3-theme.desktop /usr/share/gnome-shell/theme/gnome-shell.css || true",
-		"DEBIAN_FRONTEND=noninteractive apt-get install -y qgnomeplatform-qt5 qgnomeplatform-qt6 || true",
+		b.aptGetCommand("install") + " qgnomeplatform-qt5 qgnomeplatform-qt6 || true",
 	}
 
 	for _, script := range scripts {
@@ -596,78 +451,23 @@ func (b *Builder) setupFlatpak() error {
 	return b.installFlatpak()
 }
 
-func (b *Builder) installFlatpak() error {
-	fmt.Println("[INFO] Installing Flatpak and registering Flathub repository...")
-
-	pkgs := []string{"flatpak"}
-
-	switch b.Config.Packages.Desktop {
-	case "gnome":
-		pkgs = append(pkgs, "gnome-software-plugin-flatpak")
-	case "kde":
-		pkgs = append(pkgs, "plasma-discover-backend-flatpak")
-	}
-
-	pkgList := strings.Join(pkgs, " ")
-	if err := b.chrootExec(fmt.Sprintf("DEBIAN_FRONTEND=noninteractive apt-get install -y %s", pkgList)); err != nil {
-		return err
-	}
-
-	return b.chrootExec("flatpak remote-add --if-not-exists flathub https://flathub.org/repo/flathub.flatpakrepo 2>/dev/null || true")
-}
-
 func (b *Builder) configureBootloader() error {
-	suffix := "generic"
-	if b.isDebian() {
-		suffix = "amd64"
-	}
-
-	if b.Config.Packages.Kernel != "" {
-		switch {
-		case strings.Contains(b.Config.Packages.Kernel, "lowlatency"):
-			suffix = "lowlatency"
-		case strings.Contains(b.Config.Packages.Kernel, "oem"):
-			suffix = "oem"
-		case strings.Contains(b.Config.Packages.Kernel, "amd64"):
-			suffix = "amd64"
-		case strings.Contains(b.Config.Packages.Kernel, "rt"):
-			suffix = "rt"
-		}
-	}
-
-	kernelPattern := filepath.Join(b.ChrootDir, "boot", "vmlinuz-*"+suffix+"*")
-	initrdPattern := filepath.Join(b.ChrootDir, "boot", "initrd.img-*"+suffix+"*")
-
-	kernels, _ := filepath.Glob(kernelPattern)
-	if len(kernels) == 0 {
-		kernelPattern = filepath.Join(b.ChrootDir, "boot", "vmlinuz-*")
-		initrdPattern = filepath.Join(b.ChrootDir, "boot", "initrd.img-*")
-		kernels, _ = filepath.Glob(kernelPattern)
+	kernels, err := b.liveKernels()
+	if err != nil {
+		return err
 	}
-	initrds, _ := filepath.Glob(initrdPattern)
-
-	liveDestDir := filepath.Join(b.ImageDir, b.liveDir())
 
-	if len(kernels) > 0 {
-		exec.Command("cp", kernels[0], filepath.Join(liveDestDir, "vmlinuz")).Run()
+	if err := b.copyLiveKernels(kernels); err != nil {
+		return fmt.Errorf("failed to copy kernels: %v", err)
 	}
-	if len(initrds) > 0 {
-		exec.Command("cp", initrds[0], filepath.Join(liveDestDir, "initrd")).Run()
-	}
-
-	memtestURL := "https://memtest.org/download/v7.00/mt86plus_7.00.binaries.zip"
-	memtestZip := filepath.Join(b.ImageDir, "install", "memtest86.zip")
 
-	exec.Command("wget", "--progress=dot", memtestURL, "-O", memtestZip).Run()
-	exec.Command("unzip", "-p", memtestZip, "memtest64.bin").Output()
-	exec.Command("unzip", "-p", memtestZip, "memtest64.efi").Output()
-	exec.Command("rm", "-f", memtestZip).Run()
+	b.installMemtest()
 
 	markerFile := filepath.Join(b.ImageDir, "kagami-live")
 	os.WriteFile(markerFile, []byte(""), 0644)
 
 	grubCfg := filepath.Join(b.ImageDir, "isolinux", "grub.cfg")
-	grubContent := b.generateGrubConfig()
+	grubContent := b.generateGrubConfig(kernels)
 	if err := os.WriteFile(grubCfg, []byte(grubContent), 0644); err != nil {
 		return err
 	}
@@ -675,25 +475,8 @@ func (b *Builder) configureBootloader() error {
 	return nil
 }
 
-func (b *Builder) generateGrubConfig() string {
-	distName := b.getDistName()
-	liveDir := b.liveDir()
-	bootParam := b.bootParam()
-
-	var persistParam string
-	if b.isDebian() {
-		persistParam = "nopersistence"
-	} else {
-		persistParam = "nopersistent"
-	}
-
-	var installEntry string
-	switch b.Config.Installer.Type {
-	case "ubiquity":
-		installEntry = b.generateUbiquityGrubEntry()
-	case "calamares":
-		installEntry = b.generateCalamaresGrubEntry()
-	}
+func (b *Builder) generateGrubConfig(kernels []liveKernel) string {
+	memtestEntries := b.generateMemtestGrubEntries()
 
 	return fmt.Sprintf(`
 search --set=root --file /kagami-live
@@ -706,75 +489,76 @@ insmod iso9660
 
 set default="0"
 set timeout=30
-
-menuentry "Try %s without installing" {
-   linux /%s/vmlinuz %s %s toram quiet splash ---
-   initrd /%s/initrd
-}
 %s
-
-menuentry "Check disc for defects" {
-   linux /%s/vmlinuz %s integrity-check quiet splash ---
-   initrd /%s/initrd
-}
-
+%s
 if [ "$grub_platform" = "efi" ]; then
 menuentry "UEFI Firmware Settings" {
    fwsetup
 }
+%s
+fi
+
+`, b.kernelMenuEntries(kernels[0], ""), b.kernelSubmenus(kernels), memtestEntries)
+}
 
+func (b *Builder) generateMemtestGrubEntries() string {
+	hasBin, hasEfi := b.hasMemtest()
+
+	var entries string
+	if hasEfi {
+		entries += `
 menuentry "Test memory (Memtest86+ UEFI)" {
    linux /install/memtest86+.efi
-}
+}`
+	}
+	if hasBin {
+		entries += `
 else
 menuentry "Test memory (Memtest86+ BIOS)" {
    linux16 /install/memtest86+.bin
+}`
+	}
+	return entries
 }
-fi
 
-`, distName, liveDir, bootParam, persistParam, liveDir, installEntry,
-		liveDir, bootParam, liveDir)
-}
+func (b *Builder) cleanupChroot() error {
+	if err := b.removeServiceGuards(); err != nil {
+		return err
+	}
 
-func (b *Builder) generateUbiquityGrubEntry() string {
-	distName := b.getDistName()
-	liveDir := b.liveDir()
-	bootParam := b.bootParam()
-	return fmt.Sprintf(`
-menuentry "Install %s (Ubiquity)" {
-   linux /%s/vmlinuz %s only-ubiquity quiet splash ---
-   initrd /%s/initrd
-}`, distName, liveDir, bootParam, liveDir)
-}
+	if err := b.removeLockPreferences(); err != nil {
+		return err
+	}
 
-func (b *Builder) generateCalamaresGrubEntry() string {
-	distName := b.getDistName()
-	liveDir := b.liveDir()
-	bootParam := b.bootParam()
-	return fmt.Sprintf(`
-menuentry "Install %s (Calamares)" {
-   linux /%s/vmlinuz %s quiet splash ---
-   initrd /%s/initrd
-}`, distName, liveDir, bootParam, liveDir)
-}
+	if err := b.removeSnapshotAptConfig(); err != nil {
+		return err
+	}
 
-func (b *Builder) cleanupChroot() error {
 	scripts := []string{
 		"truncate -s 0 /etc/machine-id",
-		"rm -f /sbin/initctl",
-		"dpkg-divert --rename --remove /sbin/initctl",
 		"apt-get clean",
 		"rm -rf /tmp/* ~/.bash_history",
-		"umount /proc || true",
-		"umount /sys || true",
-		"umount /dev/pts || true",
 	}
 
 	for _, script := range scripts {
 		b.chrootExec(script)
 	}
 
-	return nil
+	if err := b.removeLocalDebs(); err != nil {
+		return fmt.Errorf("failed to remove the local package repository: %v", err)
+	}
+
+	if err := b.finaliseImageSources(); err != nil {
+		return fmt.Errorf("failed to write image APT sources: %v", err)
+	}
+	b.unmountLocalRepos()
+
+	if err := b.removeChrootProxyConfig(); err != nil {
+		return fmt.Errorf("failed to remove APT proxy configuration from chroot: %v", err)
+	}
+
+	// Nothing host-backed may remain mounted while mksquashfs walks the tree.
+	return b.mounts.unmountAll(b.ChrootDir)
 }
 
 func (b *Builder) applyCalamaresConfig() error {
@@ -802,6 +586,44 @@ func (b *Builder) applyCalamaresConfig() error {
 	return cmd.Run()
 }
 
+const openboxAutostart = `#!/bin/sh
+# Ensure calamares-launcher is in path
+export PATH=$PATH:/usr/local/bin
+tint2 &
+feh --bg-fill /usr/share/backgrounds/default.png 2>/dev/null || xsetroot -solid "#2d2d2d" &
+dunst &
+lxpolkit &
+nm-applet &
+sleep 2
+calamares-launcher &
+`
+
+const dwmSession = `#!/bin/sh
+export PATH=$PATH:/usr/local/bin
+feh --bg-fill /usr/share/backgrounds/default.png 2>/dev/null || xsetroot -solid "#2d2d2d" &
+dunst &
+lxpolkit &
+nm-applet &
+(sleep 2 && calamares-launcher) &
+exec dwm
+`
+
+const dwmDesktopEntry = `[Desktop Entry]
+Name=dwm
+Comment=ALCI style dynamic window manager
+Exec=/usr/local/bin/dwm-session
+Type=Application
+`
+
+const calamaresAutostart = `[Desktop Entry]
+Type=Application
+Name=Calamares Launcher
+Exec=calamares-launcher
+Icon=install-system
+Terminal=false
+X-GNOME-Autostart-enabled=true
+`
+
 func (b *Builder) configureMinimalInstaller() error {
 	fmt.Println("[INFO] Configuring minimal live installer environment...")
 
@@ -820,89 +642,54 @@ func (b *Builder) configureMinimalInstaller() error {
 		sessionName = "xfce"
 	}
 
-	scripts := []string{
-		fmt.Sprintf("useradd -m -G sudo -s /bin/bash %s || true", liveUser),
-		fmt.Sprintf("echo '%s:%s' | chpasswd", liveUser, liveUser),
-		fmt.Sprintf("echo '%s ALL=(ALL) NOPASSWD: ALL' > /etc/sudoers.d/live", liveUser),
-		"mkdir -p /etc/lightdm/lightdm.conf.d",
-		fmt.Sprintf(`cat > /etc/lightdm/lightdm.conf.d/50-autologin.conf <<'EOF'
-[Seat:*]
+	files := []chrootFile{
+		{"/etc/sudoers.d/live", liveUser + " ALL=(ALL) NOPASSWD: ALL\n", 0440},
+		{"/etc/lightdm/lightdm.conf.d/50-autologin.conf", fmt.Sprintf(`[Seat:*]
 autologin-user=%s
 autologin-user-timeout=0
 autologin-session=%s
 user-session=%s
-EOF`, liveUser, sessionName, sessionName),
+`, liveUser, sessionName, sessionName), 0644},
 	}
 
 	// WM specific autostart
 	switch wm {
 	case "openbox":
-		scripts = append(scripts,
-			"mkdir -p /etc/xdg/openbox",
-			`cat > /etc/xdg/openbox/autostart <<'EOFSCRIPT'
-#!/bin/sh
-# Ensure calamares-launcher is in path
-export PATH=$PATH:/usr/local/bin
-tint2 &
-feh --bg-fill /usr/share/backgrounds/default.png 2>/dev/null || xsetroot -solid "#2d2d2d" &
-dunst &
-lxpolkit &
-nm-applet &
-sleep 2
-calamares-launcher &
-EOFSCRIPT`,
-			"chmod +x /etc/xdg/openbox/autostart",
-		)
+		files = append(files, chrootFile{"/etc/xdg/openbox/autostart", openboxAutostart, 0755})
 	case "dwm":
-		scripts = append(scripts,
-			`cat > /usr/local/bin/dwm-session <<'EOFSCRIPT'
-#!/bin/sh
-export PATH=$PATH:/usr/local/bin
-feh --bg-fill /usr/share/backgrounds/default.png 2>/dev/null || xsetroot -solid "#2d2d2d" &
-dunst &
-lxpolkit &
-nm-applet &
-(sleep 2 && calamares-launcher) &
-exec dwm
-EOFSCRIPT`,
-			"chmod +x /usr/local/bin/dwm-session",
-			`cat > /usr/share/xsessions/dwm.desktop <<'EOF'
-[Desktop Entry]
-Name=dwm
-Comment=ALCI style dynamic window manager
-Exec=/usr/local/bin/dwm-session
-Type=Application
-EOF`,
+		files = append(files,
+			chrootFile{"/usr/local/bin/dwm-session", dwmSession, 0755},
+			chrootFile{"/usr/share/xsessions/dwm.desktop", dwmDesktopEntry, 0644},
 		)
 	case "xfce4-minimal":
-		scripts = append(scripts,
-			"mkdir -p /etc/xdg/autostart",
-			`cat > /etc/xdg/autostart/calamares-autostart.desktop <<'EOF'
-[Desktop Entry]
-Type=Application
-Name=Calamares Launcher
-Exec=calamares-launcher
-Icon=install-system
-Terminal=false
-X-GNOME-Autostart-enabled=true
-EOF`,
-		)
+		files = append(files, chrootFile{"/etc/xdg/autostart/calamares-autostart.desktop", calamaresAutostart, 0644})
 	}
 
-	scripts = append(scripts,
-		"chmod +x /usr/bin/calamares-launcher /usr/bin/add-calamares-desktop-icon || true",
-		"mkdir -p /etc/polkit-1/localauthority/50-local.d",
-		fmt.Sprintf(`cat > /etc/polkit-1/localauthority/50-local.d/allow-calamares.pkla <<'EOF'
-[Allow Calamares]
+	files = append(files, chrootFile{"/etc/polkit-1/localauthority/50-local.d/allow-calamares.pkla", fmt.Sprintf(`[Allow Calamares]
 Identity=unix-user:%s
 Action=*
 ResultAny=yes
 ResultInactive=yes
 ResultActive=yes
-EOF`, liveUser),
+`, liveUser), 0644})
+
+	if err := b.chrootExec(fmt.Sprintf("useradd -m -G sudo -s /bin/bash %s || true", liveUser)); err != nil {
+		log.Printf("[WARNING] Minimal installer configuration step failed: %v", err)
+	}
+
+	if err := b.writeFiles(files); err != nil {
+		log.Printf("[WARNING] Minimal installer configuration step failed: %v", err)
+	}
+
+	for _, launcher := range []string{"/usr/bin/calamares-launcher", "/usr/bin/add-calamares-desktop-icon"} {
+		b.chmodFile(launcher, 0755)
+	}
+
+	scripts := []string{
+		fmt.Sprintf("echo %s | chpasswd", shellQuote(liveUser+":"+liveUser)),
 		fmt.Sprintf("chown -R %s:%s /home/%s", liveUser, liveUser, liveUser),
 		"systemctl enable lightdm || true",
-	)
+	}
 
 	for _, script := range scripts {
 		if err := b.chrootExec(script); err != nil {
@@ -915,13 +702,7 @@ EOF`, liveUser),
 }
 
 func (b *Builder) setupCalamares() error {
-	fmt.Println("[INFO] Installing and configuring Calamares...")
-
-	installerPkgs := []string{"calamares"}
-	installerList := strings.Join(installerPkgs, " ")
-	if err := b.chrootExec(fmt.Sprintf("DEBIAN_FRONTEND=noninteractive apt-get install -y %s", installerList)); err != nil {
-		log.Printf("[WARNING] Calamares installation failed: %v", err)
-	}
+	fmt.Println("[INFO] Configuring Calamares...")
 
 	if err := b.applyLocalCalamaresSettings(); err != nil {
 		log.Printf("[WARNING] Local Calamares settings application failed: %v", err)
@@ -959,10 +740,12 @@ func (b *Builder) applyLocalCalamaresSettings() error {
 		brandingName = "debian"
 	}
 
-	settingsPath := filepath.Join(b.ChrootDir, "etc", "calamares", "settings.conf")
-	if content, err := os.ReadFile(settingsPath); err == nil {
-		updated := strings.Replace(string(content), "branding: kagami", "branding: "+brandingName, 1)
-		os.WriteFile(settingsPath, []byte(updated), 0644)
+	settingsPath := "/etc/calamares/settings.conf"
+	if content, err := b.readFile(settingsPath); err == nil {
+		updated := strings.Replace(content, "branding: kagami", "branding: "+brandingName, 1)
+		if err := b.writeFile(settingsPath, updated, 0644); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -977,15 +760,15 @@ func (b *Builder) applyBranding() error {
 	fmt.Println("[INFO] Applying custom branding to Calamares configuration...")
 
 	paths := []string{
-		filepath.Join(b.ChrootDir, "etc", "calamares/branding/ubuntu/branding.desc"),
-		filepath.Join(b.ChrootDir, "etc", "calamares/branding/debian/branding.desc"),
-		filepath.Join(b.ChrootDir, "etc", "calamares/branding/default/branding.desc"),
+		"/etc/calamares/branding/ubuntu/branding.desc",
+		"/etc/calamares/branding/debian/branding.desc",
+		"/etc/calamares/branding/default/branding.desc",
 	}
 
-	var brandingFile string
+	var brandingFile, content string
 	for _, p := range paths {
-		if _, err := os.Stat(p); err == nil {
-			brandingFile = p
+		if c, err := b.readFile(p); err == nil {
+			brandingFile, content = p, c
 			break
 		}
 	}
@@ -994,12 +777,7 @@ func (b *Builder) applyBranding() error {
 		return fmt.Errorf("branding.desc not found in expected locations")
 	}
 
-	content, err := os.ReadFile(brandingFile)
-	if err != nil {
-		return err
-	}
-
-	lines := strings.Split(string(content), "\n")
+	lines := strings.Split(content, "\n")
 	for i, line := range lines {
 		trimmed := strings.TrimSpace(line)
 		switch {
@@ -1016,7 +794,7 @@ func (b *Builder) applyBranding() error {
 		}
 	}
 
-	return os.WriteFile(brandingFile, []byte(strings.Join(lines, "\n")), 0644)
+	return b.writeFile(brandingFile, strings.Join(lines, "\n"), 0644)
 }
 
 func (b *Builder) resolveDebianRelease() {
@@ -1032,14 +810,8 @@ func (b *Builder) resolveDebianRelease() {
 	b.DebianAlias = alias
 	fmt.Printf("[INFO] Resolving Debian '%s' alias to current codename...\n", alias)
 
-	mirror := b.Config.Repository.Mirror
-	if mirror == "" {
-		mirror = "http://deb.debian.org/debian/"
-	}
-
-	url := fmt.Sprintf("%sdists/%s/Release", mirror, alias)
-	cmd := exec.Command("wget", "-qO-", url)
-	output, err := cmd.Output()
+	url := fmt.Sprintf("%sdists/%s/Release", b.buildMirror(), alias)
+	output, err := fetchURL(url)
 	if err != nil {
 		log.Printf("[WARNING] Could not resolve Debian codename via network; proceeding with alias '%s'", alias)
 		return
@@ -0,0 +1,202 @@
+package builder
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"kagami/pkg/apt"
+)
+
+type MissingPackage struct {
+	Group       string
+	Name        string
+	Suggestions []string
+}
+
+type PackageCheck struct {
+	Checked     int
+	Missing     []MissingPackage
+	PinProblems []string
+	IndexErrors []error
+}
+
+func (b *Builder) indexSources() []apt.Source {
+	var sources []apt.Source
+	for _, e := range b.hostSourceEntries() {
+		sources = append(sources, apt.Source{
+			Name:       "archive",
+			URI:        e.URI,
+			Suite:      e.Suite,
+			Components: e.Components,
+		})
+	}
+
+	for _, repo := range b.Config.Repository.AdditionalRepos {
+		sources = append(sources, apt.Source{
+			Name:       repo.Name,
+			URI:        b.repoURI(repo),
+			Suite:      repo.Suite,
+			Components: repo.Components,
+		})
+	}
+
+	return sources
+}
+
+func (b *Builder) loadPackageIndex() (*apt.Index, []error, error) {
+	if b.packageIndex != nil {
+		return b.packageIndex, nil, nil
+	}
+
+	fetcher := apt.NewFetcher(apt.DefaultCacheDir())
+	fetcher.OnLog = b.log
+
+	idx, errs := fetcher.LoadIndex(b.indexSources(), b.Config.System.Architecture)
+	if idx.Len() == 0 {
+		return nil, errs, fmt.Errorf("no package indices could be loaded for %s/%s", b.Config.Release, b.Config.System.Architecture)
+	}
+
+	debs, err := b.loadLocalDebs()
+	if err != nil {
+		return nil, errs, err
+	}
+	for _, deb := range debs {
+		idx.Add(deb.Package)
+	}
+
+	b.packageIndex = idx
+	return idx, errs, nil
+}
+
+// CheckPackages resolves every configured package name against the
+// repository indices without touching the host system, so it is safe to run
+// unprivileged.
+func (b *Builder) CheckPackages() (*PackageCheck, error) {
+	if err := b.PrepareConfig(); err != nil {
+		return nil, err
+	}
+	return b.checkPackages()
+}
+
+func (b *Builder) checkPackages() (*PackageCheck, error) {
+	groups, err := b.packageGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	idx, indexErrs, err := b.loadPackageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PackageCheck{IndexErrors: indexErrs}
+	seen := make(map[string]bool)
+
+	for _, group := range groups {
+		for _, spec := range group.Packages {
+			name := packageName(spec)
+			if name == "" || seen[group.Name+"/"+name] {
+				continue
+			}
+			seen[group.Name+"/"+name] = true
+			result.Checked++
+
+			if !idx.Has(name) {
+				result.Missing = append(result.Missing, MissingPackage{
+					Group:       group.Name,
+					Name:        name,
+					Suggestions: idx.Suggest(name, 3),
+				})
+			} else if problem := checkPackageSpec(idx, spec); problem != "" {
+				result.PinProblems = append(result.PinProblems, group.Name+" "+problem)
+			}
+		}
+	}
+
+	result.PinProblems = append(result.PinProblems, checkAptPreferences(idx, b.Config.AptPreferences)...)
+
+	if b.Locked {
+		lock, err := b.loadLock()
+		if err != nil {
+			return nil, err
+		}
+		result.PinProblems = append(result.PinProblems, checkLockAvailability(idx, lock)...)
+	}
+
+	return result, nil
+}
+
+func (b *Builder) verifyPackages() error {
+	if b.Locked {
+		lock, err := b.loadLock()
+		if err != nil {
+			return err
+		}
+		b.checkLockConfig(lock)
+	}
+
+	if _, err := b.loadLocalDebs(); err != nil {
+		return err
+	}
+
+	if err := b.checkFlatpakFiles(); err != nil {
+		return err
+	}
+
+	result, err := b.checkPackages()
+	if err != nil {
+		log.Printf("[WARNING] Package availability preflight skipped: %v", err)
+		return nil
+	}
+
+	b.log(result.Report())
+
+	if len(result.Missing) > 0 {
+		return fmt.Errorf("%d configured package(s) are not available; run 'kagami check <config>' for details", len(result.Missing))
+	}
+	if len(result.PinProblems) > 0 {
+		return fmt.Errorf("%d package pin(s) cannot be satisfied; run 'kagami check <config>' for details", len(result.PinProblems))
+	}
+	return nil
+}
+
+func (r *PackageCheck) Report() string {
+	var sb strings.Builder
+
+	for _, err := range r.IndexErrors {
+		fmt.Fprintf(&sb, "[WARNING] Index unavailable: %v\n", err)
+	}
+
+	for _, problem := range r.PinProblems {
+		fmt.Fprintf(&sb, "[ERROR] Unsatisfiable pin: %s\n", problem)
+	}
+
+	if len(r.Missing) == 0 {
+		fmt.Fprintf(&sb, "[OK] All %d configured packages are available\n", r.Checked)
+		return sb.String()
+	}
+
+	fmt.Fprintf(&sb, "[ERROR] %d of %d configured packages are not available:\n", len(r.Missing), r.Checked)
+	for _, m := range r.Missing {
+		fmt.Fprintf(&sb, "  - %-12s %s", m.Group, m.Name)
+		if len(m.Suggestions) > 0 {
+			fmt.Fprintf(&sb, " (did you mean: %s?)", strings.Join(m.Suggestions, ", "))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// packageName strips APT install qualifiers (=version, /suite, :arch) from a
+// package specification.
+func packageName(spec string) string {
+	name := strings.TrimSpace(spec)
+	if i := strings.IndexAny(name, "=/"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
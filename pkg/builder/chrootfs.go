@@ -0,0 +1,279 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const maxSymlinkHops = 255
+
+type RenderedFile struct {
+	Op      string
+	Path    string
+	Content string
+	Mode    os.FileMode
+	Target  string
+}
+
+// RenderedFiles returns every file operation performed through the chroot
+// file API, in order. With DryRun set, the operations are recorded only.
+func (b *Builder) RenderedFiles() []RenderedFile {
+	return append([]RenderedFile(nil), b.rendered...)
+}
+
+// RenderConfiguration records, without touching ChrootDir, the files the
+// configuration steps would write: base system and APT configuration,
+// snapd suppression and the firmware report. Steps that need a populated
+// chroot or network access are not rendered.
+func (b *Builder) RenderConfiguration() ([]RenderedFile, error) {
+	b.DryRun = true
+	b.rendered = nil
+
+	if err := b.applySnapReplacements(); err != nil {
+		return nil, err
+	}
+
+	steps := []func() error{
+		b.writeBaseConfig,
+		b.writeSnapshotAptConfig,
+		b.writeAptPreferences,
+		b.writeLockPreferences,
+		b.writeChrootProxyConfig,
+		b.installFirmwareReport,
+	}
+	if b.snapdBlocked() {
+		steps = append(steps, func() error { return b.writeSnapdLayers(b.snapdLayers()) })
+	}
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return nil, err
+		}
+	}
+	return b.RenderedFiles(), nil
+}
+
+type chrootFile struct {
+	Path    string
+	Content string
+	Mode    os.FileMode
+}
+
+func (b *Builder) writeFiles(files []chrootFile) error {
+	for _, f := range files {
+		if err := b.writeFile(f.Path, f.Content, f.Mode); err != nil {
+			return fmt.Errorf("failed to write %s: %v", f.Path, err)
+		}
+	}
+	return nil
+}
+
+func (b *Builder) record(f RenderedFile) {
+	b.rendered = append(b.rendered, f)
+}
+
+// chrootPath maps an absolute path inside the chroot to a host path,
+// resolving symlinks relative to the chroot root so that neither ".." nor
+// absolute link targets can escape it. The final component is only
+// dereferenced when followFinal is set.
+func (b *Builder) chrootPath(p string, followFinal bool) (string, error) {
+	if !path.IsAbs(p) {
+		return "", fmt.Errorf("chroot path must be absolute: %s", p)
+	}
+
+	root := filepath.Clean(b.ChrootDir)
+	resolved := "/"
+	remaining := strings.Split(strings.TrimPrefix(path.Clean(p), "/"), "/")
+	hops := 0
+
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		if len(remaining) == 0 && !followFinal {
+			resolved = next
+			break
+		}
+
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many symlink levels resolving %s", p)
+		}
+
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+
+	return filepath.Join(root, filepath.FromSlash(resolved)), nil
+}
+
+func (b *Builder) writeFile(p, content string, mode os.FileMode) error {
+	b.record(RenderedFile{Op: "write", Path: p, Content: content, Mode: mode})
+	if b.DryRun {
+		return nil
+	}
+
+	hostPath, err := b.chrootPath(p, true)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(hostPath, []byte(content), mode); err != nil {
+		return err
+	}
+	return os.Chmod(hostPath, mode)
+}
+
+func (b *Builder) appendFile(p, content string, mode os.FileMode) error {
+	b.record(RenderedFile{Op: "append", Path: p, Content: content, Mode: mode})
+	if b.DryRun {
+		return nil
+	}
+
+	hostPath, err := b.chrootPath(p, true)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(hostPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (b *Builder) readFile(p string) (string, error) {
+	hostPath, err := b.chrootPath(p, true)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(hostPath)
+	return string(data), err
+}
+
+func (b *Builder) chmodFile(p string, mode os.FileMode) error {
+	b.record(RenderedFile{Op: "chmod", Path: p, Mode: mode})
+	if b.DryRun {
+		return nil
+	}
+
+	hostPath, err := b.chrootPath(p, true)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(hostPath, mode)
+}
+
+func (b *Builder) symlinkFile(target, p string) error {
+	b.record(RenderedFile{Op: "symlink", Path: p, Target: target})
+	if b.DryRun {
+		return nil
+	}
+
+	hostPath, err := b.chrootPath(p, false)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(hostPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, hostPath)
+}
+
+func (b *Builder) removeFile(p string) error {
+	b.record(RenderedFile{Op: "remove", Path: p})
+	if b.DryRun {
+		return nil
+	}
+
+	hostPath, err := b.chrootPath(p, false)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(hostPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// divertFile moves p aside with dpkg-divert so package upgrades cannot
+// restore it, then points p at replacement when one is given.
+func (b *Builder) divertFile(p, replacement string) error {
+	b.record(RenderedFile{Op: "divert", Path: p, Target: replacement})
+	if b.DryRun {
+		return nil
+	}
+
+	if err := b.chrootExec("dpkg-divert --local --rename --add " + shellQuote(p)); err != nil {
+		return err
+	}
+	if replacement == "" {
+		return nil
+	}
+
+	hostPath, err := b.chrootPath(p, false)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(hostPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(replacement, hostPath)
+}
+
+// undivertFile removes whatever replaced p and restores the original.
+func (b *Builder) undivertFile(p string) error {
+	b.record(RenderedFile{Op: "undivert", Path: p})
+	if b.DryRun {
+		return nil
+	}
+
+	hostPath, err := b.chrootPath(p, false)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(hostPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return b.chrootExec("dpkg-divert --local --rename --remove " + shellQuote(p))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
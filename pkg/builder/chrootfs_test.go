@@ -0,0 +1,151 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"kagami/pkg/config"
+)
+
+func newTestBuilder(t *testing.T) *Builder {
+	t.Helper()
+	cfg := config.NewDefaultConfig("noble")
+	b := NewBuilder(cfg, t.TempDir(), "")
+	if err := os.MkdirAll(b.ChrootDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestChrootFileOpsAreRecorded(t *testing.T) {
+	b := newTestBuilder(t)
+
+	if err := b.writeFile("/etc/hostname", "kagami\n", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.appendFile("/etc/hostname", "extra\n", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.chmodFile("/etc/hostname", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.symlinkFile("/etc/hostname", "/etc/hostname.link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.removeFile("/etc/hostname.link"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []RenderedFile{
+		{Op: "write", Path: "/etc/hostname", Content: "kagami\n", Mode: 0644},
+		{Op: "append", Path: "/etc/hostname", Content: "extra\n", Mode: 0644},
+		{Op: "chmod", Path: "/etc/hostname", Mode: 0600},
+		{Op: "symlink", Path: "/etc/hostname.link", Target: "/etc/hostname"},
+		{Op: "remove", Path: "/etc/hostname.link"},
+	}
+	if got := b.RenderedFiles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("recorded ops:\n got %+v\nwant %+v", got, want)
+	}
+
+	hostPath := filepath.Join(b.ChrootDir, "etc", "hostname")
+	data, err := os.ReadFile(hostPath)
+	if err != nil || string(data) != "kagami\nextra\n" {
+		t.Errorf("hostname content %q, %v", data, err)
+	}
+	if info, err := os.Stat(hostPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("hostname mode %v, %v", info.Mode().Perm(), err)
+	}
+	if _, err := os.Lstat(hostPath + ".link"); !os.IsNotExist(err) {
+		t.Errorf("symlink not removed: %v", err)
+	}
+}
+
+func TestDryRunRecordsWithoutWriting(t *testing.T) {
+	b := newTestBuilder(t)
+	b.DryRun = true
+
+	if err := b.writeFile("/etc/motd", "hello\n", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.divertFile("/usr/bin/snap", "/bin/false"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []RenderedFile{
+		{Op: "write", Path: "/etc/motd", Content: "hello\n", Mode: 0644},
+		{Op: "divert", Path: "/usr/bin/snap", Target: "/bin/false"},
+	}
+	if got := b.RenderedFiles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("recorded ops:\n got %+v\nwant %+v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(b.ChrootDir, "etc", "motd")); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote into the chroot: %v", err)
+	}
+}
+
+func TestChrootPathStaysInsideRoot(t *testing.T) {
+	b := newTestBuilder(t)
+	root := b.ChrootDir
+
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Both an absolute and a relative link that point outside the chroot
+	// when followed on the host.
+	if err := os.Symlink("/etc", filepath.Join(root, "abs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../../../../../etc", filepath.Join(root, "rel")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"/../../etc/passwd": filepath.Join(root, "etc", "passwd"),
+		"/abs/passwd":       filepath.Join(root, "etc", "passwd"),
+		"/rel/passwd":       filepath.Join(root, "etc", "passwd"),
+	}
+	for p, want := range cases {
+		got, err := b.chrootPath(p, true)
+		if err != nil {
+			t.Errorf("chrootPath(%s): %v", p, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("chrootPath(%s) = %s, want %s", p, got, want)
+		}
+	}
+
+	if _, err := b.chrootPath("etc/passwd", true); err == nil {
+		t.Error("relative path accepted")
+	}
+}
+
+func TestRenderConfiguration(t *testing.T) {
+	b := newTestBuilder(t)
+	b.Config.Security.SnapdLayers = []string{"pinning", "marker"}
+
+	files, err := b.RenderConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make(map[string]bool)
+	for _, f := range files {
+		paths[f.Path] = true
+	}
+	for _, p := range []string{"/etc/hostname", "/etc/apt/sources.list", "/etc/apt/preferences.d/nosnapd.pref", "/etc/snapd-blocked", snapdLayersRecord, snapdUnblockScript} {
+		if !paths[p] {
+			t.Errorf("%s not rendered", p)
+		}
+	}
+	if paths["/etc/update-motd.d/99-snapd-blocked"] {
+		t.Error("unselected motd layer rendered")
+	}
+
+	entries, _ := os.ReadDir(b.ChrootDir)
+	if len(entries) != 0 {
+		t.Errorf("RenderConfiguration wrote %d entries into the chroot", len(entries))
+	}
+}
@@ -0,0 +1,135 @@
+package builder
+
+import (
+	"fmt"
+
+	"kagami/pkg/config"
+)
+
+const (
+	firmwareReportScript  = "/usr/local/sbin/kagami-firmware-report"
+	firmwareReportService = "/etc/systemd/system/kagami-firmware-report.service"
+	firmwareReportWants   = "/etc/systemd/system/multi-user.target.wants/kagami-firmware-report.service"
+	firmwareReportProfile = "/etc/profile.d/kagami-firmware-report.sh"
+)
+
+var debianWirelessFirmware = []string{
+	"firmware-iwlwifi",
+	"firmware-realtek",
+	"firmware-atheros",
+	"firmware-brcm80211",
+	"firmware-libertas",
+	"firmware-misc-nonfree",
+	"wireless-regdb",
+}
+
+// Ubuntu ships almost all firmware in the single linux-firmware package.
+var ubuntuWirelessFirmware = []string{
+	"linux-firmware",
+	"wireless-regdb",
+}
+
+// firmwarePackages resolves the firmware preset for the target distribution.
+func (b *Builder) firmwarePackages() []string {
+	var pkgs []string
+
+	switch b.Config.Firmware.Preset {
+	case config.FirmwareWireless:
+		if b.isDebian() {
+			pkgs = append(pkgs, debianWirelessFirmware...)
+		} else {
+			pkgs = append(pkgs, ubuntuWirelessFirmware...)
+		}
+	case config.FirmwareFull:
+		if b.isDebian() {
+			pkgs = append(pkgs, "firmware-linux", "firmware-sof-signed")
+			pkgs = append(pkgs, debianWirelessFirmware...)
+		} else {
+			pkgs = append(pkgs, ubuntuWirelessFirmware...)
+			pkgs = append(pkgs, "firmware-sof-signed")
+		}
+	}
+
+	return dedupe(append(pkgs, b.Config.Firmware.Packages...))
+}
+
+// installFirmware installs the firmware group and rebuilds the initramfs, so
+// that drivers loaded from it, such as amdgpu or i915, find their firmware
+// before the root filesystem is mounted.
+func (b *Builder) installFirmware() error {
+	pkgs := b.firmwarePackages()
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	fmt.Printf("[INFO] Installing %d firmware package(s) for the %s preset\n", len(pkgs), b.firmwarePreset())
+	if err := b.installGroup("firmware", pkgs); err != nil {
+		return err
+	}
+
+	return b.chrootExec("update-initramfs -u -k all")
+}
+
+func (b *Builder) firmwarePreset() string {
+	if b.Config.Firmware.Preset == "" {
+		return config.FirmwareNone
+	}
+	return b.Config.Firmware.Preset
+}
+
+const firmwareReportScriptContent = `#!/bin/sh
+# Lists firmware the kernel requested during this boot but could not load.
+report=/run/kagami/firmware-report
+mkdir -p /run/kagami
+
+{ journalctl -k -b -o cat 2>/dev/null || dmesg 2>/dev/null; } |
+    sed -n -e 's/.*Direct firmware load for \([^ ]*\) failed.*/\1/p' \
+           -e 's/.*firmware: failed to load \([^ ]*\).*/\1/p' |
+    sort -u > "$report"
+
+if [ -s "$report" ]; then
+    echo "Missing firmware detected:"
+    sed 's/^/  /' "$report"
+else
+    echo "No missing firmware detected."
+fi
+`
+
+const firmwareReportServiceContent = `[Unit]
+Description=Report firmware missing in the live session
+After=systemd-udev-trigger.service systemd-modules-load.service
+ConditionKernelCommandLine=|boot=live
+ConditionKernelCommandLine=|boot=casper
+
+[Service]
+Type=oneshot
+ExecStart=/usr/local/sbin/kagami-firmware-report
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const firmwareReportProfileContent = `if [ -s /run/kagami/firmware-report ]; then
+    echo "Some hardware is missing firmware in this live session:"
+    sed 's/^/  /' /run/kagami/firmware-report
+    echo "See 'journalctl -u kagami-firmware-report' for details."
+fi
+`
+
+// installFirmwareReport adds a boot-time service to the live session that
+// lists firmware files the kernel failed to load.
+func (b *Builder) installFirmwareReport() error {
+	if !b.Config.Firmware.DetectAtBoot {
+		return nil
+	}
+
+	files := []chrootFile{
+		{firmwareReportScript, firmwareReportScriptContent, 0755},
+		{firmwareReportService, firmwareReportServiceContent, 0644},
+		{firmwareReportProfile, firmwareReportProfileContent, 0644},
+	}
+	if err := b.writeFiles(files); err != nil {
+		return err
+	}
+	return b.symlinkFile(firmwareReportService, firmwareReportWants)
+}
@@ -0,0 +1,199 @@
+package builder
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"kagami/pkg/config"
+)
+
+const (
+	flatpakStagingDir = "/tmp/kagami-flatpak"
+	flatpakInstall    = "flatpak install --system --noninteractive -y"
+)
+
+// flatpakRemotes returns the configured remotes, with Flathub first unless a
+// remote of that name replaces it.
+func (b *Builder) flatpakRemotes() []config.FlatpakRemote {
+	remotes := []config.FlatpakRemote{{Name: config.DefaultFlatpakRemote, URL: "https://flathub.org/repo/flathub.flatpakrepo"}}
+	for _, remote := range b.Config.Flatpak.Remotes {
+		if remote.Name == config.DefaultFlatpakRemote {
+			remotes = remotes[1:]
+			break
+		}
+	}
+	return append(remotes, b.Config.Flatpak.Remotes...)
+}
+
+// flatpakRefs groups the configured apps and runtimes by remote, keeping the
+// order of the configuration. Runtimes come first so apps find them.
+func (b *Builder) flatpakRefs() (map[string][]string, []string) {
+	refs := make(map[string][]string)
+	var order []string
+	for _, entry := range append(append([]string(nil), b.Config.Flatpak.Runtimes...), b.Config.Flatpak.Apps...) {
+		remote, ref := config.FlatpakRef(entry)
+		if _, ok := refs[remote]; !ok {
+			order = append(order, remote)
+		}
+		refs[remote] = append(refs[remote], ref)
+	}
+	return refs, order
+}
+
+// checkFlatpakFiles makes sure the host files the flatpak section names exist
+// and, offline, that no ref needs a remote that is not registered, before the
+// build starts.
+func (b *Builder) checkFlatpakFiles() error {
+	if !b.Config.Packages.EnableFlatpak {
+		return nil
+	}
+	if b.isOffline() {
+		if err := b.Config.Flatpak.CheckOfflineRefs(); err != nil {
+			return err
+		}
+	}
+
+	var files []string
+	for _, remote := range b.Config.Flatpak.Remotes {
+		if remote.File != "" {
+			files = append(files, remote.File)
+		}
+		if remote.GPGKey != "" {
+			files = append(files, remote.GPGKey)
+		}
+	}
+	files = append(files, b.Config.Flatpak.Bundles...)
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("flatpak file %s: %v", file, err)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("flatpak file %s is a directory", file)
+		}
+	}
+	return nil
+}
+
+// stageFlatpakFile copies a host file into the chroot's staging directory and
+// returns its path inside the chroot.
+func (b *Builder) stageFlatpakFile(src string) (string, error) {
+	p := filepath.Join(flatpakStagingDir, filepath.Base(src))
+	if _, _, err := b.copyIntoChroot(src, p); err != nil {
+		return "", fmt.Errorf("failed to copy %s into the chroot: %v", src, err)
+	}
+	return p, nil
+}
+
+func (b *Builder) addFlatpakRemote(remote config.FlatpakRemote) error {
+	cmd := "flatpak remote-add --system --if-not-exists"
+	location := remote.URL
+
+	switch {
+	case remote.File != "":
+		staged, err := b.stageFlatpakFile(remote.File)
+		if err != nil {
+			return err
+		}
+		cmd += " --from"
+		location = staged
+	case remote.HasRepoFile():
+		cmd += " --from"
+	case remote.GPGKey != "":
+		staged, err := b.stageFlatpakFile(remote.GPGKey)
+		if err != nil {
+			return err
+		}
+		cmd += " --gpg-import=" + staged
+	case remote.GPGVerify != nil && !*remote.GPGVerify:
+		log.Printf("[WARNING] Flatpak remote %s is registered with GPG verification disabled (gpg_verify: false)", remote.Name)
+		cmd += " --no-gpg-verify"
+	default:
+		return fmt.Errorf("flatpak remote %s is a repository URL without a signing key; set gpg_key, or gpg_verify to false", remote.Name)
+	}
+
+	return b.chrootExec(fmt.Sprintf("%s %s %s", cmd, remote.Name, location))
+}
+
+func (b *Builder) installFlatpak() error {
+	fmt.Println("[INFO] Installing Flatpak and registering remotes...")
+
+	pkgList := strings.Join(b.flatpakPackages(), " ")
+	if err := b.chrootExec(b.aptGetCommand("install") + " " + pkgList); err != nil {
+		return err
+	}
+
+	refs, order := b.flatpakRefs()
+
+	for _, remote := range b.flatpakRemotes() {
+		if remote.URL != "" && b.isOffline() {
+			log.Printf("[INFO] Offline build; skipping registration of Flatpak remote %s", remote.Name)
+			continue
+		}
+		if err := b.addFlatpakRemote(remote); err != nil {
+			if len(refs[remote.Name]) > 0 {
+				return fmt.Errorf("failed to register Flatpak remote %s: %v", remote.Name, err)
+			}
+			log.Printf("[WARNING] Failed to register Flatpak remote %s: %v", remote.Name, err)
+		}
+	}
+
+	for _, remote := range order {
+		fmt.Printf("[INFO] Installing %d Flatpak ref(s) from %s: %s\n", len(refs[remote]), remote, strings.Join(refs[remote], ", "))
+		if err := b.chrootExec(fmt.Sprintf("%s %s %s", flatpakInstall, remote, strings.Join(refs[remote], " "))); err != nil {
+			return fmt.Errorf("failed to install Flatpak refs from %s: %v", remote, err)
+		}
+	}
+
+	for _, bundle := range b.Config.Flatpak.Bundles {
+		fmt.Printf("[INFO] Installing Flatpak bundle %s\n", filepath.Base(bundle))
+		staged, err := b.stageFlatpakFile(bundle)
+		if err != nil {
+			return err
+		}
+		if err := b.chrootExec(fmt.Sprintf("%s --bundle %s", flatpakInstall, staged)); err != nil {
+			return fmt.Errorf("failed to install Flatpak bundle %s: %v", bundle, err)
+		}
+	}
+
+	if err := b.removeFile(flatpakStagingDir); err != nil {
+		return err
+	}
+
+	return b.recordFlatpaks()
+}
+
+// recordFlatpaks lists the system-wide installation, which lives in
+// /var/lib/flatpak and so is copied to disk with the rest of the squashfs.
+func (b *Builder) recordFlatpaks() error {
+	if len(b.Config.Flatpak.Apps)+len(b.Config.Flatpak.Runtimes)+len(b.Config.Flatpak.Bundles) == 0 {
+		return nil
+	}
+
+	output, err := b.chrootExecOutput("flatpak list --system --columns=ref")
+	if err != nil {
+		return fmt.Errorf("failed to list installed Flatpaks: %v", err)
+	}
+
+	var installed []string
+	for _, line := range strings.Split(output, "\n") {
+		if ref := strings.TrimSpace(line); ref != "" {
+			installed = append(installed, ref)
+		}
+	}
+	sort.Strings(installed)
+	b.flatpaks = installed
+
+	fmt.Printf("[OK] %d Flatpak ref(s) installed system-wide\n", len(installed))
+	return nil
+}
+
+// Flatpaks returns the Flatpak refs preinstalled in the image.
+func (b *Builder) Flatpaks() []string {
+	return append([]string(nil), b.flatpaks...)
+}
@@ -8,9 +8,21 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"time"
 )
 
+func isLiveOnlyPackage(manifestLine string, liveOnly []string) bool {
+	fields := strings.Fields(manifestLine)
+	if len(fields) == 0 {
+		return false
+	}
+	for _, pkg := range liveOnly {
+		if fields[0] == pkg || strings.HasPrefix(fields[0], pkg+"-") {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *Builder) createFilesystem() error {
 	liveDestDir := filepath.Join(b.ImageDir, b.liveDir())
 
@@ -50,17 +62,16 @@ func (b *Builder) createFilesystem() error {
 		}
 	}
 
-	manifestContent := output
-	for _, pkg := range liveRemovePackages {
-		lines := strings.Split(manifestContent, "\n")
-		var filteredLines []string
-		for _, line := range lines {
-			if !strings.Contains(line, pkg) {
-				filteredLines = append(filteredLines, line)
-			}
+	// Match package names and their name- prefixed companions, such as
+	// ubiquity-frontend-gtk. A plain substring match on "discover" would also
+	// uninstall plasma-discover and its Flatpak backend from installed systems.
+	var filteredLines []string
+	for _, line := range strings.Split(output, "\n") {
+		if !isLiveOnlyPackage(line, liveRemovePackages) {
+			filteredLines = append(filteredLines, line)
 		}
-		manifestContent = strings.Join(filteredLines, "\n")
 	}
+	manifestContent := strings.Join(filteredLines, "\n")
 
 	if err := os.WriteFile(manifestDesktopPath, []byte(manifestContent), 0644); err != nil {
 		return err
@@ -112,6 +123,10 @@ func (b *Builder) createFilesystem() error {
 		return err
 	}
 
+	if err := b.verifySquashfsClean(squashfsPath); err != nil {
+		return err
+	}
+
 	sizePath := filepath.Join(liveDestDir, "filesystem.size")
 	duCmd := exec.Command("du", "-sx", "--block-size=1", b.ChrootDir)
 	outputBytes, err := duCmd.Output()
@@ -124,6 +139,10 @@ func (b *Builder) createFilesystem() error {
 		return err
 	}
 
+	if err := b.writeSizeReport(squashfsPath); err != nil {
+		log.Printf("[WARNING] Size report unavailable: %v", err)
+	}
+
 	return nil
 }
 
@@ -349,38 +368,40 @@ func (b *Builder) createISO() error {
 func (b *Builder) cleanup() error {
 	fmt.Println("[INFO] Unmounting filesystems and releasing temporary resources...")
 
-	mounts := []string{
-		filepath.Join(b.ChrootDir, "dev/pts"),
-		filepath.Join(b.ChrootDir, "dev"),
-		filepath.Join(b.ChrootDir, "proc"),
-		filepath.Join(b.ChrootDir, "sys"),
-		filepath.Join(b.ChrootDir, "run"),
-	}
+	b.unmountLocalRepos()
 
-	for _, mount := range mounts {
-		if isMounted(mount) {
-			for i := 0; i < 3; i++ {
-				cmd := exec.Command("umount", "-l", mount)
-				if err := cmd.Run(); err == nil {
-					break
-				}
-				time.Sleep(500 * time.Millisecond)
-			}
-		}
+	if err := b.mounts.unmountAll(b.ChrootDir); err != nil {
+		log.Printf("[WARNING] %v", err)
 	}
 
 	return nil
 }
 
 func (b *Builder) RemoveWorkspace() error {
+	// The caller normally still holds the lock from the build. Take it when
+	// it does not, so another build's workspace is not deleted from under it.
+	if err := b.LockWorkspace(false); err != nil {
+		return err
+	}
+	defer b.UnlockWorkspace()
+
 	b.log(fmt.Sprintf("[INFO] Removing build workspace: %s\n", b.WorkDir))
+	b.stopAptProxy()
 	b.cleanup()
-	cmd := exec.Command("rm", "-rf", b.WorkDir)
+
+	// Never recurse through a mount that could not be released: a still-bound
+	// /dev would be deleted along with the workspace.
+	if remaining := mountsUnder(b.WorkDir); len(remaining) > 0 {
+		return fmt.Errorf("refusing to remove %s while mounts remain: %s; run 'kagami cleanup-mounts --workdir %s'",
+			b.WorkDir, strings.Join(remaining, ", "), b.WorkDir)
+	}
+
+	cmd := exec.Command("rm", "-rf", "--one-file-system", b.WorkDir)
 	return cmd.Run()
 }
 
 func (b *Builder) chrootExec(command string) error {
-	cmd := exec.Command("chroot", b.ChrootDir, "/bin/bash", "-c", command)
+	cmd := b.execCommand(command)
 	if b.OnLog != nil {
 		cmd.Stdout = &logWriter{b}
 		cmd.Stderr = &logWriter{b}
@@ -392,7 +413,7 @@ func (b *Builder) chrootExec(command string) error {
 }
 
 func (b *Builder) chrootExecOutput(command string) (string, error) {
-	cmd := exec.Command("chroot", b.ChrootDir, "/bin/bash", "-c", command)
+	cmd := b.execCommand(command)
 	output, err := cmd.Output()
 	return string(output), err
 }
@@ -406,74 +427,58 @@ func (w *logWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
-func (b *Builder) generateSourcesList() string {
-	mirror := b.Config.Repository.Mirror
-	if mirror == "" {
-		if b.isDebian() {
-			mirror = "http://deb.debian.org/debian/"
-		} else {
-			mirror = "http://archive.ubuntu.com/ubuntu/"
-		}
+type sourceEntry struct {
+	URI        string
+	Suite      string
+	Components []string
+}
+
+func (b *Builder) sourceEntries(mirror, securityMirror string) []sourceEntry {
+	release := b.Config.Release
+
+	var components []string
+	if b.isDebian() {
+		components = []string{"main", "contrib", "non-free", "non-free-firmware"}
+	} else {
+		components = []string{"main", "restricted", "universe", "multiverse"}
 	}
 
-	var sourcesContent string
+	entries := []sourceEntry{{mirror, release, components}}
+
 	if b.isDebian() {
-		if b.DebianAlias == "unstable" || b.Config.Release == "sid" {
-			sourcesContent = fmt.Sprintf(`cat > /etc/apt/sources.list <<'EOF'
-deb %s %s main contrib non-free non-free-firmware
-deb-src %s %s main contrib non-free non-free-firmware
-`, mirror, b.Config.Release, mirror, b.Config.Release)
-		} else {
-			sourcesContent = fmt.Sprintf(`cat > /etc/apt/sources.list <<'EOF'
-deb %s %s main contrib non-free non-free-firmware
-deb-src %s %s main contrib non-free non-free-firmware
-
-deb %s %s-updates main contrib non-free non-free-firmware
-deb-src %s %s-updates main contrib non-free non-free-firmware
-
-deb http://security.debian.org/debian-security %s-security main contrib non-free non-free-firmware
-deb-src http://security.debian.org/debian-security %s-security main contrib non-free non-free-firmware
-`,
-				mirror, b.Config.Release,
-				mirror, b.Config.Release,
-				mirror, b.Config.Release,
-				mirror, b.Config.Release,
-				b.Config.Release,
-				b.Config.Release,
+		if b.DebianAlias != "unstable" && release != "sid" {
+			entries = append(entries,
+				sourceEntry{mirror, release + "-updates", components},
+				sourceEntry{securityMirror, release + "-security", components},
 			)
 		}
 	} else {
-		sourcesContent = fmt.Sprintf(`cat > /etc/apt/sources.list <<'EOF'
-deb %s %s main restricted universe multiverse
-deb-src %s %s main restricted universe multiverse
-
-deb %s %s-security main restricted universe multiverse
-deb-src %s %s-security main restricted universe multiverse
-
-deb %s %s-updates main restricted universe multiverse
-deb-src %s %s-updates main restricted universe multiverse
-`,
-			mirror, b.Config.Release,
-			mirror, b.Config.Release,
-			mirror, b.Config.Release,
-			mirror, b.Config.Release,
-			mirror, b.Config.Release,
-			mirror, b.Config.Release,
+		entries = append(entries,
+			sourceEntry{mirror, release + "-security", components},
+			sourceEntry{mirror, release + "-updates", components},
 		)
 	}
 
-	if b.Config.Repository.UseProposed && b.Config.Release != "sid" && b.Config.Release != "unstable" {
-		sourcesContent += fmt.Sprintf(`
-deb %s %s-proposed main restricted universe multiverse
-deb-src %s %s-proposed main restricted universe multiverse
-`,
-			mirror, b.Config.Release,
-			mirror, b.Config.Release,
-		)
+	if b.Config.Repository.UseProposed && release != "sid" && release != "unstable" {
+		entries = append(entries, sourceEntry{mirror, release + "-proposed", []string{"main", "restricted", "universe", "multiverse"}})
 	}
 
-	sourcesContent += "EOF"
-	return sourcesContent
+	return entries
+}
+
+func renderSourcesList(entries []sourceEntry, withSources bool) string {
+	var sb strings.Builder
+	for i, e := range entries {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		line := fmt.Sprintf("%s %s %s\n", e.URI, e.Suite, strings.Join(e.Components, " "))
+		sb.WriteString("deb " + line)
+		if withSources {
+			sb.WriteString("deb-src " + line)
+		}
+	}
+	return sb.String()
 }
 
 func (b *Builder) configureAdditionalRepos() error {
@@ -487,8 +492,6 @@ func (b *Builder) configureAdditionalRepos() error {
 
 		keyName := fmt.Sprintf("%s.gpg", repo.Name)
 		keyPath := filepath.Join(keyringsDir, keyName)
-		chrootKeyPath := filepath.Join("/etc/apt/keyrings", keyName)
-		signedByOpt := fmt.Sprintf("[signed-by=%s]", chrootKeyPath)
 
 		if repo.Key != "" {
 			if strings.HasPrefix(repo.Key, "http://") || strings.HasPrefix(repo.Key, "https://") {
@@ -496,6 +499,8 @@ func (b *Builder) configureAdditionalRepos() error {
 					cmd := exec.Command("wget", "-qO", keyPath, repo.Key)
 					if output, err := cmd.CombinedOutput(); err != nil {
 						log.Printf("[WARNING] Key download failed for %s: %v\n%s", repo.Name, err, string(output))
+					} else if err := dearmorInPlace(keyPath); err != nil {
+						log.Printf("[WARNING] Key dearmoring failed for %s: %v", repo.Name, err)
 					}
 				} else {
 					wgetCmd := exec.Command("wget", "-qO-", repo.Key)
@@ -519,6 +524,21 @@ func (b *Builder) configureAdditionalRepos() error {
 
 					wgetCmd.Wait()
 				}
+			} else if keyFile := localKeyPath(repo.Key); keyFile != "" {
+				keyData, err := os.ReadFile(keyFile)
+				if err != nil {
+					log.Printf("[WARNING] Key file unreadable for %s: %v", repo.Name, err)
+				} else if strings.HasSuffix(keyFile, ".gpg") {
+					if err := os.WriteFile(keyPath, keyData, 0644); err != nil {
+						log.Printf("[WARNING] Key installation failed for %s: %v", repo.Name, err)
+					}
+				} else {
+					cmd := exec.Command("gpg", "--dearmor", "-o", keyPath)
+					cmd.Stdin = strings.NewReader(string(keyData))
+					if output, err := cmd.CombinedOutput(); err != nil {
+						log.Printf("[WARNING] Key dearmoring failed for %s: %v\n%s", repo.Name, err, string(output))
+					}
+				}
 			} else {
 				cmd := exec.Command("gpg", "--dearmor", "-o", keyPath)
 				cmd.Stdin = strings.NewReader(repo.Key)
@@ -526,21 +546,12 @@ func (b *Builder) configureAdditionalRepos() error {
 					log.Printf("[WARNING] Inline key processing failed for %s: %v\n%s", repo.Name, err, string(output))
 				}
 			}
-		} else {
-			signedByOpt = ""
 		}
 
-		components := strings.Join(repo.Components, " ")
-		repoLine := fmt.Sprintf("deb %s %s %s %s", signedByOpt, repo.URI, repo.Suite, components)
-		repoLine = strings.ReplaceAll(repoLine, "  ", " ")
-
-		repoFilePath := filepath.Join(b.ChrootDir, "etc", "apt", "sources.list.d", fmt.Sprintf("%s.list", repo.Name))
+		repoLine := additionalRepoLine(repo, b.chrootRepoURI(repo.Name, b.repoURI(repo)))
+		repoFilePath := fmt.Sprintf("/etc/apt/sources.list.d/%s.list", repo.Name)
 
-		if err := os.MkdirAll(filepath.Dir(repoFilePath), 0755); err != nil {
-			return fmt.Errorf("failed to create sources.list.d directory: %v", err)
-		}
-
-		if err := os.WriteFile(repoFilePath, []byte(repoLine+"\n"), 0644); err != nil {
+		if err := b.writeFile(repoFilePath, repoLine, 0644); err != nil {
 			return fmt.Errorf("failed to create repository file for %s: %v", repo.Name, err)
 		}
 	}
@@ -548,22 +559,41 @@ func (b *Builder) configureAdditionalRepos() error {
 	return nil
 }
 
-func isMounted(path string) bool {
-	file, err := os.Open("/proc/mounts")
+// dearmorInPlace converts an ASCII-armored key saved under a .gpg name, as
+// some vendors publish them, to the binary form signed-by expects.
+func dearmorInPlace(keyPath string) error {
+	data, err := os.ReadFile(keyPath)
 	if err != nil {
-		return false
+		return err
+	}
+	if !strings.HasPrefix(strings.TrimSpace(string(data)), "-----BEGIN PGP") {
+		return nil
 	}
-	defer file.Close()
 
-	absPath, err := filepath.Abs(path)
-	if err != nil {
-		absPath = path
+	cmd := exec.Command("gpg", "--dearmor", "--yes", "-o", keyPath)
+	cmd.Stdin = strings.NewReader(string(data))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v\n%s", err, string(output))
 	}
+	return nil
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		fields := strings.Fields(scanner.Text())
-		if len(fields) >= 2 && fields[1] == absPath {
+func localKeyPath(key string) string {
+	if isFileURI(key) {
+		return fileURIPath(key)
+	}
+	if filepath.IsAbs(key) && !strings.Contains(key, "\n") {
+		if _, err := os.Stat(key); err == nil {
+			return key
+		}
+	}
+	return ""
+}
+
+func isMounted(path string) bool {
+	target := canonicalPath(path)
+	for _, p := range mountPoints() {
+		if p == target {
 			return true
 		}
 	}
@@ -0,0 +1,134 @@
+package builder
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"kagami/pkg/config"
+)
+
+type installPolicy struct {
+	Recommends bool
+	OnFailure  string
+}
+
+// PackageFailure lists the packages of one group that could not be
+// installed on their own.
+type PackageFailure struct {
+	Group    string   `json:"group"`
+	Packages []string `json:"packages"`
+}
+
+// defaultPolicy is the behaviour of each group when packages.policies does
+// not override it.
+func (b *Builder) defaultPolicy(group string) installPolicy {
+	switch group {
+	case "essential", "local":
+		return installPolicy{Recommends: true, OnFailure: config.OnFailureFail}
+	case "kernel":
+		return installPolicy{Recommends: false, OnFailure: config.OnFailureFail}
+	case "firmware":
+		return installPolicy{Recommends: false, OnFailure: config.OnFailureWarn}
+	case "additional":
+		return installPolicy{Recommends: true, OnFailure: config.OnFailureWarn}
+	case "desktop":
+		return installPolicy{Recommends: !b.isDebian(), OnFailure: config.OnFailureFail}
+	case "installer":
+		recommends := b.Config.Installer.Type == "calamares" || b.Config.Packages.Desktop == "none"
+		return installPolicy{Recommends: recommends, OnFailure: config.OnFailureWarn}
+	}
+	return installPolicy{Recommends: true, OnFailure: config.OnFailureFail}
+}
+
+func (b *Builder) groupPolicy(group string) installPolicy {
+	policy := b.defaultPolicy(group)
+	override, ok := b.Config.Packages.Policies[group]
+	if !ok {
+		return policy
+	}
+	if override.Recommends != nil {
+		policy.Recommends = *override.Recommends
+	}
+	if override.OnFailure != "" {
+		policy.OnFailure = override.OnFailure
+	}
+	return policy
+}
+
+// aptGetCommand starts a non-interactive apt-get command. Locked builds pin
+// packages at priority 1001, and apt only moves an installed package down to
+// such a pin when downgrades are allowed.
+func (b *Builder) aptGetCommand(action string) string {
+	cmd := "DEBIAN_FRONTEND=noninteractive apt-get " + action + " -y"
+	if b.Locked {
+		cmd += " --allow-downgrades"
+	}
+	return cmd
+}
+
+func (b *Builder) aptInstallCommand(recommends, simulate bool, pkgs []string) string {
+	cmd := b.aptGetCommand("install")
+	if !recommends {
+		cmd += " --no-install-recommends"
+	}
+	if simulate {
+		cmd += " --simulate"
+	}
+	return cmd + " " + strings.Join(pkgs, " ")
+}
+
+// installGroup installs a package group in one transaction. When that fails,
+// every package is retried on its own to find the failing names. With
+// skip-individually the retries install each package for real, so the rest
+// of the group still lands; fail and warn only simulate them and leave the
+// group uninstalled, as apt did.
+func (b *Builder) installGroup(group string, pkgs []string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	policy := b.groupPolicy(group)
+	err := b.chrootExec(b.aptInstallCommand(policy.Recommends, false, pkgs))
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("[WARNING] Installing the %s group failed: %v; retrying package by package", group, err)
+
+	simulate := policy.OnFailure != config.OnFailureSkip
+	var failed []string
+	for _, pkg := range pkgs {
+		if err := b.chrootExec(b.aptInstallCommand(policy.Recommends, simulate, []string{pkg})); err != nil {
+			failed = append(failed, pkg)
+		}
+	}
+
+	if len(failed) == 0 {
+		if simulate {
+			// Every package resolves on its own, so the failure came from the
+			// combination or from a maintainer script.
+			failed = pkgs
+		} else {
+			log.Printf("[WARNING] Every %s package installed on its own after the group install failed", group)
+			return nil
+		}
+	}
+
+	b.installFailures = append(b.installFailures, PackageFailure{Group: group, Packages: failed})
+
+	switch policy.OnFailure {
+	case config.OnFailureFail:
+		return fmt.Errorf("%s packages failed to install: %s", group, strings.Join(failed, ", "))
+	case config.OnFailureWarn:
+		log.Printf("[WARNING] %s group not installed; failing packages: %s", group, strings.Join(failed, ", "))
+	default:
+		fmt.Printf("[INFO] Skipped %s packages that failed to install: %s\n", group, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// InstallFailures returns the packages that failed to install, by group.
+func (b *Builder) InstallFailures() []PackageFailure {
+	return append([]PackageFailure(nil), b.installFailures...)
+}
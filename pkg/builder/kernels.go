@@ -0,0 +1,230 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"kagami/pkg/apt"
+)
+
+// maxKernelDepth bounds the dependency walk from a kernel metapackage such
+// as linux-generic to the package that ships /boot/vmlinuz-*.
+const maxKernelDepth = 4
+
+// liveKernel is one installed kernel and the names it is copied to on the
+// ISO. The first kernel keeps the plain vmlinuz and initrd names.
+type liveKernel struct {
+	Package string
+	Version string
+	Vmlinuz string
+	Initrd  string
+	ISOName string
+	ISOInit string
+}
+
+// packageFiles reads a package's file list from the chroot's dpkg database.
+func (b *Builder) packageFiles(pkg string) []string {
+	infoDir := filepath.Join(b.ChrootDir, "var", "lib", "dpkg", "info")
+	candidates := []string{
+		filepath.Join(infoDir, pkg+".list"),
+		filepath.Join(infoDir, pkg+":"+b.Config.System.Architecture+".list"),
+	}
+
+	for _, path := range candidates {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		var files []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			files = append(files, scanner.Text())
+		}
+		return files
+	}
+	return nil
+}
+
+// installedDepends maps every installed package to the names in its Depends
+// and Pre-Depends fields.
+func (b *Builder) installedDepends() (map[string][]string, error) {
+	f, err := os.Open(filepath.Join(b.ChrootDir, "var", "lib", "dpkg", "status"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stanzas, err := apt.ParseStanzas(f)
+	if err != nil {
+		return nil, err
+	}
+
+	depends := make(map[string][]string)
+	for _, st := range stanzas {
+		if st["Status"] != "install ok installed" {
+			continue
+		}
+		depends[st["Package"]] = append(apt.RelationNames(st["Depends"]), apt.RelationNames(st["Pre-Depends"])...)
+	}
+	return depends, nil
+}
+
+// kernelVersions follows a kernel package's dependencies breadth first and
+// returns the versions of the /boot/vmlinuz-* files found at the shallowest
+// level, newest first.
+func (b *Builder) kernelVersions(pkg string, depends map[string][]string) []string {
+	level := []string{pkg}
+	seen := map[string]bool{pkg: true}
+
+	for depth := 0; depth <= maxKernelDepth && len(level) > 0; depth++ {
+		var versions, next []string
+		for _, name := range level {
+			if _, installed := depends[name]; !installed {
+				continue
+			}
+			for _, file := range b.packageFiles(name) {
+				if strings.HasPrefix(file, "/boot/vmlinuz-") {
+					versions = append(versions, strings.TrimPrefix(file, "/boot/vmlinuz-"))
+				}
+			}
+			for _, dep := range depends[name] {
+				if !seen[dep] {
+					seen[dep] = true
+					next = append(next, dep)
+				}
+			}
+		}
+
+		if len(versions) > 0 {
+			sort.Slice(versions, func(i, j int) bool { return apt.CompareVersions(versions[i], versions[j]) > 0 })
+			return dedupe(versions)
+		}
+		level = next
+	}
+	return nil
+}
+
+// liveKernels resolves every configured kernel package to its installed
+// kernel image and initrd.
+func (b *Builder) liveKernels() ([]liveKernel, error) {
+	depends, err := b.installedDepends()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the dpkg database: %v", err)
+	}
+
+	var kernels []liveKernel
+	seen := make(map[string]bool)
+
+	for _, pkg := range b.kernelMetapackages() {
+		versions := b.kernelVersions(pkg, depends)
+		if len(versions) == 0 {
+			return nil, fmt.Errorf("no kernel image is installed by package %s", pkg)
+		}
+
+		version := versions[0]
+		if seen[version] {
+			continue
+		}
+		seen[version] = true
+
+		k := liveKernel{
+			Package: pkg,
+			Version: version,
+			Vmlinuz: filepath.Join(b.ChrootDir, "boot", "vmlinuz-"+version),
+			Initrd:  filepath.Join(b.ChrootDir, "boot", "initrd.img-"+version),
+			ISOName: "vmlinuz",
+			ISOInit: "initrd",
+		}
+		if len(kernels) > 0 {
+			k.ISOName += "-" + version
+			k.ISOInit += "-" + version
+		}
+		if _, err := os.Stat(k.Initrd); err != nil {
+			return nil, fmt.Errorf("kernel %s from %s has no initrd: %v", version, pkg, err)
+		}
+
+		kernels = append(kernels, k)
+	}
+
+	return kernels, nil
+}
+
+func (b *Builder) copyLiveKernels(kernels []liveKernel) error {
+	liveDestDir := filepath.Join(b.ImageDir, b.liveDir())
+	for _, k := range kernels {
+		fmt.Printf("[INFO] Copying kernel %s (%s) to /%s/%s\n", k.Version, k.Package, b.liveDir(), k.ISOName)
+		if err := b.runCommand("cp", k.Vmlinuz, filepath.Join(liveDestDir, k.ISOName)); err != nil {
+			return err
+		}
+		if err := b.runCommand("cp", k.Initrd, filepath.Join(liveDestDir, k.ISOInit)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kernelMenuEntries renders the live, installer and integrity check entries
+// booting one kernel.
+func (b *Builder) kernelMenuEntries(k liveKernel, label string) string {
+	liveDir := b.liveDir()
+	bootParam := b.bootParam()
+	linux := fmt.Sprintf("/%s/%s", liveDir, k.ISOName)
+	initrd := fmt.Sprintf("/%s/%s", liveDir, k.ISOInit)
+
+	persistParam := "nopersistent"
+	if b.isDebian() {
+		persistParam = "nopersistence"
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `
+menuentry "Try %s without installing%s" {
+   linux %s %s %s toram quiet splash ---
+   initrd %s
+}`, b.getDistName(), label, linux, bootParam, persistParam, initrd)
+
+	switch b.Config.Installer.Type {
+	case "ubiquity":
+		fmt.Fprintf(&sb, `
+menuentry "Install %s (Ubiquity)%s" {
+   linux %s %s only-ubiquity quiet splash ---
+   initrd %s
+}`, b.getDistName(), label, linux, bootParam, initrd)
+	case "calamares":
+		fmt.Fprintf(&sb, `
+menuentry "Install %s (Calamares)%s" {
+   linux %s %s quiet splash ---
+   initrd %s
+}`, b.getDistName(), label, linux, bootParam, initrd)
+	}
+
+	fmt.Fprintf(&sb, `
+
+menuentry "Check disc for defects%s" {
+   linux %s %s integrity-check quiet splash ---
+   initrd %s
+}`, label, linux, bootParam, initrd)
+
+	return sb.String()
+}
+
+// kernelSubmenus renders a GRUB submenu per kernel when the ISO carries more
+// than one.
+func (b *Builder) kernelSubmenus(kernels []liveKernel) string {
+	if len(kernels) < 2 {
+		return ""
+	}
+
+	var sb strings.Builder
+	for _, k := range kernels {
+		label := fmt.Sprintf(" (kernel %s)", k.Version)
+		fmt.Fprintf(&sb, "\nsubmenu \"Kernel %s (%s)\" {%s\n}\n", k.Version, k.Package, b.kernelMenuEntries(k, label))
+	}
+	return sb.String()
+}
@@ -0,0 +1,89 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeDpkgList(t *testing.T, b *Builder, name string, files ...string) {
+	t.Helper()
+	dir := filepath.Join(b.ChrootDir, "var", "lib", "dpkg", "info")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".list"), []byte(strings.Join(files, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKernelVersions(t *testing.T) {
+	b := newTestBuilder(t)
+	b.Config.System.Architecture = "amd64"
+
+	writeDpkgList(t, b, "linux-image-6.8.0-40-generic", "/boot", "/boot/vmlinuz-6.8.0-40-generic")
+	writeDpkgList(t, b, "linux-image-6.8.0-45-generic:amd64", "/boot", "/boot/vmlinuz-6.8.0-45-generic")
+	writeDpkgList(t, b, "linux-image-6.11.0-8-generic", "/boot/vmlinuz-6.11.0-8-generic")
+	writeDpkgList(t, b, "linux-modules-6.8.0-45-generic", "/lib/modules/6.8.0-45-generic")
+
+	depends := map[string][]string{
+		"linux-generic":                  {"linux-image-generic", "linux-headers-generic"},
+		"linux-image-generic":            {"linux-image-6.8.0-45-generic", "linux-image-6.8.0-40-generic"},
+		"linux-image-6.8.0-45-generic":   {"linux-modules-6.8.0-45-generic"},
+		"linux-image-6.8.0-40-generic":   nil,
+		"linux-modules-6.8.0-45-generic": nil,
+		"linux-generic-hwe":              {"linux-image-generic-hwe"},
+		"linux-image-generic-hwe":        {"linux-image-6.11.0-8-generic"},
+	}
+
+	cases := []struct {
+		pkg  string
+		want []string
+	}{
+		// Both images sit at the same depth; the newest comes first.
+		{"linux-generic", []string{"6.8.0-45-generic", "6.8.0-40-generic"}},
+		{"linux-image-6.8.0-40-generic", []string{"6.8.0-40-generic"}},
+		// The image itself is not installed, so nothing is found through it.
+		{"linux-generic-hwe", nil},
+		{"linux-lowlatency", nil},
+	}
+	for _, c := range cases {
+		if got := b.kernelVersions(c.pkg, depends); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("kernelVersions(%s) = %q, want %q", c.pkg, got, c.want)
+		}
+	}
+}
+
+func TestKernelSubmenus(t *testing.T) {
+	b := newTestBuilder(t)
+	b.Config.Installer.Type = "calamares"
+
+	kernels := []liveKernel{
+		{Package: "linux-generic", Version: "6.8.0-45-generic", ISOName: "vmlinuz", ISOInit: "initrd"},
+		{Package: "linux-generic-hwe-24.04", Version: "6.11.0-8-generic", ISOName: "vmlinuz-6.11.0-8-generic", ISOInit: "initrd-6.11.0-8-generic"},
+	}
+
+	if got := b.kernelSubmenus(kernels[:1]); got != "" {
+		t.Errorf("single kernel rendered submenus:\n%s", got)
+	}
+
+	menu := b.kernelSubmenus(kernels)
+	if n := strings.Count(menu, "submenu "); n != 2 {
+		t.Fatalf("rendered %d submenus, want 2:\n%s", n, menu)
+	}
+	for _, want := range []string{
+		`submenu "Kernel 6.8.0-45-generic (linux-generic)" {`,
+		`submenu "Kernel 6.11.0-8-generic (linux-generic-hwe-24.04)" {`,
+		"(Calamares) (kernel 6.11.0-8-generic)\" {\n   linux /casper/vmlinuz-6.11.0-8-generic boot=casper quiet splash ---\n   initrd /casper/initrd-6.11.0-8-generic\n}",
+		"Check disc for defects (kernel 6.8.0-45-generic)\" {\n   linux /casper/vmlinuz boot=casper integrity-check",
+	} {
+		if !strings.Contains(menu, want) {
+			t.Errorf("submenus lack %q:\n%s", want, menu)
+		}
+	}
+	if strings.Count(menu, "{") != strings.Count(menu, "}") {
+		t.Errorf("unbalanced braces:\n%s", menu)
+	}
+}
@@ -0,0 +1,179 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"kagami/pkg/apt"
+)
+
+const (
+	localDebsDir  = "/var/lib/kagami/local-debs"
+	localDebsList = "/etc/apt/sources.list.d/kagami-local.list"
+	localDebsRepo = "local"
+)
+
+type localDeb struct {
+	Path    string
+	Control string
+	Package *apt.Package
+}
+
+// localDebFiles expands packages.local_debs; a directory contributes every
+// .deb file directly inside it.
+func (b *Builder) localDebFiles() ([]string, error) {
+	var files []string
+	for _, entry := range b.Config.Packages.LocalDebs {
+		info, err := os.Stat(entry)
+		if err != nil {
+			return nil, fmt.Errorf("local package %s: %v", entry, err)
+		}
+		if !info.IsDir() {
+			files = append(files, entry)
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(entry, "*.deb"))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("local package directory %s contains no .deb files", entry)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// loadLocalDebs reads the control data of every local package with dpkg-deb.
+func (b *Builder) loadLocalDebs() ([]localDeb, error) {
+	if b.localDebs != nil || len(b.Config.Packages.LocalDebs) == 0 {
+		return b.localDebs, nil
+	}
+
+	files, err := b.localDebFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var debs []localDeb
+	seen := make(map[string]string)
+	for _, file := range files {
+		if other, ok := seen[filepath.Base(file)]; ok {
+			return nil, fmt.Errorf("local packages %s and %s share a file name", other, file)
+		}
+		seen[filepath.Base(file)] = file
+
+		output, err := exec.Command("dpkg-deb", "--field", file).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read control data of %s: %v", file, err)
+		}
+
+		control := strings.TrimSpace(string(output))
+		pkgs, err := apt.ParsePackages(strings.NewReader(control), localDebsRepo)
+		if err != nil || len(pkgs) != 1 {
+			return nil, fmt.Errorf("%s is not a valid Debian package", file)
+		}
+		pkgs[0].Filename = "./" + filepath.Base(file)
+		debs = append(debs, localDeb{Path: file, Control: control, Package: pkgs[0]})
+	}
+
+	b.localDebs = debs
+	return debs, nil
+}
+
+func (b *Builder) localPackageNames() []string {
+	debs, err := b.loadLocalDebs()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, deb := range debs {
+		names = append(names, deb.Package.Name)
+	}
+	return dedupe(names)
+}
+
+// stageLocalDebs copies the local packages into the chroot and registers them
+// as a trusted flat repository, so apt resolves their dependencies from the
+// configured archives.
+func (b *Builder) stageLocalDebs() error {
+	debs, err := b.loadLocalDebs()
+	if err != nil || len(debs) == 0 {
+		return err
+	}
+
+	fmt.Printf("[INFO] Staging %d local package(s) in %s\n", len(debs), localDebsDir)
+
+	var index strings.Builder
+	for _, deb := range debs {
+		target := filepath.Join(localDebsDir, filepath.Base(deb.Path))
+		size, sum, err := b.copyIntoChroot(deb.Path, target)
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %v", deb.Path, err)
+		}
+		fmt.Fprintf(&index, "%s\nFilename: %s\nSize: %d\nSHA256: %s\n\n", deb.Control, deb.Package.Filename, size, sum)
+	}
+
+	return b.writeFiles([]chrootFile{
+		{filepath.Join(localDebsDir, "Packages"), index.String(), 0644},
+		{localDebsList, fmt.Sprintf("deb [trusted=yes] file:%s ./\n", localDebsDir), 0644},
+	})
+}
+
+func (b *Builder) copyIntoChroot(src, p string) (int64, string, error) {
+	b.record(RenderedFile{Op: "copy", Path: p, Target: src, Mode: 0644})
+	if b.DryRun {
+		return 0, "", nil
+	}
+
+	hostPath, err := b.chrootPath(p, true)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+		return 0, "", err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, "", err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(hostPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, "", err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// removeLocalDebs drops the temporary repository and its package list. The
+// installed packages stay in the image and its manifest.
+func (b *Builder) removeLocalDebs() error {
+	if len(b.Config.Packages.LocalDebs) == 0 {
+		return nil
+	}
+	if err := b.removeFile(localDebsList); err != nil {
+		return err
+	}
+	if err := b.removeFile(localDebsDir); err != nil {
+		return err
+	}
+	listPrefix := strings.ReplaceAll(strings.TrimPrefix(localDebsDir, "/"), "/", "_")
+	return b.chrootExec(fmt.Sprintf("rm -f /var/lib/apt/lists/_%s_*", listPrefix))
+}
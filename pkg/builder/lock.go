@@ -0,0 +1,145 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"kagami/pkg/system"
+)
+
+const workspaceLockSuffix = ".kagami-lock"
+
+type LockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+	Output  string    `json:"output"`
+}
+
+func (l *LockInfo) String() string {
+	if l.PID == 0 {
+		return "an unidentified kagami process"
+	}
+	return fmt.Sprintf("pid %d on %s, started %s", l.PID, l.Host, l.Started.Format(time.RFC3339))
+}
+
+// workspaceLockPath places the lock file next to the workspace rather than
+// in it, so removing the workspace never unlinks a lock that is still held.
+func workspaceLockPath(workDir string) string {
+	workDir = filepath.Clean(workDir)
+	return filepath.Join(filepath.Dir(workDir), "."+filepath.Base(workDir)+workspaceLockSuffix)
+}
+
+func readLockInfo(path string) *LockInfo {
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	var info LockInfo
+	if json.Unmarshal(data, &info) != nil {
+		return nil
+	}
+	return &info
+}
+
+// LockWorkspace takes an exclusive flock on the workspace lock file. The
+// kernel drops the lock when the holder exits, so a lock file whose flock
+// can be taken is stale by definition, whatever its recorded PID says. With
+// wait set, a held lock is polled until it is released.
+func (b *Builder) LockWorkspace(wait bool) error {
+	if b.lockFile != nil {
+		return nil
+	}
+	if err := os.MkdirAll(b.WorkDir, 0755); err != nil {
+		return fmt.Errorf("failed to create workspace %s: %v", b.WorkDir, err)
+	}
+
+	path := workspaceLockPath(b.WorkDir)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open workspace lock %s: %v", path, err)
+	}
+
+	announced := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return fmt.Errorf("failed to lock workspace %s: %v", b.WorkDir, err)
+		}
+
+		holder := "unknown process"
+		if info := readLockInfo(path); info != nil {
+			holder = info.String()
+		}
+		if !wait {
+			f.Close()
+			return fmt.Errorf("workspace %s is in use by %s; use --wait-lock to wait or --workdir to build elsewhere", b.WorkDir, holder)
+		}
+		if !announced {
+			fmt.Printf("[INFO] Workspace %s is in use by %s; waiting for it to be released...\n", b.WorkDir, holder)
+			announced = true
+		}
+		time.Sleep(2 * time.Second)
+	}
+
+	if stale := readLockInfo(path); stale != nil {
+		fmt.Printf("[INFO] Taking over stale workspace lock left by %s\n", stale.String())
+	}
+
+	host, _ := os.Hostname()
+	data, _ := json.MarshalIndent(LockInfo{
+		PID:     system.HostPID(),
+		Host:    host,
+		Started: time.Now(),
+		Output:  b.OutputISO,
+	}, "", "  ")
+
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt(append(data, '\n'), 0)
+		f.Sync()
+	}
+
+	b.lockFile = f
+	return nil
+}
+
+// UnlockWorkspace releases the workspace lock taken by LockWorkspace.
+func (b *Builder) UnlockWorkspace() {
+	if b.lockFile == nil {
+		return
+	}
+	b.lockFile.Truncate(0)
+	syscall.Flock(int(b.lockFile.Fd()), syscall.LOCK_UN)
+	b.lockFile.Close()
+	b.lockFile = nil
+}
+
+// WorkspaceLockHolder reports who holds the workspace lock, if anyone. It
+// returns nil when the workspace is free, including when only a stale lock
+// file from a dead process remains.
+func WorkspaceLockHolder(workDir string) *LockInfo {
+	path := workspaceLockPath(workDir)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		return nil
+	}
+
+	if info := readLockInfo(path); info != nil {
+		return info
+	}
+	return &LockInfo{}
+}
@@ -0,0 +1,349 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"kagami/pkg/apt"
+)
+
+const (
+	LockfileName      = "kagami.lock"
+	lockPreferences   = "/etc/apt/preferences.d/kagami-lock.pref"
+	lockedPinPriority = 1001
+)
+
+type Lockfile struct {
+	Distro       string          `json:"distro"`
+	Release      string          `json:"release"`
+	Architecture string          `json:"architecture"`
+	Config       string          `json:"config,omitempty"`
+	ConfigSHA256 string          `json:"config_sha256,omitempty"`
+	Generated    time.Time       `json:"generated"`
+	Packages     []LockedPackage `json:"packages"`
+}
+
+// LockedPackage records one installed package. Repo is the configured
+// repository and suite it was resolved from, such as "archive/noble-updates",
+// or empty when no index carried that version.
+type LockedPackage struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture"`
+	Repo         string `json:"repo"`
+}
+
+func LoadLockfile(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lock Lockfile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("invalid lockfile %s: %v", path, err)
+	}
+	return &lock, nil
+}
+
+func (l *Lockfile) Save(path string) error {
+	sort.Slice(l.Packages, func(i, j int) bool { return l.Packages[i].Name < l.Packages[j].Name })
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func lockRepo(p *apt.Package) string {
+	return p.Repo + "/" + p.Suite
+}
+
+// sameLockSource reports whether p comes from the repository a package was
+// locked from. Any suite of that repository qualifies, so packages follow
+// -updates and -security, except backports, which apt only installs on request.
+func sameLockSource(p *apt.Package, repo string) bool {
+	name, suite, _ := strings.Cut(repo, "/")
+	if p.Repo != name {
+		return false
+	}
+	return p.Suite == suite || !strings.HasSuffix(p.Suite, "-backports")
+}
+
+// installedPackages reads the chroot's dpkg status database directly, so it
+// needs neither mounts nor a working chroot.
+func (b *Builder) installedPackages() ([]LockedPackage, error) {
+	f, err := os.Open(filepath.Join(b.ChrootDir, "var", "lib", "dpkg", "status"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stanzas, err := apt.ParseStanzas(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var installed []LockedPackage
+	for _, st := range stanzas {
+		if st["Status"] != "install ok installed" {
+			continue
+		}
+		installed = append(installed, LockedPackage{
+			Name:         st["Package"],
+			Version:      st["Version"],
+			Architecture: st["Architecture"],
+		})
+	}
+	return installed, nil
+}
+
+// configIdentity returns the base name and SHA-256 of the configuration
+// file, or empty strings when the build has none.
+func (b *Builder) configIdentity() (name, sum string) {
+	if b.ConfigFile == "" {
+		return "", ""
+	}
+	if data, err := os.ReadFile(b.ConfigFile); err == nil {
+		sum = fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+	return filepath.Base(b.ConfigFile), sum
+}
+
+func (b *Builder) loadLock() (*Lockfile, error) {
+	lock, err := LoadLockfile(b.LockfilePath)
+	if err != nil {
+		return nil, fmt.Errorf("lockfile unavailable (a build without --locked writes one): %v", err)
+	}
+	if lock.Distro != b.Config.Distro || lock.Release != b.Config.Release || lock.Architecture != b.Config.System.Architecture {
+		return nil, fmt.Errorf("lockfile %s was generated for %s %s (%s), not %s %s (%s)",
+			b.LockfilePath, lock.Distro, lock.Release, lock.Architecture,
+			b.Config.Distro, b.Config.Release, b.Config.System.Architecture)
+	}
+	if name, _ := b.configIdentity(); lock.Config != "" && name != "" && lock.Config != name {
+		return nil, fmt.Errorf("lockfile %s was generated from %s, not %s; pass --lockfile to choose another", b.LockfilePath, lock.Config, name)
+	}
+	return lock, nil
+}
+
+// checkLockConfig warns when the configuration changed after the lockfile
+// was written: packages added since then are installed unlocked.
+func (b *Builder) checkLockConfig(lock *Lockfile) {
+	if _, sum := b.configIdentity(); lock.ConfigSHA256 != "" && sum != "" && lock.ConfigSHA256 != sum {
+		log.Printf("[WARNING] %s changed since %s was written; packages added since then are not locked", b.ConfigFile, b.LockfilePath)
+	}
+}
+
+// checkLockAvailability reports locked versions the indices no longer carry.
+// Entries without a repository did not come from an index and are skipped.
+func checkLockAvailability(idx *apt.Index, lock *Lockfile) []string {
+	var problems []string
+	for _, locked := range lock.Packages {
+		if locked.Repo == "" {
+			continue
+		}
+		found := false
+		for _, p := range idx.Lookup(locked.Name) {
+			if p.Version == locked.Version {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("lock %s=%s is no longer available", locked.Name, locked.Version))
+		}
+	}
+	return problems
+}
+
+// writeLockPreferences pins every locked package to its recorded version
+// above priority 1000, so apt installs exactly that version and downgrades
+// anything the bootstrapper brought in newer.
+func (b *Builder) writeLockPreferences() error {
+	if !b.Locked {
+		return nil
+	}
+
+	lock, err := b.loadLock()
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	for _, p := range lock.Packages {
+		fmt.Fprintf(&sb, "Package: %s\nPin: version %s\nPin-Priority: %d\n\n", p.Name, p.Version, lockedPinPriority)
+	}
+
+	fmt.Printf("[INFO] Pinning %d packages to the versions in %s\n", len(lock.Packages), b.LockfilePath)
+	return b.writeFile(lockPreferences, sb.String(), 0644)
+}
+
+func (b *Builder) removeLockPreferences() error {
+	if !b.Locked {
+		return nil
+	}
+	return b.removeFile(lockPreferences)
+}
+
+// recordLockfile writes the lockfile from the finished chroot. A locked build
+// instead verifies that every locked package was installed at its version.
+func (b *Builder) recordLockfile() error {
+	if b.LockfilePath == "" {
+		return nil
+	}
+
+	installed, err := b.installedPackages()
+	if err != nil {
+		return fmt.Errorf("failed to read installed packages: %v", err)
+	}
+
+	if b.Locked {
+		return b.verifyLockedInstall(installed)
+	}
+
+	idx, _, err := b.loadPackageIndex()
+	if err != nil {
+		log.Printf("[WARNING] Package indices unavailable; lockfile entries will not record their repository: %v", err)
+	}
+
+	for i := range installed {
+		if idx == nil {
+			break
+		}
+		for _, p := range idx.Lookup(installed[i].Name) {
+			if p.Version == installed[i].Version {
+				installed[i].Repo = lockRepo(p)
+				break
+			}
+		}
+	}
+
+	name, sum := b.configIdentity()
+	lock := &Lockfile{
+		Distro:       b.Config.Distro,
+		Release:      b.Config.Release,
+		Architecture: b.Config.System.Architecture,
+		Config:       name,
+		ConfigSHA256: sum,
+		Generated:    time.Now().UTC(),
+		Packages:     installed,
+	}
+	if err := lock.Save(b.LockfilePath); err != nil {
+		return fmt.Errorf("failed to write lockfile: %v", err)
+	}
+
+	fmt.Printf("[OK] Recorded %d package versions in %s\n", len(installed), b.LockfilePath)
+	return nil
+}
+
+func (b *Builder) verifyLockedInstall(installed []LockedPackage) error {
+	lock, err := b.loadLock()
+	if err != nil {
+		return err
+	}
+
+	versions := make(map[string]string)
+	for _, p := range installed {
+		versions[p.Name] = p.Version
+	}
+
+	var drifted, unlocked []string
+	locked := make(map[string]bool)
+	for _, p := range lock.Packages {
+		locked[p.Name] = true
+		if v, ok := versions[p.Name]; ok && v != p.Version {
+			drifted = append(drifted, fmt.Sprintf("%s %s (locked %s)", p.Name, v, p.Version))
+		}
+	}
+	for _, p := range installed {
+		if !locked[p.Name] {
+			unlocked = append(unlocked, p.Name+"="+p.Version)
+		}
+	}
+
+	if len(unlocked) > 0 {
+		log.Printf("[WARNING] %d installed package(s) are not in the lockfile: %s", len(unlocked), strings.Join(unlocked, ", "))
+	}
+	if len(drifted) > 0 {
+		return fmt.Errorf("installed versions differ from the lockfile: %s", strings.Join(drifted, ", "))
+	}
+
+	fmt.Printf("[OK] Installed packages match %s\n", b.LockfilePath)
+	return nil
+}
+
+type LockChange struct {
+	Name string
+	From string
+	To   string
+}
+
+// UpdateLockfile moves every locked package to the newest version in the
+// current indices, preferring the repository it was locked from.
+// Packages no longer available are dropped and reported with an empty To;
+// entries without a repository are kept as they are.
+func (b *Builder) UpdateLockfile() ([]LockChange, error) {
+	lock, err := b.loadLock()
+	if err != nil {
+		return nil, err
+	}
+
+	b.resolveDebianRelease()
+
+	idx, indexErrs, err := b.loadPackageIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range indexErrs {
+		log.Printf("[WARNING] Index unavailable: %v", e)
+	}
+
+	var changes []LockChange
+	var kept []LockedPackage
+
+	for _, locked := range lock.Packages {
+		if locked.Repo == "" {
+			kept = append(kept, locked)
+			continue
+		}
+
+		var best, bestSameRepo *apt.Package
+		for _, p := range idx.Lookup(locked.Name) {
+			if p.Architecture != locked.Architecture {
+				continue
+			}
+			if best == nil || apt.CompareVersions(p.Version, best.Version) > 0 {
+				best = p
+			}
+			if sameLockSource(p, locked.Repo) && (bestSameRepo == nil || apt.CompareVersions(p.Version, bestSameRepo.Version) > 0) {
+				bestSameRepo = p
+			}
+		}
+		if bestSameRepo != nil {
+			best = bestSameRepo
+		}
+
+		if best == nil {
+			changes = append(changes, LockChange{Name: locked.Name, From: locked.Version})
+			continue
+		}
+
+		if best.Version != locked.Version {
+			changes = append(changes, LockChange{Name: locked.Name, From: locked.Version, To: best.Version})
+		}
+		locked.Version = best.Version
+		locked.Repo = lockRepo(best)
+		kept = append(kept, locked)
+	}
+
+	lock.Packages = kept
+	lock.Config, lock.ConfigSHA256 = b.configIdentity()
+	lock.Generated = time.Now().UTC()
+	return changes, lock.Save(b.LockfilePath)
+}
@@ -0,0 +1,148 @@
+package builder
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const memtestURL = "https://memtest.org/download/v7.00/mt86plus_7.00.binaries.zip"
+
+var (
+	memtestBinNames = []string{"memtest86+.bin", "memtest86+x64.bin", "memtest64.bin"}
+	memtestEfiNames = []string{"memtest86+.efi", "memtest86+x64.efi", "memtest64.efi"}
+	memtestHostDirs = []string{"/boot", "/usr/lib/memtest86+"}
+)
+
+func (b *Builder) memtestDest() (bin, efi string) {
+	installDir := filepath.Join(b.ImageDir, "install")
+	return filepath.Join(installDir, "memtest86+.bin"), filepath.Join(installDir, "memtest86+.efi")
+}
+
+func (b *Builder) hasMemtest() (bin, efi bool) {
+	binPath, efiPath := b.memtestDest()
+	_, binErr := os.Stat(binPath)
+	_, efiErr := os.Stat(efiPath)
+	return binErr == nil, efiErr == nil
+}
+
+// locateMemtest searches the assets directory for memtest86+ binaries and,
+// offline only, the host and the chroot, in that order. Online builds
+// otherwise download the pinned release rather than depend on whatever
+// memtest86+ the host has installed.
+func (b *Builder) locateMemtest() (bin, efi string) {
+	var dirs []string
+	if b.Config.Build.AssetsDir != "" {
+		dirs = append(dirs, b.Config.Build.AssetsDir)
+	}
+	if b.isOffline() {
+		dirs = append(dirs, memtestHostDirs...)
+		for _, dir := range memtestHostDirs {
+			dirs = append(dirs, filepath.Join(b.ChrootDir, dir))
+		}
+	}
+
+	find := func(names []string) string {
+		for _, dir := range dirs {
+			for _, name := range names {
+				candidate := filepath.Join(dir, name)
+				if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+					return candidate
+				}
+			}
+		}
+		return ""
+	}
+
+	bin = find(memtestBinNames)
+	efi = find(memtestEfiNames)
+
+	if bin == "" && efi == "" && b.Config.Build.AssetsDir != "" {
+		zips, _ := filepath.Glob(filepath.Join(b.Config.Build.AssetsDir, "*.zip"))
+		for _, z := range zips {
+			if strings.Contains(filepath.Base(z), "mt86plus") || strings.Contains(filepath.Base(z), "memtest") {
+				return z, z
+			}
+		}
+	}
+
+	return bin, efi
+}
+
+func (b *Builder) installMemtest() {
+	binDest, efiDest := b.memtestDest()
+
+	bin, efi := b.locateMemtest()
+	if bin == "" && efi == "" {
+		if b.isOffline() {
+			log.Printf("[WARNING] Memtest86+ unavailable locally; omitting memory test boot entries")
+			return
+		}
+
+		memtestZip := filepath.Join(b.ImageDir, "install", "memtest86.zip")
+		defer os.Remove(memtestZip)
+		if err := exec.Command("wget", "--progress=dot", memtestURL, "-O", memtestZip).Run(); err != nil {
+			log.Printf("[WARNING] Memtest86+ download failed: %v", err)
+			return
+		}
+		bin, efi = memtestZip, memtestZip
+	}
+
+	if err := copyMemtest(bin, "memtest64.bin", binDest); err != nil && bin != "" {
+		log.Printf("[WARNING] Memtest86+ BIOS binary unavailable: %v", err)
+	}
+	if err := copyMemtest(efi, "memtest64.efi", efiDest); err != nil && efi != "" {
+		log.Printf("[WARNING] Memtest86+ UEFI binary unavailable: %v", err)
+	}
+}
+
+func copyMemtest(src, zipMember, dest string) error {
+	if src == "" {
+		return fmt.Errorf("no source")
+	}
+
+	if strings.HasSuffix(src, ".zip") {
+		zr, err := zip.OpenReader(src)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		for _, f := range zr.File {
+			if filepath.Base(f.Name) != zipMember {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			return writeFileFrom(dest, rc)
+		}
+		return fmt.Errorf("%s not found in %s", zipMember, src)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFileFrom(dest, in)
+}
+
+func writeFileFrom(dest string, r io.Reader) error {
+	out, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
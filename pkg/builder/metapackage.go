@@ -0,0 +1,187 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// metapackageName derives a Debian package name from the branding, such as
+// "acme-os-baseline" for "Acme OS". It is empty when the product name has no
+// usable characters.
+func (b *Builder) metapackageName() string {
+	product := b.Config.Installer.Branding.ShortProductName
+	if product == "" {
+		product = b.Config.Installer.Branding.ProductName
+	}
+
+	var sb strings.Builder
+	for _, r := range strings.ToLower(product) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '+', r == '.':
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('-')
+		}
+	}
+
+	name := strings.Trim(sb.String(), "-.+")
+	for strings.Contains(name, "--") {
+		name = strings.ReplaceAll(name, "--", "-")
+	}
+	if name == "" {
+		return ""
+	}
+	return name + "-baseline"
+}
+
+func (b *Builder) metapackageFile() string {
+	return fmt.Sprintf("%s_%s_all.deb", b.metapackageName(), b.Config.Installer.Branding.Version)
+}
+
+// metapackageDepends lists the desktop and additional packages that ended up
+// installed. Packages that failed to install are left out, since depending
+// on them would make the metapackage itself uninstallable.
+func (b *Builder) metapackageDepends() ([]string, error) {
+	desktop, err := b.desktopPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	installed, err := b.installedPackages()
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool)
+	for _, p := range installed {
+		present[p.Name] = true
+	}
+
+	var depends, skipped []string
+	for _, spec := range append(append([]string{}, desktop...), b.Config.Packages.Additional...) {
+		name := packageName(spec)
+		if name == "" {
+			continue
+		}
+		if present[name] {
+			depends = append(depends, name)
+		} else {
+			skipped = append(skipped, name)
+		}
+	}
+
+	if len(skipped) > 0 {
+		log.Printf("[WARNING] Metapackage omits packages that are not installed: %s", strings.Join(dedupe(skipped), ", "))
+	}
+	return dedupe(depends), nil
+}
+
+func (b *Builder) metapackageControl(depends []string) string {
+	branding := b.Config.Installer.Branding
+	product := branding.ProductName
+	if product == "" {
+		product = branding.ShortProductName
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Package: %s\n", b.metapackageName())
+	fmt.Fprintf(&sb, "Version: %s\n", branding.Version)
+	sb.WriteString("Architecture: all\n")
+	fmt.Fprintf(&sb, "Maintainer: %s <root@localhost>\n", product)
+	sb.WriteString("Section: metapackages\n")
+	sb.WriteString("Priority: optional\n")
+	if len(depends) > 0 {
+		fmt.Fprintf(&sb, "Depends: %s\n", strings.Join(depends, ", "))
+	}
+	if branding.ProductUrl != "" {
+		fmt.Fprintf(&sb, "Homepage: %s\n", branding.ProductUrl)
+	}
+	fmt.Fprintf(&sb, "Description: %s package baseline\n", product)
+	sb.WriteString(" Depends on the desktop and additional packages selected for this image,\n")
+	sb.WriteString(" so that apt autoremove keeps them installed.\n")
+	return sb.String()
+}
+
+// addToPool copies the metapackage into the ISO pool and indexes it there as
+// a flat repository, which the live system can use with
+// "deb [trusted=yes] file:/cdrom/pool ./".
+func (b *Builder) addToPool(debPath, control string) error {
+	name := b.metapackageName()
+	filename := path.Join("main", name[:1], name, b.metapackageFile())
+
+	data, err := os.ReadFile(debPath)
+	if err != nil {
+		return err
+	}
+
+	poolDir := filepath.Join(b.ImageDir, "pool")
+	if err := os.MkdirAll(filepath.Join(poolDir, filepath.Dir(filename)), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(poolDir, filename), data, 0644); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	index := fmt.Sprintf("%s\nFilename: ./%s\nSize: %d\nSHA256: %s\n\n", strings.TrimSpace(control), filename, len(data), hex.EncodeToString(sum[:]))
+	return os.WriteFile(filepath.Join(poolDir, "Packages"), []byte(index), 0644)
+}
+
+// installMetapackage builds the baseline metapackage with dpkg-deb, installs
+// it in the chroot and adds it to the ISO pool.
+func (b *Builder) installMetapackage() error {
+	if !b.Config.Packages.Metapackage {
+		return nil
+	}
+
+	name := b.metapackageName()
+	if name == "" {
+		return fmt.Errorf("no package name can be derived from the branding product name")
+	}
+
+	depends, err := b.metapackageDepends()
+	if err != nil {
+		return fmt.Errorf("failed to read installed packages: %v", err)
+	}
+
+	buildDir := filepath.Join(b.WorkDir, "metapackage")
+	rootDir := filepath.Join(buildDir, name)
+	if err := os.RemoveAll(rootDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(rootDir, "DEBIAN"), 0755); err != nil {
+		return err
+	}
+	control := b.metapackageControl(depends)
+	if err := os.WriteFile(filepath.Join(rootDir, "DEBIAN", "control"), []byte(control), 0644); err != nil {
+		return err
+	}
+
+	debPath := filepath.Join(buildDir, b.metapackageFile())
+	if err := b.runCommand("dpkg-deb", "--root-owner-group", "--build", rootDir, debPath); err != nil {
+		return fmt.Errorf("failed to build metapackage: %v", err)
+	}
+
+	chrootDeb := "/tmp/" + b.metapackageFile()
+	if _, _, err := b.copyIntoChroot(debPath, chrootDeb); err != nil {
+		return err
+	}
+	if err := b.chrootExec(b.aptGetCommand("install") + " " + chrootDeb); err != nil {
+		return fmt.Errorf("failed to install metapackage: %v", err)
+	}
+	if err := b.removeFile(chrootDeb); err != nil {
+		return err
+	}
+
+	if err := b.addToPool(debPath, control); err != nil {
+		return fmt.Errorf("failed to add metapackage to the ISO pool: %v", err)
+	}
+
+	fmt.Printf("[OK] Installed metapackage %s %s with %d dependencies\n", name, b.Config.Installer.Branding.Version, len(depends))
+	return nil
+}
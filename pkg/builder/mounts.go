@@ -0,0 +1,277 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type mountRecord struct {
+	Source string
+	Target string
+	FSType string
+	Bind   bool
+}
+
+// mountManager records every mount the build makes so teardown can release
+// them in reverse order instead of relying on lazy unmounts.
+type mountManager struct {
+	mounts []mountRecord
+}
+
+func (m *mountManager) bind(source, target string, readOnly bool) error {
+	if isMounted(target) {
+		return nil
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create mount target %s: %v", target, err)
+	}
+	if output, err := exec.Command("mount", "--bind", source, target).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to bind %s to %s: %v: %s", source, target, err, strings.TrimSpace(string(output)))
+	}
+	m.mounts = append(m.mounts, mountRecord{Source: source, Target: target, Bind: true})
+
+	if readOnly {
+		exec.Command("mount", "-o", "remount,bind,ro", target).Run()
+	}
+	return nil
+}
+
+func (m *mountManager) rbind(source, target string) error {
+	if isMounted(target) {
+		return nil
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create mount target %s: %v", target, err)
+	}
+	if output, err := exec.Command("mount", "--rbind", source, target).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to bind %s to %s: %v: %s", source, target, err, strings.TrimSpace(string(output)))
+	}
+	m.mounts = append(m.mounts, mountRecord{Source: source, Target: target, Bind: true})
+	return nil
+}
+
+func (m *mountManager) mount(fstype, source, target string, options ...string) error {
+	if isMounted(target) {
+		return nil
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create mount target %s: %v", target, err)
+	}
+
+	args := []string{"-t", fstype}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	args = append(args, source, target)
+
+	if output, err := exec.Command("mount", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount %s on %s: %v: %s", fstype, target, err, strings.TrimSpace(string(output)))
+	}
+	m.mounts = append(m.mounts, mountRecord{Source: source, Target: target, FSType: fstype})
+	return nil
+}
+
+func (m *mountManager) unmount(target string) error {
+	for i := len(m.mounts) - 1; i >= 0; i-- {
+		if m.mounts[i].Target == target {
+			m.mounts = append(m.mounts[:i], m.mounts[i+1:]...)
+			break
+		}
+	}
+	return unmountPath(target)
+}
+
+// unmountAll releases recorded mounts newest first, then sweeps anything
+// still mounted below root (for example mounts made by package scripts or
+// the submounts of a recursive bind). Individual failures are tolerated as
+// long as nothing is left mounted at the end.
+func (m *mountManager) unmountAll(root string) error {
+	for i := len(m.mounts) - 1; i >= 0; i-- {
+		unmountPath(m.mounts[i].Target)
+	}
+	m.mounts = nil
+
+	for _, target := range mountsUnder(root) {
+		unmountPath(target)
+	}
+
+	if remaining := mountsUnder(root); len(remaining) > 0 {
+		return fmt.Errorf("mounts still active below %s: %s", root, strings.Join(remaining, ", "))
+	}
+	return nil
+}
+
+// unmountPath tries a regular unmount a few times before falling back to a
+// lazy one, so busy mounts are detached rather than left in place.
+func unmountPath(target string) error {
+	if !isMounted(target) {
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := exec.Command("umount", target).Run(); err == nil {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	if output, err := exec.Command("umount", "-l", target).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to unmount %s: %v: %s", target, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// mountsUnder lists mount points at or below root, deepest first, in the
+// order they must be unmounted.
+func mountsUnder(root string) []string {
+	return mountsBelow(mountPoints(), canonicalPath(root))
+}
+
+// mountsBelow returns the mount points at or below root in unmount order.
+func mountsBelow(points []string, root string) []string {
+	var found []string
+	for _, target := range points {
+		if target == root || strings.HasPrefix(target, root+"/") {
+			found = append(found, target)
+		}
+	}
+
+	// mountinfo lists mounts oldest first; reversing it and then ordering by
+	// depth unmounts children before their parents.
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return strings.Count(found[i], "/") > strings.Count(found[j], "/")
+	})
+
+	return dedupe(found)
+}
+
+func mountPoints() []string {
+	var points []string
+	for _, entry := range readMountInfo() {
+		points = append(points, entry.Target)
+	}
+	return points
+}
+
+type mountEntry struct {
+	Target  string
+	FSType  string
+	Options []string
+}
+
+func readMountInfo() []mountEntry {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	return parseMountInfo(file)
+}
+
+// parseMountInfo reads /proc/<pid>/mountinfo lines. A variable number of
+// optional fields precedes the "-" separator, after which come the
+// filesystem type, the source and the superblock options.
+func parseMountInfo(r io.Reader) []mountEntry {
+	var entries []mountEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if i >= 6 && f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+
+		// Per-mount options come first; superblock options follow the fstype.
+		options := strings.Split(fields[5], ",")
+		if sep+3 < len(fields) {
+			options = append(options, strings.Split(fields[sep+3], ",")...)
+		}
+		entries = append(entries, mountEntry{
+			Target:  unescapeMountPath(fields[4]),
+			FSType:  fields[sep+1],
+			Options: dedupe(options),
+		})
+	}
+	return entries
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for space and so on)
+// the kernel uses in mountinfo.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+func canonicalPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		abs = p
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return filepath.Clean(abs)
+}
+
+func dedupe(items []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, item := range items {
+		if !seen[item] {
+			seen[item] = true
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// CleanupMounts releases mounts left below workDir by builds that crashed
+// outside a private mount namespace. It returns the mount points released.
+func CleanupMounts(workDir string) ([]string, error) {
+	targets := mountsUnder(workDir)
+
+	var released, failed []string
+	for _, target := range targets {
+		if err := unmountPath(target); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", target, err))
+			continue
+		}
+		released = append(released, target)
+	}
+
+	if len(failed) > 0 {
+		return released, fmt.Errorf("could not release: %s", strings.Join(failed, ", "))
+	}
+	return released, nil
+}
@@ -0,0 +1,101 @@
+package builder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Recorded from a host with a bind-mounted build chroot, plus a target with
+// spaces and one with several optional fields.
+const testMountInfo = `22 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw,errors=remount-ro
+24 22 0:22 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+25 22 0:5 / /dev rw,nosuid,relatime shared:2 - devtmpfs udev rw,size=8024296k,mode=755
+31 22 259:3 / /home rw,relatime shared:29 - ext4 /dev/nvme0n1p3 rw
+412 31 259:3 /kagami/work /home/user/kagami/work rw,relatime shared:29 - ext4 /dev/nvme0n1p3 rw
+418 412 0:5 / /home/user/kagami/work/chroot/dev rw,nosuid,relatime shared:2 - devtmpfs udev rw,size=8024296k
+419 418 0:24 / /home/user/kagami/work/chroot/dev/pts rw,nosuid,noexec,relatime shared:3 - devpts devpts rw,gid=5,mode=620
+420 412 0:22 / /home/user/kagami/work/chroot/proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+421 31 0:50 / /home/user/My\040Builds rw,nosuid,nodev shared:40 master:7 propagate_from:2 - tmpfs tmpfs rw,size=1048576k
+malformed line
+`
+
+func TestParseMountInfo(t *testing.T) {
+	entries := parseMountInfo(strings.NewReader(testMountInfo))
+	if len(entries) != 9 {
+		t.Fatalf("parsed %d entries, want 9", len(entries))
+	}
+
+	want := map[int]mountEntry{
+		0: {Target: "/", FSType: "ext4", Options: []string{"rw", "relatime", "errors=remount-ro"}},
+		5: {Target: "/home/user/kagami/work/chroot/dev", FSType: "devtmpfs", Options: []string{"rw", "nosuid", "relatime", "size=8024296k"}},
+		8: {Target: "/home/user/My Builds", FSType: "tmpfs", Options: []string{"rw", "nosuid", "nodev", "size=1048576k"}},
+	}
+	for i, w := range want {
+		if !reflect.DeepEqual(entries[i], w) {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], w)
+		}
+	}
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	cases := map[string]string{
+		"/plain":               "/plain",
+		`/My\040Builds`:        "/My Builds",
+		`/tab\011and\134slash`: "/tab\tand\\slash",
+		`/trailing\04`:         `/trailing\04`,
+		`/not\999octal`:        `/not\999octal`,
+	}
+	for in, want := range cases {
+		if got := unescapeMountPath(in); got != want {
+			t.Errorf("unescapeMountPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMountsBelow(t *testing.T) {
+	var points []string
+	for _, entry := range parseMountInfo(strings.NewReader(testMountInfo)) {
+		points = append(points, entry.Target)
+	}
+
+	got := mountsBelow(points, "/home/user/kagami/work")
+	want := []string{
+		"/home/user/kagami/work/chroot/dev/pts",
+		"/home/user/kagami/work/chroot/proc",
+		"/home/user/kagami/work/chroot/dev",
+		"/home/user/kagami/work",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mountsBelow:\n got %q\nwant %q", got, want)
+	}
+
+	if got := mountsBelow(points, "/home/user/kagami/wo"); got != nil {
+		t.Errorf("prefix that is not a path component matched %q", got)
+	}
+}
+
+func TestContainingMount(t *testing.T) {
+	entries := parseMountInfo(strings.NewReader(testMountInfo))
+	cases := map[string]string{
+		"/":                                     "/",
+		"/usr/bin":                              "/",
+		"/home":                                 "/home",
+		"/homework":                             "/",
+		"/home/user/kagami/work/chroot/usr":     "/home/user/kagami/work",
+		"/home/user/kagami/work/chroot/devices": "/home/user/kagami/work",
+		"/home/user/My Builds/iso":              "/home/user/My Builds",
+	}
+	for path, want := range cases {
+		mnt, ok := containingMount(entries, path)
+		if !ok || mnt.Target != want {
+			t.Errorf("containingMount(%q) = %q, %v; want %q", path, mnt.Target, ok, want)
+		}
+	}
+
+	// The later of two mounts on the same point is the visible one.
+	stacked := append(entries, mountEntry{Target: "/home", FSType: "tmpfs"})
+	if mnt, _ := containingMount(stacked, "/home/user"); mnt.FSType != "tmpfs" {
+		t.Errorf("stacked mount resolved to %s", mnt.FSType)
+	}
+}
@@ -0,0 +1,320 @@
+package builder
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultDebianMirror   = "http://deb.debian.org/debian/"
+	defaultUbuntuMirror   = "http://archive.ubuntu.com/ubuntu/"
+	defaultDebianSecurity = "http://security.debian.org/debian-security"
+
+	chrootMirrorDir = "/mnt/kagami-mirror"
+	chrootReposDir  = "/mnt/kagami-repos"
+)
+
+type bindMount struct {
+	source string
+	target string
+}
+
+func (b *Builder) isOffline() bool {
+	return b.Config.Build.Offline
+}
+
+func (b *Builder) defaultMirror() string {
+	if b.isDebian() {
+		return defaultDebianMirror
+	}
+	return defaultUbuntuMirror
+}
+
+// archiveMirror is the configured mirror; buildMirror is the same archive at
+// the configured snapshot, if any.
+func (b *Builder) archiveMirror() string {
+	if b.Config.Repository.Mirror == "" {
+		return b.defaultMirror()
+	}
+	return withTrailingSlash(b.Config.Repository.Mirror)
+}
+
+func (b *Builder) buildMirror() string {
+	return b.snapshotOf(b.archiveMirror())
+}
+
+// chrootMirror is the mirror as seen from inside the chroot; file:// mirrors
+// are bind-mounted because the host path is not visible there.
+func (b *Builder) chrootMirror() string {
+	if isFileURI(b.buildMirror()) {
+		return "file://" + chrootMirrorDir + "/"
+	}
+	return b.buildMirror()
+}
+
+// imageMirror is the mirror written into the shipped image. Local mirrors are
+// unreachable from installed systems, so they fall back to the public archive.
+func (b *Builder) imageMirror() string {
+	if b.Config.Repository.ImageMirror != "" {
+		return withTrailingSlash(b.Config.Repository.ImageMirror)
+	}
+	if b.isOffline() || isFileURI(b.buildMirror()) {
+		return b.defaultMirror()
+	}
+	return b.archiveMirror()
+}
+
+func (b *Builder) buildSourceEntries() []sourceEntry {
+	return b.availableSourceEntries(b.chrootMirror())
+}
+
+// hostSourceEntries mirrors buildSourceEntries with URIs reachable from the
+// host, for index downloads performed outside the chroot.
+func (b *Builder) hostSourceEntries() []sourceEntry {
+	return b.availableSourceEntries(b.buildMirror())
+}
+
+func (b *Builder) availableSourceEntries(mirror string) []sourceEntry {
+	if !b.isOffline() {
+		return b.sourceEntries(mirror, b.securityMirror())
+	}
+
+	var available []sourceEntry
+	for _, e := range b.sourceEntries(mirror, mirror) {
+		if b.suiteAvailable(b.buildMirror(), e.Suite) {
+			available = append(available, e)
+		}
+	}
+	return available
+}
+
+func (b *Builder) imageSourceEntries() []sourceEntry {
+	return b.sourceEntries(b.imageMirror(), defaultDebianSecurity)
+}
+
+func (b *Builder) suiteAvailable(mirror, suite string) bool {
+	if b.suiteCache == nil {
+		b.suiteCache = make(map[string]bool)
+	}
+	key := mirror + "|" + suite
+	if ok, cached := b.suiteCache[key]; cached {
+		return ok
+	}
+
+	ok := false
+	for _, name := range []string{"InRelease", "Release"} {
+		if _, err := fetchURL(releaseURL(mirror, suite, name)); err == nil {
+			ok = true
+			break
+		}
+	}
+	b.suiteCache[key] = ok
+	return ok
+}
+
+// releaseURL locates a suite's Release file. A suite ending in a slash, such
+// as "./", names a flat repository whose Release sits in that directory
+// rather than under dists/.
+func releaseURL(mirror, suite, name string) string {
+	if strings.HasSuffix(suite, "/") {
+		dir := strings.TrimPrefix(strings.TrimPrefix(suite, "./"), "/")
+		return withTrailingSlash(mirror) + dir + name
+	}
+	return fmt.Sprintf("%sdists/%s/%s", withTrailingSlash(mirror), suite, name)
+}
+
+func (b *Builder) localRepoBinds() []bindMount {
+	var binds []bindMount
+
+	if isFileURI(b.buildMirror()) {
+		binds = append(binds, bindMount{fileURIPath(b.buildMirror()), filepath.Join(b.ChrootDir, chrootMirrorDir)})
+	}
+
+	for _, repo := range b.Config.Repository.AdditionalRepos {
+		if isFileURI(repo.URI) {
+			binds = append(binds, bindMount{fileURIPath(repo.URI), filepath.Join(b.ChrootDir, chrootReposDir, repo.Name)})
+		}
+	}
+
+	return binds
+}
+
+func (b *Builder) chrootRepoURI(name, uri string) string {
+	if isFileURI(uri) {
+		return "file://" + filepath.Join(chrootReposDir, name) + "/"
+	}
+	return uri
+}
+
+func (b *Builder) mountLocalRepos() error {
+	if b.usesNspawn() {
+		return nil
+	}
+
+	for _, m := range b.localRepoBinds() {
+		if err := b.mounts.bind(m.source, m.target, true); err != nil {
+			return fmt.Errorf("failed to bind local repository: %v", err)
+		}
+	}
+	return nil
+}
+
+func (b *Builder) unmountLocalRepos() {
+	for _, m := range b.localRepoBinds() {
+		b.mounts.unmount(m.target)
+		os.Remove(m.target)
+	}
+	os.Remove(filepath.Join(b.ChrootDir, chrootReposDir))
+}
+
+// finaliseImageSources replaces build-time sources with the ones an installed
+// system can reach, dropping package lists fetched from local mirrors.
+func (b *Builder) finaliseImageSources() error {
+	buildSources := renderSourcesList(b.buildSourceEntries(), !b.isOffline())
+	imageSources := renderSourcesList(b.imageSourceEntries(), true)
+
+	rewritten := false
+	for _, repo := range b.Config.Repository.AdditionalRepos {
+		listFile := "/etc/apt/sources.list.d/" + repo.Name + ".list"
+		switch {
+		case isFileURI(repo.URI):
+			b.removeFile(listFile)
+		case b.repoURI(repo) != repo.URI:
+			if err := b.writeFile(listFile, additionalRepoLine(repo, repo.URI), 0644); err != nil {
+				return err
+			}
+			rewritten = true
+		}
+	}
+
+	if buildSources == imageSources && !rewritten {
+		return nil
+	}
+
+	if buildSources != imageSources {
+		fmt.Printf("[INFO] Writing image APT sources for %s\n", b.imageMirror())
+		if err := b.writeFile("/etc/apt/sources.list", imageSources, 0644); err != nil {
+			return err
+		}
+	}
+
+	return b.chrootExec("rm -rf /var/lib/apt/lists/* && mkdir -p /var/lib/apt/lists/partial")
+}
+
+func (b *Builder) verifyOfflineArtifacts() error {
+	fmt.Println("[INFO] Verifying local availability of offline build artifacts...")
+
+	var problems []string
+
+	mirror := b.Config.Repository.Mirror
+	switch {
+	case mirror == "":
+		problems = append(problems, "repository.mirror must point at a local mirror (file:// or local HTTP)")
+	case !isLocalURI(mirror):
+		problems = append(problems, fmt.Sprintf("mirror %s is not local; offline builds require a file:// mirror or one on localhost or the local network", mirror))
+	case !b.suiteAvailable(b.buildMirror(), b.bootstrapRelease()):
+		problems = append(problems, fmt.Sprintf("no Release file for suite '%s' at %s", b.bootstrapRelease(), b.buildMirror()))
+	}
+
+	if len(problems) == 0 {
+		for _, e := range b.sourceEntries(b.buildMirror(), b.buildMirror()) {
+			if !b.suiteAvailable(b.buildMirror(), e.Suite) {
+				log.Printf("[INFO] Suite '%s' not present on local mirror; omitted from build sources", e.Suite)
+			}
+		}
+	}
+
+	for _, repo := range b.Config.Repository.AdditionalRepos {
+		if !isFileURI(repo.URI) {
+			problems = append(problems, fmt.Sprintf("additional repository '%s' must be a file:// repository in offline builds, not %s", repo.Name, repo.URI))
+		} else if !b.suiteAvailable(repo.URI, repo.Suite) {
+			problems = append(problems, fmt.Sprintf("additional repository '%s' has no Release file for suite '%s'", repo.Name, repo.Suite))
+		}
+		if strings.HasPrefix(repo.Key, "http://") || strings.HasPrefix(repo.Key, "https://") {
+			problems = append(problems, fmt.Sprintf("additional repository '%s' key must be inline or a local file, not %s", repo.Name, repo.Key))
+		}
+	}
+
+	if b.Config.Build.AssetsDir != "" {
+		if info, err := os.Stat(b.Config.Build.AssetsDir); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("assets directory %s is not accessible", b.Config.Build.AssetsDir))
+		}
+	}
+
+	if bin, efi := b.locateMemtest(); bin == "" && efi == "" {
+		log.Printf("[WARNING] No local Memtest86+ binaries found (assets directory or host memtest86+ package); memory test entries will be omitted")
+	}
+
+	if b.Config.Packages.EnableFlatpak {
+		log.Printf("[WARNING] Offline build: Flathub remote registration will be skipped")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("offline build requirements not met:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+
+	fmt.Println("[OK] All required artifacts are available locally")
+	return nil
+}
+
+func (b *Builder) bootstrapRelease() string {
+	if b.Config.Release == "devel" {
+		return "noble"
+	}
+	return b.Config.Release
+}
+
+func fetchURL(rawURL string) ([]byte, error) {
+	if isFileURI(rawURL) {
+		return os.ReadFile(fileURIPath(rawURL))
+	}
+	return exec.Command("wget", "-qO-", rawURL).Output()
+}
+
+func isFileURI(uri string) bool {
+	return strings.HasPrefix(uri, "file:")
+}
+
+func fileURIPath(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Path != "" {
+		return u.Path
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(uri, "file://"), "file:")
+}
+
+// isLocalURI reports whether a mirror is reachable without internet access:
+// a file:// path, or an HTTP host that is loopback, on a private network, or
+// a local name without a public domain.
+func isLocalURI(uri string) bool {
+	if isFileURI(uri) {
+		return true
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+	}
+	if host == "localhost" || !strings.Contains(host, ".") {
+		return true
+	}
+	for _, suffix := range []string{".localhost", ".local", ".lan", ".internal", ".home.arpa"} {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func withTrailingSlash(uri string) string {
+	return strings.TrimSuffix(uri, "/") + "/"
+}
@@ -0,0 +1,164 @@
+package builder
+
+import (
+	"fmt"
+	"strings"
+)
+
+var ubuntuDesktopPackages = map[string][]string{
+	"gnome": {
+		"vanilla-gnome-desktop",
+		"vanilla-gnome-default-settings",
+		"gnome-session",
+		"gnome-tweaks",
+		"gnome-shell-extension-manager",
+		"gnome-backgrounds",
+		"fonts-cantarell",
+		"adwaita-icon-theme",
+		"plymouth-themes",
+	},
+	"kde":  {"kde-plasma-desktop"},
+	"xfce": {"xfce4", "xfce4-goodies"},
+	"lxde": {"lxde"},
+	"lxqt": {"lxqt"},
+	"mate": {"mate-desktop-environment"},
+}
+
+var debianDesktopPackages = map[string][]string{
+	"gnome": {"task-gnome-desktop"},
+	"kde":   {"task-kde-desktop"},
+	"xfce":  {"task-xfce-desktop"},
+	"lxde":  {"task-lxde-desktop"},
+	"lxqt":  {"task-lxqt-desktop"},
+	"mate":  {"task-mate-desktop"},
+}
+
+var ubiquitySlideshows = map[string]string{
+	"ubuntu":      "ubiquity-slideshow-ubuntu",
+	"kubuntu":     "ubiquity-slideshow-kubuntu",
+	"xubuntu":     "ubiquity-slideshow-xubuntu",
+	"lubuntu":     "ubiquity-slideshow-lubuntu",
+	"ubuntu-mate": "ubiquity-slideshow-ubuntu-mate",
+}
+
+type packageGroup struct {
+	Name     string
+	Packages []string
+}
+
+func (b *Builder) basePackages() []string {
+	if b.isDebian() {
+		return []string{"systemd-sysv"}
+	}
+	return []string{"libterm-readline-gnu-perl", "systemd-sysv"}
+}
+
+// kernelMetapackages returns the configured kernels, the default kernel of
+// the distribution when none is configured. The first one boots by default.
+func (b *Builder) kernelMetapackages() []string {
+	if len(b.Config.Packages.Kernel) > 0 {
+		return b.Config.Packages.Kernel
+	}
+	if !b.isDebian() {
+		return []string{"linux-generic"}
+	}
+	if b.Config.System.Architecture == "arm64" {
+		return []string{"linux-image-arm64"}
+	}
+	return []string{"linux-image-amd64"}
+}
+
+func (b *Builder) kernelPackages() []string {
+	var pkgs []string
+	for _, kernelPkg := range b.kernelMetapackages() {
+		pkgs = append(pkgs, kernelPkg)
+		if strings.HasPrefix(kernelPkg, "linux-image-") {
+			pkgs = append(pkgs, strings.Replace(kernelPkg, "linux-image-", "linux-headers-", 1))
+		} else if strings.HasPrefix(kernelPkg, "linux-") {
+			pkgs = append(pkgs, "linux-headers-"+strings.TrimPrefix(kernelPkg, "linux-"))
+		}
+	}
+	return dedupe(pkgs)
+}
+
+func (b *Builder) desktopPackages() ([]string, error) {
+	if b.Config.Packages.Desktop == "none" {
+		return nil, nil
+	}
+
+	desktopPackages := ubuntuDesktopPackages
+	if b.isDebian() {
+		desktopPackages = debianDesktopPackages
+	}
+
+	pkgs, ok := desktopPackages[b.Config.Packages.Desktop]
+	if !ok {
+		return nil, fmt.Errorf("unsupported desktop environment identifier: %s", b.Config.Packages.Desktop)
+	}
+	return b.substituteSnaps("desktop", pkgs), nil
+}
+
+func (b *Builder) installerPackages() []string {
+	switch b.Config.Installer.Type {
+	case "calamares":
+		return b.substituteSnaps("installer", []string{"calamares"})
+	case "ubiquity":
+		if b.isDebian() && b.Config.Packages.Desktop != "none" {
+			return nil
+		}
+		pkgs := []string{
+			"ubiquity",
+			"ubiquity-casper",
+			"ubiquity-frontend-gtk",
+			"ubiquity-ubuntu-artwork",
+		}
+		if b.Config.Packages.Desktop == "none" {
+			if slideshow, ok := ubiquitySlideshows[b.Config.Installer.Slideshow]; ok {
+				pkgs = append(pkgs, slideshow)
+			}
+		}
+		return b.substituteSnaps("installer", pkgs)
+	}
+	return nil
+}
+
+func (b *Builder) flatpakPackages() []string {
+	pkgs := []string{"flatpak"}
+
+	switch b.Config.Packages.Desktop {
+	case "gnome":
+		pkgs = append(pkgs, "gnome-software-plugin-flatpak")
+	case "kde":
+		pkgs = append(pkgs, "plasma-discover-backend-flatpak")
+	}
+	return pkgs
+}
+
+// packageGroups lists every package set the build installs, in installation
+// order, so preflight checks see exactly what the install steps will request.
+func (b *Builder) packageGroups() ([]packageGroup, error) {
+	desktop, err := b.desktopPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []packageGroup{
+		{"base", b.basePackages()},
+		{"essential", b.Config.Packages.Essential},
+		{"kernel", b.kernelPackages()},
+		{"firmware", b.firmwarePackages()},
+		{"additional", b.Config.Packages.Additional},
+		{"desktop", desktop},
+		{"installer", b.installerPackages()},
+	}
+
+	if len(b.Config.Packages.LocalDebs) > 0 {
+		groups = append(groups, packageGroup{"local", b.localPackageNames()})
+	}
+
+	if b.Config.Packages.EnableFlatpak {
+		groups = append(groups, packageGroup{"flatpak", b.flatpakPackages()})
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,178 @@
+package builder
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"kagami/pkg/apt"
+	"kagami/pkg/config"
+)
+
+const aptPreferencesFile = "/etc/apt/preferences.d/kagami.pref"
+
+// parsePackageSpec splits an APT install specification into its name and
+// the optional version (name=version) or suite (name/suite) qualifier.
+func parsePackageSpec(spec string) (name, version, suite string) {
+	spec = strings.TrimSpace(spec)
+	if i := strings.Index(spec, "="); i >= 0 {
+		version = spec[i+1:]
+		spec = spec[:i]
+	} else if i := strings.Index(spec, "/"); i >= 0 {
+		suite = spec[i+1:]
+		spec = spec[:i]
+	}
+	return packageName(spec), version, suite
+}
+
+// checkPackageSpec verifies a version or suite qualifier against the index.
+// It returns an empty string when the spec is unqualified or satisfiable.
+func checkPackageSpec(idx *apt.Index, spec string) string {
+	name, version, suite := parsePackageSpec(spec)
+	if version == "" && suite == "" {
+		return ""
+	}
+
+	candidates := idx.Lookup(name)
+	if len(candidates) == 0 {
+		// Virtual packages cannot carry a version or suite.
+		return fmt.Sprintf("%s: a pinned package must be a real package, not one only provided by others", spec)
+	}
+
+	var available []string
+	for _, p := range candidates {
+		if version != "" && p.Version == version {
+			return ""
+		}
+		if suite != "" && p.Suite == suite {
+			return ""
+		}
+		if version != "" {
+			available = append(available, p.Version)
+		} else {
+			available = append(available, p.Suite)
+		}
+	}
+
+	if version != "" {
+		return fmt.Sprintf("%s: version %s is not in the indices (available: %s)", spec, version, strings.Join(dedupe(available), ", "))
+	}
+	return fmt.Sprintf("%s: not available from suite %s (available from: %s)", spec, suite, strings.Join(dedupe(available), ", "))
+}
+
+func isPackageGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[") || (strings.HasPrefix(name, "/") && strings.HasSuffix(name, "/"))
+}
+
+// releaseSelector returns the apt_preferences release expression; a bare
+// name is taken as the archive, the Suite field of the Release file.
+func releaseSelector(release string) string {
+	if strings.Contains(release, "=") {
+		return release
+	}
+	return "a=" + release
+}
+
+// checkAptPreferences reports preferences that match nothing in the indices.
+// Globs and regular expressions are only checked for the pin itself, and
+// release selectors other than a=/n= cannot be checked without Release files.
+func checkAptPreferences(idx *apt.Index, prefs []config.AptPreference) []string {
+	var problems []string
+
+	for i, pref := range prefs {
+		label := fmt.Sprintf("apt_preferences[%d]", i)
+
+		var matches func(p *apt.Package) bool
+		switch {
+		case pref.Origin != "":
+			matches = func(p *apt.Package) bool { return p.Origin == pref.Origin }
+		case pref.Release != "":
+			key, value, _ := strings.Cut(releaseSelector(pref.Release), "=")
+			switch key {
+			case "a":
+				matches = func(p *apt.Package) bool { return p.Archive == value }
+			case "n":
+				matches = func(p *apt.Package) bool { return p.Codename == value }
+			default:
+				continue
+			}
+		default:
+			matches = func(p *apt.Package) bool {
+				ok, _ := path.Match(pref.Version, p.Version)
+				return ok
+			}
+		}
+
+		for _, name := range pref.Packages {
+			if name == "*" || isPackageGlob(name) {
+				continue
+			}
+
+			candidates := idx.Lookup(name)
+			if len(candidates) == 0 {
+				problems = append(problems, fmt.Sprintf("%s: package %s is not in the indices", label, name))
+				continue
+			}
+
+			found := false
+			for _, p := range candidates {
+				if matches(p) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("%s: no version of %s matches %s%s", label, name, pinExpression(pref), releaseHint(pref, candidates)))
+			}
+		}
+	}
+
+	return problems
+}
+
+// releaseHint suggests the other selector when a release pin names the
+// codename as an archive or the other way round.
+func releaseHint(pref config.AptPreference, candidates []*apt.Package) string {
+	if pref.Release == "" || pref.Origin != "" {
+		return ""
+	}
+	key, value, _ := strings.Cut(releaseSelector(pref.Release), "=")
+	for _, p := range candidates {
+		if key == "a" && p.Codename == value {
+			return fmt.Sprintf(" (%s is a codename; use n=%s)", value, value)
+		}
+		if key == "n" && p.Archive == value {
+			return fmt.Sprintf(" (%s is an archive; use a=%s)", value, value)
+		}
+	}
+	return ""
+}
+
+func pinExpression(pref config.AptPreference) string {
+	switch {
+	case pref.Origin != "":
+		return fmt.Sprintf("origin %q", pref.Origin)
+	case pref.Release != "":
+		return "release " + releaseSelector(pref.Release)
+	default:
+		return "version " + pref.Version
+	}
+}
+
+func renderAptPreferences(prefs []config.AptPreference) string {
+	var stanzas []string
+	for _, pref := range prefs {
+		stanzas = append(stanzas, fmt.Sprintf("Explanation: Configured in kagami apt_preferences\nPackage: %s\nPin: %s\nPin-Priority: %d\n",
+			strings.Join(pref.Packages, " "), pinExpression(pref), pref.Priority))
+	}
+	return strings.Join(stanzas, "\n")
+}
+
+// writeAptPreferences installs the configured pins before the first package
+// installation. The file stays in the image so upgrades keep honouring it.
+func (b *Builder) writeAptPreferences() error {
+	if len(b.Config.AptPreferences) == 0 {
+		return nil
+	}
+	return b.writeFile(aptPreferencesFile, renderAptPreferences(b.Config.AptPreferences), 0644)
+}
@@ -0,0 +1,117 @@
+package builder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"kagami/pkg/apt"
+	"kagami/pkg/config"
+)
+
+func pinTestIndex() *apt.Index {
+	idx := apt.NewIndex()
+	idx.Add(
+		&apt.Package{Name: "mesa", Version: "24.0.5-1", Suite: "noble", Archive: "noble", Codename: "noble"},
+		&apt.Package{Name: "mesa", Version: "24.2.8-1", Suite: "noble-backports", Archive: "noble-backports", Codename: "noble-backports"},
+		&apt.Package{Name: "firefox", Version: "130.0", Origin: "packages.mozilla.org", Archive: "mozilla", Codename: "mozilla"},
+		&apt.Package{Name: "zsh", Version: "5.9-6", Suite: "stable", Archive: "stable", Codename: "bookworm"},
+		&apt.Package{Name: "default-mta", Provides: []string{"mail-transport-agent"}},
+	)
+	return idx
+}
+
+func TestParsePackageSpec(t *testing.T) {
+	cases := []struct {
+		spec, name, version, suite string
+	}{
+		{"mesa", "mesa", "", ""},
+		{" mesa=24.0.5-1 ", "mesa", "24.0.5-1", ""},
+		{"mesa/noble-backports", "mesa", "", "noble-backports"},
+		{"mesa:amd64=1:2.0", "mesa", "1:2.0", ""},
+	}
+	for _, c := range cases {
+		name, version, suite := parsePackageSpec(c.spec)
+		if name != c.name || version != c.version || suite != c.suite {
+			t.Errorf("parsePackageSpec(%q) = %q, %q, %q", c.spec, name, version, suite)
+		}
+	}
+}
+
+func TestCheckPackageSpec(t *testing.T) {
+	idx := pinTestIndex()
+	cases := []struct {
+		spec string
+		want string
+	}{
+		{"mesa", ""},
+		{"mesa=24.2.8-1", ""},
+		{"mesa/noble-backports", ""},
+		{"mesa=25.0", "version 25.0 is not in the indices (available: 24.0.5-1, 24.2.8-1)"},
+		{"mesa/noble-proposed", "not available from suite noble-proposed (available from: noble, noble-backports)"},
+		{"mail-transport-agent=1.0", "must be a real package"},
+	}
+	for _, c := range cases {
+		got := checkPackageSpec(idx, c.spec)
+		if (c.want == "") != (got == "") || !strings.Contains(got, c.want) {
+			t.Errorf("checkPackageSpec(%q) = %q, want %q", c.spec, got, c.want)
+		}
+	}
+}
+
+func TestCheckAptPreferences(t *testing.T) {
+	idx := pinTestIndex()
+	prefs := []config.AptPreference{
+		{Packages: []string{"mesa"}, Release: "noble-backports", Priority: 500},
+		{Packages: []string{"mesa"}, Release: "n=noble-backports", Priority: 500},
+		{Packages: []string{"firefox"}, Origin: "packages.mozilla.org", Priority: 1000},
+		{Packages: []string{"mesa"}, Version: "24.0*", Priority: 900},
+		{Packages: []string{"libreoffice*", "*"}, Version: "1.0", Priority: 100},
+		{Packages: []string{"mesa"}, Release: "o=Ubuntu", Priority: 100},
+		{Packages: []string{"zsh"}, Release: "bookworm", Priority: 100},
+		{Packages: []string{"zsh"}, Release: "n=stable", Priority: 100},
+		{Packages: []string{"firefox"}, Version: "131*", Priority: 100},
+		{Packages: []string{"missing"}, Release: "a=noble", Priority: 100},
+	}
+	want := []string{
+		"apt_preferences[6]: no version of zsh matches release a=bookworm (bookworm is a codename; use n=bookworm)",
+		"apt_preferences[7]: no version of zsh matches release n=stable (stable is an archive; use a=stable)",
+		"apt_preferences[8]: no version of firefox matches version 131*",
+		"apt_preferences[9]: package missing is not in the indices",
+	}
+	if got := checkAptPreferences(idx, prefs); !reflect.DeepEqual(got, want) {
+		t.Errorf("checkAptPreferences:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestRenderAptPreferences(t *testing.T) {
+	prefs := []config.AptPreference{
+		{Packages: []string{"mesa", "libgl1-mesa-dri"}, Release: "noble-backports", Priority: 500},
+		{Packages: []string{"mesa"}, Release: "n=noble-backports", Priority: 500},
+		{Packages: []string{"firefox"}, Origin: "packages.mozilla.org", Priority: 1000},
+		{Packages: []string{"thunderbird"}, Version: "*", Priority: -1},
+	}
+	want := `Explanation: Configured in kagami apt_preferences
+Package: mesa libgl1-mesa-dri
+Pin: release a=noble-backports
+Pin-Priority: 500
+
+Explanation: Configured in kagami apt_preferences
+Package: mesa
+Pin: release n=noble-backports
+Pin-Priority: 500
+
+Explanation: Configured in kagami apt_preferences
+Package: firefox
+Pin: origin "packages.mozilla.org"
+Pin-Priority: 1000
+
+Explanation: Configured in kagami apt_preferences
+Package: thunderbird
+Pin: version *
+Pin-Priority: -1
+`
+	if got := renderAptPreferences(prefs); got != want {
+		t.Errorf("renderAptPreferences:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,293 @@
+package builder
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Installed footprint of each desktop profile including the base system and
+// kernel, in MiB. Derived from manifests of previous builds.
+var desktopFootprintMB = map[string]int{
+	"none":  1500,
+	"lxde":  3500,
+	"lxqt":  4000,
+	"xfce":  4500,
+	"mate":  5000,
+	"gnome": 6500,
+	"kde":   7500,
+}
+
+const (
+	perPackageMB      = 30
+	flatpakMB         = 500
+	installerMB       = 400
+	isoOverheadMB     = 150
+	minMemoryMB       = 4096
+	lowAvailableMemMB = 2048
+)
+
+type spaceEstimate struct {
+	InstalledMB  int
+	PeakChrootMB int
+	SquashfsMB   int
+	ISOMB        int
+}
+
+func (b *Builder) estimateSpace() spaceEstimate {
+	installed, ok := desktopFootprintMB[b.Config.Packages.Desktop]
+	if !ok {
+		installed = desktopFootprintMB["gnome"]
+	}
+
+	installed += perPackageMB * (len(b.Config.Packages.Essential) + len(b.Config.Packages.Additional))
+	installed += installerMB
+	if b.Config.Packages.EnableFlatpak {
+		installed += flatpakMB
+	}
+
+	// Downloaded .debs stay in /var/cache/apt/archives until cleanup and add
+	// roughly 40% on top; xz squashfs compresses to about 40% of installed.
+	est := spaceEstimate{
+		InstalledMB:  installed,
+		PeakChrootMB: installed * 14 / 10,
+		SquashfsMB:   installed * 4 / 10,
+	}
+	est.ISOMB = est.SquashfsMB + isoOverheadMB
+	return est
+}
+
+type preflightReport struct {
+	Problems []string
+	Warnings []string
+}
+
+func (r *preflightReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *preflightReport) warn(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (b *Builder) runPreflight() *preflightReport {
+	report := &preflightReport{}
+	est := b.estimateSpace()
+
+	workDir := existingAncestor(b.WorkDir)
+	outputDir := existingAncestor(filepath.Dir(b.OutputISO))
+
+	workNeed := est.PeakChrootMB + est.SquashfsMB
+	outputNeed := est.ISOMB
+	if sameFilesystem(workDir, outputDir) {
+		workNeed += outputNeed
+		outputNeed = 0
+	}
+	workNeed = workNeed * 11 / 10
+
+	if free, err := freeSpaceMB(workDir); err == nil {
+		if free < workNeed {
+			report.problem("workspace filesystem at %s has %s free; this configuration needs about %s (chroot %s, squashfs %s)",
+				workDir, formatMB(free), formatMB(workNeed), formatMB(est.PeakChrootMB), formatMB(est.SquashfsMB))
+		}
+	} else {
+		report.warn("cannot determine free space at %s: %v", workDir, err)
+	}
+
+	if outputNeed > 0 {
+		if free, err := freeSpaceMB(outputDir); err == nil && free < outputNeed*11/10 {
+			report.problem("output filesystem at %s has %s free; the ISO needs about %s", outputDir, formatMB(free), formatMB(outputNeed))
+		}
+	}
+
+	b.checkWorkspaceMount(workDir, report)
+	checkMemory(report)
+
+	return report
+}
+
+func (b *Builder) checkWorkspaceMount(path string, report *preflightReport) {
+	mnt, ok := mountFor(path)
+	if !ok {
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(mnt.FSType, "nfs"), mnt.FSType == "cifs", mnt.FSType == "smb3", mnt.FSType == "fuse.sshfs":
+		report.problem("workspace is on a %s filesystem (%s); root squashing and missing device node, xattr and ownership support break chroot builds", mnt.FSType, mnt.Target)
+	case mnt.FSType == "tmpfs":
+		report.warn("workspace is on tmpfs (%s); the build will consume RAM instead of disk", mnt.Target)
+	}
+
+	for _, opt := range mnt.Options {
+		switch opt {
+		case "ro":
+			report.problem("workspace filesystem %s is mounted read-only", mnt.Target)
+		case "noexec":
+			report.problem("workspace filesystem %s is mounted noexec; binaries inside the chroot cannot run", mnt.Target)
+		case "nodev":
+			if !b.isRootless() {
+				report.problem("workspace filesystem %s is mounted nodev; device nodes created during bootstrap will not work", mnt.Target)
+			}
+		case "nosuid":
+			report.warn("workspace filesystem %s is mounted nosuid; setuid programs such as sudo will not work inside the chroot", mnt.Target)
+		}
+	}
+}
+
+func checkMemory(report *preflightReport) {
+	info, err := readMeminfo()
+	if err != nil {
+		report.warn("cannot read /proc/meminfo: %v", err)
+		return
+	}
+
+	// MemTotal excludes memory reserved by the kernel and firmware, so a
+	// 4 GiB host reports somewhat less; allow 10% for that.
+	if total := info["MemTotal"]; total > 0 && total < minMemoryMB*9/10 {
+		report.problem("host has %s of RAM; at least %s is required", formatMB(total), formatMB(minMemoryMB))
+	}
+	if avail, ok := info["MemAvailable"]; ok && avail < lowAvailableMemMB {
+		report.warn("only %s of memory is available; mksquashfs may be slow or fail", formatMB(avail))
+	}
+}
+
+// preflight runs every check that needs no chroot: host resources,
+// prerequisites and package availability. All of them run before the build
+// fails, so one run shows everything to fix.
+func (b *Builder) preflight() error {
+	checks := []func() error{b.checkHostResources, b.checkPrerequisites, b.verifyPackages}
+
+	var failures []string
+	for _, check := range checks {
+		if err := check(); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	switch len(failures) {
+	case 0:
+		return nil
+	case 1:
+		return errors.New(failures[0])
+	}
+	return fmt.Errorf("%d preflight checks failed:\n  - %s", len(failures), strings.Join(failures, "\n  - "))
+}
+
+// checkHostResources reports every resource problem found by runPreflight.
+func (b *Builder) checkHostResources() error {
+	est := b.estimateSpace()
+	fmt.Printf("[INFO] Estimated footprint: installed %s, peak chroot %s, squashfs %s, ISO %s\n",
+		formatMB(est.InstalledMB), formatMB(est.PeakChrootMB), formatMB(est.SquashfsMB), formatMB(est.ISOMB))
+
+	report := b.runPreflight()
+
+	for _, w := range report.Warnings {
+		fmt.Printf("[WARNING] %s\n", w)
+	}
+	for _, p := range report.Problems {
+		fmt.Printf("[ERROR] %s\n", p)
+	}
+
+	if len(report.Problems) == 0 {
+		fmt.Println("[OK] Host resources are sufficient for this build")
+		return nil
+	}
+
+	if b.Config.Build.SkipPreflight {
+		fmt.Printf("[WARNING] Continuing despite %d preflight problem(s) (--skip-preflight)\n", len(report.Problems))
+		return nil
+	}
+	return fmt.Errorf("%d preflight problem(s) found; fix them or re-run with --skip-preflight", len(report.Problems))
+}
+
+// mountFor returns the mountinfo entry of the filesystem containing path.
+func mountFor(path string) (mountEntry, bool) {
+	return containingMount(readMountInfo(), canonicalPath(path))
+}
+
+// containingMount picks the longest mount point that is a prefix of path.
+// A later entry for the same mount point wins, since it is mounted on top.
+func containingMount(entries []mountEntry, path string) (mountEntry, bool) {
+	var best mountEntry
+	found := false
+
+	for _, entry := range entries {
+		target := entry.Target
+		if target != "/" && path != target && !strings.HasPrefix(path, target+"/") {
+			continue
+		}
+		if found && len(target) < len(best.Target) {
+			continue
+		}
+		best = entry
+		found = true
+	}
+
+	return best, found
+}
+
+func readMeminfo() (map[string]int, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		info[strings.TrimSuffix(fields[0], ":")] = kb / 1024
+	}
+	return info, scanner.Err()
+}
+
+func freeSpaceMB(path string) (int, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int(st.Bavail * uint64(st.Bsize) / (1024 * 1024)), nil
+}
+
+func sameFilesystem(a, b string) bool {
+	var sa, sb syscall.Stat_t
+	if syscall.Stat(a, &sa) != nil || syscall.Stat(b, &sb) != nil {
+		return false
+	}
+	return sa.Dev == sb.Dev
+}
+
+func existingAncestor(path string) string {
+	path = filepath.Clean(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+func formatMB(mb int) string {
+	if mb >= 1024 {
+		return fmt.Sprintf("%.1f GiB", float64(mb)/1024)
+	}
+	return fmt.Sprintf("%d MiB", mb)
+}
@@ -0,0 +1,85 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kagami/pkg/proxy"
+)
+
+const chrootProxyConf = "/etc/apt/apt.conf.d/01kagami-proxy"
+
+func (b *Builder) startAptProxy() error {
+	cfg := b.Config.Repository.Proxy
+
+	if cfg.URL != "" {
+		b.proxyURL = strings.TrimSuffix(cfg.URL, "/") + "/"
+		fmt.Printf("[INFO] Using external APT proxy: %s\n", b.proxyURL)
+		return nil
+	}
+
+	if !cfg.Enabled {
+		return nil
+	}
+
+	cacheDir := cfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = DefaultProxyCacheDir(b.WorkDir)
+	}
+
+	srv := proxy.NewServer(cacheDir)
+	srv.OnLog = b.log
+
+	addr, err := srv.Start("127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to start caching APT proxy: %v", err)
+	}
+
+	b.proxyServer = srv
+	b.proxyURL = fmt.Sprintf("http://%s/", addr)
+	fmt.Printf("[INFO] Caching APT proxy listening on %s (cache: %s)\n", b.proxyURL, cacheDir)
+	return nil
+}
+
+// proxyConfigured reports whether the build goes through an APT proxy. It
+// holds before startAptProxy runs, so sources can be chosen up front.
+func (b *Builder) proxyConfigured() bool {
+	return b.Config.Repository.Proxy.URL != "" || b.Config.Repository.Proxy.Enabled
+}
+
+func (b *Builder) stopAptProxy() {
+	if b.proxyServer == nil {
+		return
+	}
+	b.proxyServer.Close()
+	b.proxyServer = nil
+}
+
+func (b *Builder) proxyEnv() []string {
+	env := os.Environ()
+	if b.proxyURL != "" {
+		env = append(env, "http_proxy="+b.proxyURL)
+	}
+	return env
+}
+
+func (b *Builder) writeChrootProxyConfig() error {
+	if b.proxyURL == "" {
+		return nil
+	}
+
+	content := fmt.Sprintf("Acquire::http::Proxy \"%s\";\n", b.proxyURL)
+	return b.writeFile(chrootProxyConf, content, 0644)
+}
+
+func (b *Builder) removeChrootProxyConfig() error {
+	return b.removeFile(chrootProxyConf)
+}
+
+// DefaultProxyCacheDir places the package cache beside the workspace so it
+// survives RemoveWorkspace and is shared by consecutive builds.
+func DefaultProxyCacheDir(workDir string) string {
+	return filepath.Join(filepath.Dir(filepath.Clean(workDir)), "kagami-apt-cache")
+}
@@ -0,0 +1,187 @@
+package builder
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// RemovalAudit records what remove_list and the following autoremove did.
+type RemovalAudit struct {
+	Requested   []string `json:"requested"`
+	NoOps       []string `json:"no_ops,omitempty"`
+	Purged      []string `json:"purged,omitempty"`
+	Autoremoved []string `json:"autoremoved,omitempty"`
+}
+
+// protectedPackages are the packages no removal may take with it.
+func (b *Builder) protectedPackages() (map[string]string, error) {
+	desktop, err := b.desktopPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	protected := make(map[string]string)
+	groups := []packageGroup{
+		{"base", b.basePackages()},
+		{"essential", b.Config.Packages.Essential},
+		{"kernel", b.kernelPackages()},
+		{"desktop", desktop},
+	}
+	for _, group := range groups {
+		for _, spec := range group.Packages {
+			if name := packageName(spec); name != "" {
+				protected[name] = group.Name
+			}
+		}
+	}
+	return protected, nil
+}
+
+// simulateRemoval runs an apt-get action with --simulate and returns the
+// packages it would remove or purge.
+func (b *Builder) simulateRemoval(action string, pkgs []string) ([]string, error) {
+	output, err := b.chrootExecOutput(fmt.Sprintf("LC_ALL=C apt-get %s --simulate -y %s", action, strings.Join(pkgs, " ")))
+	if err != nil {
+		return nil, fmt.Errorf("apt-get %s simulation failed: %v", action, err)
+	}
+	return parseSimulatedRemovals(output), nil
+}
+
+// parseSimulatedRemovals picks the Purg and Remv lines out of apt-get
+// --simulate output and returns the package names, sorted.
+func parseSimulatedRemovals(output string) []string {
+	var removed []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && (fields[0] == "Purg" || fields[0] == "Remv") {
+			removed = append(removed, packageName(fields[1]))
+		}
+	}
+	sort.Strings(removed)
+	return dedupe(removed)
+}
+
+func protectedHits(removed []string, protected map[string]string) []string {
+	var hits []string
+	for _, name := range removed {
+		if group, ok := protected[name]; ok {
+			hits = append(hits, fmt.Sprintf("%s (%s)", name, group))
+		}
+	}
+	return hits
+}
+
+func (b *Builder) installedNames() (map[string]bool, error) {
+	pkgs, err := b.installedPackages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read installed packages: %v", err)
+	}
+	installed := make(map[string]bool)
+	for _, p := range pkgs {
+		installed[p.Name] = true
+	}
+	return installed, nil
+}
+
+// markSelectedManual marks every installed package a group asked for as
+// manually installed, so autoremove only takes dependencies left behind.
+func (b *Builder) markSelectedManual(installed map[string]bool) error {
+	groups, err := b.packageGroups()
+	if err != nil {
+		return err
+	}
+
+	var manual []string
+	for _, group := range groups {
+		for _, spec := range group.Packages {
+			if name := packageName(spec); installed[name] {
+				manual = append(manual, name)
+			}
+		}
+	}
+	if len(manual) == 0 {
+		return nil
+	}
+	return b.chrootExec("apt-mark manual " + strings.Join(dedupe(manual), " ") + " >/dev/null")
+}
+
+// purgeRemoveList purges packages.remove_list and then autoremoves what they
+// leave behind. Both steps are simulated first; the build stops if either
+// would remove a base, essential, kernel or desktop package.
+func (b *Builder) purgeRemoveList() error {
+	protected, err := b.protectedPackages()
+	if err != nil {
+		return err
+	}
+
+	installed, err := b.installedNames()
+	if err != nil {
+		return err
+	}
+
+	audit := &RemovalAudit{Requested: b.Config.Packages.RemoveList}
+	b.removals = audit
+
+	var present []string
+	for _, spec := range b.Config.Packages.RemoveList {
+		if installed[packageName(spec)] {
+			present = append(present, spec)
+		} else {
+			audit.NoOps = append(audit.NoOps, spec)
+		}
+	}
+	if len(audit.NoOps) > 0 {
+		log.Printf("[WARNING] remove_list entries not installed (nothing to remove): %s", strings.Join(audit.NoOps, ", "))
+	}
+
+	if len(present) > 0 {
+		removed, err := b.simulateRemoval("purge", present)
+		if err != nil {
+			return err
+		}
+		if hits := protectedHits(removed, protected); len(hits) > 0 {
+			return fmt.Errorf("remove_list would remove protected packages: %s", strings.Join(hits, ", "))
+		}
+
+		fmt.Printf("[INFO] Purging %d package(s) for remove_list: %s\n", len(removed), strings.Join(removed, ", "))
+		if err := b.chrootExec("DEBIAN_FRONTEND=noninteractive apt-get purge -y " + strings.Join(present, " ")); err != nil {
+			return fmt.Errorf("remove_list purge failed: %v", err)
+		}
+		audit.Purged = removed
+
+		// The purge may have taken selected packages along as dependents,
+		// and apt-mark fails on packages that are not installed.
+		if installed, err = b.installedNames(); err != nil {
+			return err
+		}
+	}
+
+	if err := b.markSelectedManual(installed); err != nil {
+		return fmt.Errorf("failed to mark selected packages as manually installed: %v", err)
+	}
+
+	orphans, err := b.simulateRemoval("autoremove", nil)
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	if hits := protectedHits(orphans, protected); len(hits) > 0 {
+		return fmt.Errorf("autoremove would remove protected packages: %s", strings.Join(hits, ", "))
+	}
+
+	fmt.Printf("[INFO] Autoremoving %d package(s) no longer needed: %s\n", len(orphans), strings.Join(orphans, ", "))
+	if err := b.chrootExec("DEBIAN_FRONTEND=noninteractive apt-get autoremove --purge -y"); err != nil {
+		return fmt.Errorf("autoremove failed: %v", err)
+	}
+	audit.Autoremoved = orphans
+	return nil
+}
+
+// Removals returns the remove_list audit of the build, if it got that far.
+func (b *Builder) Removals() *RemovalAudit {
+	return b.removals
+}
@@ -0,0 +1,41 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSimulatedRemovals(t *testing.T) {
+	output := `NOTE: This is only a simulation!
+      apt-get needs root privileges for real execution.
+Reading package lists...
+Building dependency tree...
+The following packages will be REMOVED:
+  libreoffice-core* libreoffice-writer*
+0 upgraded, 0 newly installed, 3 to remove and 0 not upgraded.
+Purg libreoffice-writer [4:24.2.5-0ubuntu0.24.04.2]
+Purg libreoffice-core:amd64 [4:24.2.5-0ubuntu0.24.04.2]
+Remv thunderbird [2:1snap1-0ubuntu3]
+Purg libreoffice-writer [4:24.2.5-0ubuntu0.24.04.2]
+Inst firefox (130.0 packages.mozilla.org [amd64])
+Conf firefox (130.0 packages.mozilla.org [amd64])
+Remv
+`
+	want := []string{"libreoffice-core", "libreoffice-writer", "thunderbird"}
+	if got := parseSimulatedRemovals(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSimulatedRemovals = %q, want %q", got, want)
+	}
+
+	if got := parseSimulatedRemovals("0 upgraded, 0 newly installed, 0 to remove and 0 not upgraded.\n"); got != nil {
+		t.Errorf("nothing to remove parsed as %q", got)
+	}
+}
+
+func TestProtectedHits(t *testing.T) {
+	protected := map[string]string{"ubuntu-desktop": "desktop", "linux-generic": "kernel"}
+	got := protectedHits([]string{"gnome-shell", "linux-generic", "ubuntu-desktop"}, protected)
+	want := []string{"linux-generic (kernel)", "ubuntu-desktop (desktop)"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("protectedHits = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,90 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"kagami/pkg/config"
+)
+
+// BuildReport describes how an ISO was produced. It is written next to the
+// image as <name>.report.json.
+type BuildReport struct {
+	Tool         string             `json:"tool"`
+	Version      string             `json:"version"`
+	Distro       string             `json:"distro"`
+	Release      string             `json:"release"`
+	Architecture string             `json:"architecture"`
+	Desktop      string             `json:"desktop"`
+	Mirror       string             `json:"mirror"`
+	ImageMirror  string             `json:"image_mirror"`
+	Snapshot     string             `json:"snapshot,omitempty"`
+	Offline      bool               `json:"offline"`
+	Bootstrapper string             `json:"bootstrapper"`
+	Backend      string             `json:"backend"`
+	Lockfile     string             `json:"lockfile,omitempty"`
+	Locked       bool               `json:"locked"`
+	Packages     int                `json:"packages"`
+	Failed       []PackageFailure   `json:"failed_packages,omitempty"`
+	Removals     *RemovalAudit      `json:"removals,omitempty"`
+	Flatpaks     []string           `json:"flatpaks,omitempty"`
+	Snaps        []SnapSubstitution `json:"snap_substitutions,omitempty"`
+	SnapdLayers  []string           `json:"snapd_layers,omitempty"`
+	ISO          string             `json:"iso"`
+	Started      time.Time          `json:"started"`
+	Finished     time.Time          `json:"finished"`
+}
+
+// ReportPath returns where the build report of isoPath is written.
+func ReportPath(isoPath string) string {
+	return strings.TrimSuffix(isoPath, ".iso") + ".report.json"
+}
+
+func (b *Builder) reportPath() string {
+	return ReportPath(b.OutputISO)
+}
+
+func (b *Builder) writeBuildReport() error {
+	report := BuildReport{
+		Tool:         config.AppName,
+		Version:      config.Version,
+		Distro:       b.Config.Distro,
+		Release:      b.Config.Release,
+		Architecture: b.Config.System.Architecture,
+		Desktop:      b.Config.Packages.Desktop,
+		Mirror:       b.buildMirror(),
+		ImageMirror:  b.imageMirror(),
+		Snapshot:     b.snapshotTimestamp(),
+		Offline:      b.isOffline(),
+		Bootstrapper: b.bootstrapper().Name(),
+		Backend:      b.backend(),
+		Lockfile:     b.LockfilePath,
+		Locked:       b.Locked,
+		Failed:       b.InstallFailures(),
+		Removals:     b.Removals(),
+		Flatpaks:     b.Flatpaks(),
+		Snaps:        b.SnapSubstitutions(),
+		SnapdLayers:  b.SnapdLayers(),
+		ISO:          b.OutputISO,
+		Started:      b.started.UTC(),
+		Finished:     time.Now().UTC(),
+	}
+
+	if installed, err := b.installedPackages(); err == nil {
+		report.Packages = len(installed)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(b.reportPath(), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write build report: %v", err)
+	}
+
+	fmt.Printf("[OK] Build report written to %s\n", b.reportPath())
+	return nil
+}
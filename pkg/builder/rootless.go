@@ -0,0 +1,40 @@
+package builder
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"kagami/pkg/system"
+)
+
+func (b *Builder) isRootless() bool {
+	return system.IsRootless()
+}
+
+func (b *Builder) checkRootlessPrerequisites() error {
+	if b.usesNspawn() {
+		return fmt.Errorf("the nspawn backend cannot run inside a rootless user namespace; use the chroot backend")
+	}
+	return nil
+}
+
+// mountRootless mirrors mountFilesystems for a user namespace, where /dev and
+// /sys carry locked submounts that can only be bound recursively, sysfs
+// cannot be mounted without a network namespace, and /run gets a private
+// tmpfs rather than the host's.
+func (b *Builder) mountRootless() error {
+	for _, dir := range []string{"/dev", "/sys"} {
+		if err := b.mounts.rbind(dir, filepath.Join(b.ChrootDir, dir)); err != nil {
+			return err
+		}
+	}
+
+	if err := b.mounts.mount("tmpfs", "tmpfs", filepath.Join(b.ChrootDir, "run"), "mode=0755"); err != nil {
+		return err
+	}
+	if err := b.mounts.mount("proc", "proc", filepath.Join(b.ChrootDir, "proc")); err != nil {
+		return err
+	}
+
+	return b.mountLocalRepos()
+}
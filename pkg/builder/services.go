@@ -0,0 +1,142 @@
+package builder
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const policyRcD = "/usr/sbin/policy-rc.d"
+
+const systemctlShim = "/usr/local/sbin/systemctl"
+
+const policyRcDScript = `#!/bin/sh
+# Installed by kagami: no services may start inside the build chroot.
+exit 101
+`
+
+const startStopDaemonStub = `#!/bin/sh
+# Installed by kagami: start-stop-daemon is disabled inside the build chroot.
+echo "Warning: fake start-stop-daemon called, doing nothing." >&2
+exit 0
+`
+
+// The shim lets postinsts enable, mask and reload unit files while refusing
+// anything that would start a process.
+const systemctlShimScript = `#!/bin/sh
+# Installed by kagami: runtime systemctl verbs are disabled inside the build chroot.
+for arg in "$@"; do
+    case "$arg" in
+        -*) ;;
+        start|stop|restart|reload|try-restart|reload-or-restart|try-reload-or-restart|condrestart|force-reload|isolate|kill|default|rescue|emergency|halt|poweroff|reboot|kexec|suspend|hibernate)
+            echo "Warning: systemctl $arg suppressed inside the build chroot." >&2
+            exit 0
+            ;;
+        *) break ;;
+    esac
+done
+exec /usr/bin/systemctl "$@"
+`
+
+func (b *Builder) startStopDaemonPath() string {
+	for _, p := range []string{"/usr/sbin/start-stop-daemon", "/sbin/start-stop-daemon"} {
+		if _, err := b.chrootExecOutput("dpkg-query -S " + p); err == nil {
+			return p
+		}
+	}
+	return "/sbin/start-stop-daemon"
+}
+
+// serviceGuardDiversions lists the binaries diverted while building, each
+// replaced by a symlink or stub that never starts anything.
+func (b *Builder) serviceGuardDiversions() []string {
+	return []string{"/sbin/initctl", b.startStopDaemonPath()}
+}
+
+func (b *Builder) installServiceGuards() error {
+	fmt.Println("[INFO] Preventing services from starting inside the chroot...")
+
+	if err := b.writeFile(policyRcD, policyRcDScript, 0755); err != nil {
+		return err
+	}
+
+	if err := b.divertFile("/sbin/initctl", "/bin/true"); err != nil {
+		return err
+	}
+
+	ssd := b.startStopDaemonPath()
+	if err := b.divertFile(ssd, ""); err != nil {
+		return err
+	}
+	if err := b.writeFile(ssd, startStopDaemonStub, 0755); err != nil {
+		return err
+	}
+
+	return b.writeFile(systemctlShim, systemctlShimScript, 0755)
+}
+
+func (b *Builder) removeServiceGuards() error {
+	var errs []string
+
+	for _, p := range b.serviceGuardDiversions() {
+		if err := b.undivertFile(p); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", p, err))
+		}
+	}
+
+	for _, p := range []string{systemctlShim, policyRcD} {
+		if err := b.removeFile(p); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", p, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove service guards: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (b *Builder) serviceGuardLeftovers() []string {
+	leftovers := []string{policyRcD, systemctlShim}
+	for _, p := range b.serviceGuardDiversions() {
+		leftovers = append(leftovers, p+".distrib")
+	}
+	return leftovers
+}
+
+// verifySquashfsClean lists the finished image and fails if any build-time
+// service guard made it into the shipped filesystem.
+func (b *Builder) verifySquashfsClean(squashfsPath string) error {
+	if _, err := exec.LookPath("unsquashfs"); err != nil {
+		return fmt.Errorf("unsquashfs is required to verify the image contains no service guards: %v", err)
+	}
+
+	output, err := exec.Command("unsquashfs", "-lc", squashfsPath).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list squashfs contents: %v", err)
+	}
+
+	contents := make(map[string]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		contents[strings.TrimPrefix(line, "squashfs-root")] = true
+	}
+
+	var found []string
+	for _, p := range b.serviceGuardLeftovers() {
+		// /sbin may be a merged-/usr symlink, so check both spellings.
+		alt := "/usr" + p
+		if strings.HasPrefix(p, "/usr/") {
+			alt = strings.TrimPrefix(p, "/usr")
+		}
+		if contents[p] || contents[alt] {
+			found = append(found, p)
+		}
+	}
+
+	if len(found) > 0 {
+		return fmt.Errorf("build-time service guards leaked into the image: %s", strings.Join(found, ", "))
+	}
+
+	fmt.Println("[OK] Image contains no build-time service guards")
+	return nil
+}
@@ -0,0 +1,479 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"kagami/pkg/apt"
+)
+
+const (
+	SizeReportName = "kagami-size.json"
+	sizeReportDirs = 25
+	sizeDirDepth   = 3
+)
+
+type SizeReport struct {
+	Generated   time.Time       `json:"generated"`
+	TotalKB     int64           `json:"total_kb"`
+	SquashfsKB  int64           `json:"squashfs_kb"`
+	Packages    []PackageSize   `json:"packages"`
+	Directories []DirectorySize `json:"directories"`
+}
+
+// PackageSize is one installed package. Group is the package group that
+// pulled it in, and Chain the dependency path from that group's package to
+// this one; packages no group reaches come from the bootstrap.
+type PackageSize struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	InstalledKB int64    `json:"installed_kb"`
+	Group       string   `json:"group"`
+	Chain       []string `json:"chain,omitempty"`
+}
+
+type DirectorySize struct {
+	Path string `json:"path"`
+	KB   int64  `json:"kb"`
+}
+
+type statusPackage struct {
+	version  string
+	sizeKB   int64
+	requires []string
+}
+
+// readStatusSizes reads installed packages with their sizes and the
+// relations apt follows when installing: Depends, Pre-Depends and Recommends.
+// Virtual names are resolved to their installed providers.
+func (b *Builder) readStatusSizes() (map[string]*statusPackage, error) {
+	f, err := os.Open(filepath.Join(b.ChrootDir, "var", "lib", "dpkg", "status"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stanzas, err := apt.ParseStanzas(f)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgs := make(map[string]*statusPackage)
+	providers := make(map[string][]string)
+	for _, st := range stanzas {
+		if st["Status"] != "install ok installed" {
+			continue
+		}
+		name := st["Package"]
+		size, _ := strconv.ParseInt(st["Installed-Size"], 10, 64)
+		var requires []string
+		for _, field := range []string{"Pre-Depends", "Depends", "Recommends"} {
+			requires = append(requires, apt.RelationNames(st[field])...)
+		}
+		pkgs[name] = &statusPackage{version: st["Version"], sizeKB: size, requires: requires}
+		for _, prov := range apt.RelationNames(st["Provides"]) {
+			providers[prov] = append(providers[prov], name)
+		}
+	}
+
+	for _, p := range pkgs {
+		var resolved []string
+		for _, req := range p.requires {
+			if _, ok := pkgs[req]; ok {
+				resolved = append(resolved, req)
+			} else {
+				resolved = append(resolved, providers[req]...)
+			}
+		}
+		p.requires = dedupe(resolved)
+	}
+
+	return pkgs, nil
+}
+
+// attributePackages walks the dependency graph breadth first from each
+// group's packages in build order, so every package is credited to the first
+// group that reaches it along the shortest chain.
+func attributePackages(groups []packageGroup, pkgs map[string]*statusPackage) map[string]PackageSize {
+	attributed := make(map[string]PackageSize)
+
+	for _, group := range groups {
+		var queue []string
+		for _, spec := range group.Packages {
+			name := packageName(spec)
+			if _, ok := pkgs[name]; !ok {
+				continue
+			}
+			if _, done := attributed[name]; done {
+				continue
+			}
+			attributed[name] = PackageSize{Group: group.Name, Chain: []string{name}}
+			queue = append(queue, name)
+		}
+
+		for len(queue) > 0 {
+			name := queue[0]
+			queue = queue[1:]
+			chain := attributed[name].Chain
+			for _, dep := range pkgs[name].requires {
+				if _, done := attributed[dep]; done {
+					continue
+				}
+				attributed[dep] = PackageSize{Group: group.Name, Chain: append(append([]string{}, chain...), dep)}
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	return attributed
+}
+
+// largestDirectories runs du over the chroot and returns the largest
+// directories up to sizeDirDepth levels deep.
+func (b *Builder) largestDirectories() ([]DirectorySize, error) {
+	output, err := exec.Command("du", "-x", "-k", fmt.Sprintf("--max-depth=%d", sizeDirDepth), b.ChrootDir).Output()
+	if err != nil && len(output) == 0 {
+		return nil, err
+	}
+
+	var dirs []DirectorySize
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(b.ChrootDir, fields[1])
+		if err != nil || rel == "." {
+			continue
+		}
+		dirs = append(dirs, DirectorySize{Path: "/" + rel, KB: kb})
+	}
+
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].KB > dirs[j].KB })
+	if len(dirs) > sizeReportDirs {
+		dirs = dirs[:sizeReportDirs]
+	}
+	return dirs, nil
+}
+
+func (b *Builder) buildSizeReport(squashfsPath string) (*SizeReport, error) {
+	pkgs, err := b.readStatusSizes()
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := b.packageGroups()
+	if err != nil {
+		return nil, err
+	}
+	// The metapackage depends on the desktop and additional packages, so it
+	// goes last and is only credited with what no configured group reaches.
+	if b.Config.Packages.Metapackage {
+		groups = append(groups, packageGroup{"metapackage", []string{b.metapackageName()}})
+	}
+	attributed := attributePackages(groups, pkgs)
+
+	report := &SizeReport{Generated: time.Now().UTC()}
+	for name, p := range pkgs {
+		entry, ok := attributed[name]
+		if !ok {
+			entry = PackageSize{Group: "bootstrap"}
+		}
+		entry.Name = name
+		entry.Version = p.version
+		entry.InstalledKB = p.sizeKB
+		report.Packages = append(report.Packages, entry)
+		report.TotalKB += p.sizeKB
+	}
+	sort.Slice(report.Packages, func(i, j int) bool {
+		if report.Packages[i].InstalledKB != report.Packages[j].InstalledKB {
+			return report.Packages[i].InstalledKB > report.Packages[j].InstalledKB
+		}
+		return report.Packages[i].Name < report.Packages[j].Name
+	})
+
+	if info, err := os.Stat(squashfsPath); err == nil {
+		report.SquashfsKB = info.Size() / 1024
+	}
+
+	report.Directories, err = b.largestDirectories()
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure directories: %v", err)
+	}
+
+	return report, nil
+}
+
+// SizeReportPath returns where the size report of isoPath is kept next to
+// it, so the report outlives the workspace.
+func SizeReportPath(isoPath string) string {
+	return strings.TrimSuffix(isoPath, ".iso") + ".size.json"
+}
+
+// previousSizeReport finds the last build's report in the workspace, or next
+// to its ISO at the output path or where the ISO was relocated to.
+func (b *Builder) previousSizeReport() (*SizeReport, error) {
+	var err error
+	for _, target := range []string{b.WorkDir, b.RelocatedISO, b.OutputISO} {
+		if target == "" {
+			continue
+		}
+		var report *SizeReport
+		if report, err = LoadSizeReport(target); err == nil {
+			return report, nil
+		}
+	}
+	return nil, err
+}
+
+// writeSizeReport records the size report in the workspace, on the ISO and
+// next to it, and prints how it differs from the previous build's report.
+func (b *Builder) writeSizeReport(squashfsPath string) error {
+	report, err := b.buildSizeReport(squashfsPath)
+	if err != nil {
+		return err
+	}
+
+	previous, prevErr := b.previousSizeReport()
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	paths := []string{
+		filepath.Join(b.WorkDir, SizeReportName),
+		filepath.Join(b.ImageDir, SizeReportName),
+		SizeReportPath(b.OutputISO),
+	}
+	for _, path := range paths {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	b.log(report.Format(10))
+	if prevErr == nil {
+		b.log(CompareSizeReports(previous, report).Format(10))
+	}
+	return nil
+}
+
+// LoadSizeReport reads a size report from a workspace, an ISO or a report
+// file. For an ISO the report kept next to it is preferred over extracting
+// the copy inside.
+func LoadSizeReport(target string) (*SizeReport, error) {
+	if strings.HasSuffix(target, ".iso") {
+		if _, err := os.Stat(SizeReportPath(target)); err == nil {
+			target = SizeReportPath(target)
+		}
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+
+	path := target
+	switch {
+	case info.IsDir():
+		path = filepath.Join(target, SizeReportName)
+	case strings.HasSuffix(target, ".iso"):
+		tmp, err := os.CreateTemp("", "kagami-size-*.json")
+		if err != nil {
+			return nil, err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		cmd := exec.Command("xorriso", "-osirrox", "on", "-indev", target, "-extract", "/"+SizeReportName, tmp.Name())
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("%s carries no size report: %v\n%s", target, err, string(output))
+		}
+		path = tmp.Name()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var report SizeReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("invalid size report %s: %v", path, err)
+	}
+	return &report, nil
+}
+
+func formatKB(kb int64) string {
+	kb = abs64(kb)
+	switch {
+	case kb >= 1024*1024:
+		return fmt.Sprintf("%.1f GiB", float64(kb)/(1024*1024))
+	case kb >= 1024:
+		return fmt.Sprintf("%.1f MiB", float64(kb)/1024)
+	}
+	return fmt.Sprintf("%d KiB", kb)
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func signedKB(kb int64) string {
+	if kb < 0 {
+		return "-" + formatKB(kb)
+	}
+	return "+" + formatKB(kb)
+}
+
+// Format renders the largest packages and directories and the installed
+// size per group.
+func (r *SizeReport) Format(top int) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "[INFO] Installed size: %s in %d packages", formatKB(r.TotalKB), len(r.Packages))
+	if r.SquashfsKB > 0 {
+		fmt.Fprintf(&sb, " (squashfs %s)", formatKB(r.SquashfsKB))
+	}
+	sb.WriteString("\n")
+
+	groupKB := make(map[string]int64)
+	var groups []string
+	for _, p := range r.Packages {
+		if _, ok := groupKB[p.Group]; !ok {
+			groups = append(groups, p.Group)
+		}
+		groupKB[p.Group] += p.InstalledKB
+	}
+	sort.Slice(groups, func(i, j int) bool { return groupKB[groups[i]] > groupKB[groups[j]] })
+
+	sb.WriteString("\n  By group:\n")
+	for _, g := range groups {
+		fmt.Fprintf(&sb, "    %-14s %10s\n", g, formatKB(groupKB[g]))
+	}
+
+	fmt.Fprintf(&sb, "\n  Largest packages:\n")
+	for i, p := range r.Packages {
+		if i == top {
+			break
+		}
+		fmt.Fprintf(&sb, "    %10s  %-36s %s\n", formatKB(p.InstalledKB), p.Name, p.reason())
+	}
+
+	if len(r.Directories) > 0 {
+		fmt.Fprintf(&sb, "\n  Largest directories:\n")
+		for i, d := range r.Directories {
+			if i == top {
+				break
+			}
+			fmt.Fprintf(&sb, "    %10s  %s\n", formatKB(d.KB), d.Path)
+		}
+	}
+
+	return sb.String()
+}
+
+func (p PackageSize) reason() string {
+	if len(p.Chain) <= 1 {
+		return p.Group
+	}
+	return p.Group + ": " + strings.Join(p.Chain, " -> ")
+}
+
+const (
+	deltaAdded   = "added"
+	deltaRemoved = "removed"
+	deltaResized = "resized"
+)
+
+type PackageDelta struct {
+	Name   string `json:"name"`
+	Change string `json:"change"`
+	FromKB int64  `json:"from_kb"`
+	ToKB   int64  `json:"to_kb"`
+	Reason string `json:"reason"`
+}
+
+type SizeDiff struct {
+	TotalDeltaKB    int64          `json:"total_delta_kb"`
+	SquashfsDeltaKB int64          `json:"squashfs_delta_kb"`
+	Changes         []PackageDelta `json:"changes"`
+}
+
+// CompareSizeReports lists every package added, removed or resized between
+// two reports, largest change first.
+func CompareSizeReports(old, current *SizeReport) SizeDiff {
+	diff := SizeDiff{
+		TotalDeltaKB: current.TotalKB - old.TotalKB,
+	}
+	if old.SquashfsKB > 0 && current.SquashfsKB > 0 {
+		diff.SquashfsDeltaKB = current.SquashfsKB - old.SquashfsKB
+	}
+
+	before := make(map[string]PackageSize)
+	for _, p := range old.Packages {
+		before[p.Name] = p
+	}
+
+	for _, p := range current.Packages {
+		prev, existed := before[p.Name]
+		delete(before, p.Name)
+		switch {
+		case !existed:
+			diff.Changes = append(diff.Changes, PackageDelta{Name: p.Name, Change: deltaAdded, ToKB: p.InstalledKB, Reason: p.reason()})
+		case prev.InstalledKB != p.InstalledKB:
+			diff.Changes = append(diff.Changes, PackageDelta{Name: p.Name, Change: deltaResized, FromKB: prev.InstalledKB, ToKB: p.InstalledKB, Reason: p.reason()})
+		}
+	}
+	for _, p := range before {
+		diff.Changes = append(diff.Changes, PackageDelta{Name: p.Name, Change: deltaRemoved, FromKB: p.InstalledKB, Reason: p.reason()})
+	}
+
+	sort.Slice(diff.Changes, func(i, j int) bool {
+		di := abs64(diff.Changes[i].ToKB - diff.Changes[i].FromKB)
+		dj := abs64(diff.Changes[j].ToKB - diff.Changes[j].FromKB)
+		if di != dj {
+			return di > dj
+		}
+		return diff.Changes[i].Name < diff.Changes[j].Name
+	})
+	return diff
+}
+
+func (d SizeDiff) Format(top int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\n[INFO] Compared with the previous build: installed size %s", signedKB(d.TotalDeltaKB))
+	if d.SquashfsDeltaKB != 0 {
+		fmt.Fprintf(&sb, ", squashfs %s", signedKB(d.SquashfsDeltaKB))
+	}
+	fmt.Fprintf(&sb, ", %d package(s) changed\n", len(d.Changes))
+
+	for i, c := range d.Changes {
+		if i == top {
+			break
+		}
+		switch c.Change {
+		case deltaAdded:
+			fmt.Fprintf(&sb, "    + %-36s %10s  %s\n", c.Name, signedKB(c.ToKB), c.Reason)
+		case deltaRemoved:
+			fmt.Fprintf(&sb, "    - %-36s %10s\n", c.Name, signedKB(-c.FromKB))
+		default:
+			fmt.Fprintf(&sb, "    ~ %-36s %10s\n", c.Name, signedKB(c.ToKB-c.FromKB))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,257 @@
+package builder
+
+import (
+	"fmt"
+	"strings"
+
+	"kagami/pkg/config"
+)
+
+const (
+	snapdLayersRecord  = "/etc/kagami/snapd-layers"
+	snapdUnblockScript = "/usr/local/sbin/kagami-snapd-unblock"
+)
+
+var snapdPackages = []string{"snapd", "snap-confine", "ubuntu-core-launcher", "snapd-xdg-open"}
+
+const snapdPreferences = `Explanation: Snapd package installation is permanently prohibited on this system.
+Package: snapd
+Pin: release *
+Pin-Priority: -1
+
+Package: snapd:*
+Pin: release *
+Pin-Priority: -1
+
+Package: snap-confine
+Pin: release *
+Pin-Priority: -1
+
+Package: ubuntu-core-launcher
+Pin: release *
+Pin-Priority: -1
+
+Package: snapd-xdg-open
+Pin: release *
+Pin-Priority: -1
+`
+
+const snapdServiceOverride = `[Unit]
+ConditionPathExists=!/etc/snapd-blocked
+
+[Service]
+ExecStart=
+ExecStart=/bin/false
+`
+
+const snapdSocketOverride = `[Unit]
+ConditionPathExists=!/etc/snapd-blocked
+
+[Socket]
+ListenStream=
+`
+
+const snapdAptHook = `DPkg::Pre-Install-Pkgs {
+  "/usr/local/bin/block-snapd-hook";
+};
+`
+
+const snapdHookScript = `#!/bin/sh
+while read pkg; do
+    case "$pkg" in
+        *snapd*)
+            echo "Installation of snapd is permanently prohibited on this system." >&2
+            exit 1
+            ;;
+    esac
+done
+`
+
+const snapdMotd = `#!/bin/sh
+echo ""
+echo "-----------------------------------------------------------"
+echo "  NOTICE: Snapd is permanently suppressed on this system.  "
+echo "  Snap package installation is not permitted.              "
+echo "-----------------------------------------------------------"
+echo ""
+`
+
+const snapdProfile = `export SNAPD_BLOCKED=1
+snap() {
+    echo "Snapd is permanently suppressed on this system." >&2
+    return 1
+}
+`
+
+const snapdUnblockContent = `#!/bin/sh
+# Reverses the snapd suppression layers recorded in /etc/kagami/snapd-layers.
+set -e
+record=/etc/kagami/snapd-layers
+
+if [ "$(id -u)" -ne 0 ]; then
+    echo "kagami-snapd-unblock must be run as root." >&2
+    exit 1
+fi
+
+if [ ! -f "$record" ]; then
+    echo "No snapd suppression layers are recorded on this system."
+    exit 0
+fi
+
+while read -r layer; do
+    case "$layer" in
+        pinning)
+            rm -f /etc/apt/preferences.d/nosnapd.pref
+            ;;
+        service-masks)
+            rm -f /etc/systemd/system/snapd.service.d/override.conf /etc/systemd/system/snapd.socket.d/override.conf
+            rmdir /etc/systemd/system/snapd.service.d /etc/systemd/system/snapd.socket.d 2>/dev/null || true
+            ;;
+        apt-hook)
+            rm -f /etc/apt/apt.conf.d/99-block-snapd /usr/local/bin/block-snapd-hook
+            ;;
+        diversion)
+            rm -f /usr/bin/snap
+            dpkg-divert --local --rename --remove /usr/bin/snap
+            ;;
+        profile)
+            rm -f /etc/profile.d/block-snapd.sh
+            echo "Open a new login shell to drop the snap shell function."
+            ;;
+        motd)
+            rm -f /etc/update-motd.d/99-snapd-blocked
+            ;;
+        marker)
+            rm -f /etc/snapd-blocked
+            ;;
+        "")
+            continue
+            ;;
+        *)
+            echo "Skipping unknown layer: $layer" >&2
+            continue
+            ;;
+    esac
+    echo "Removed snapd suppression layer: $layer"
+done < "$record"
+
+rm -f "$record"
+systemctl daemon-reload 2>/dev/null || true
+echo "Snapd is no longer blocked. Install it with: apt install snapd"
+`
+
+// snapdLayers returns the selected suppression layers in application order.
+func (b *Builder) snapdLayers() []string {
+	if len(b.Config.Security.SnapdLayers) == 0 {
+		return config.SnapdLayers
+	}
+
+	selected := make(map[string]bool)
+	for _, layer := range b.Config.Security.SnapdLayers {
+		selected[layer] = true
+	}
+
+	var layers []string
+	for _, layer := range config.SnapdLayers {
+		if selected[layer] {
+			layers = append(layers, layer)
+		}
+	}
+	return layers
+}
+
+func (b *Builder) applySnapdLayer(layer string) error {
+	switch layer {
+	case "pinning":
+		return b.writeFile("/etc/apt/preferences.d/nosnapd.pref", snapdPreferences, 0644)
+	case "service-masks":
+		return b.writeFiles([]chrootFile{
+			{"/etc/systemd/system/snapd.service.d/override.conf", snapdServiceOverride, 0644},
+			{"/etc/systemd/system/snapd.socket.d/override.conf", snapdSocketOverride, 0644},
+		})
+	case "apt-hook":
+		return b.writeFiles([]chrootFile{
+			{"/etc/apt/apt.conf.d/99-block-snapd", snapdAptHook, 0644},
+			{"/usr/local/bin/block-snapd-hook", snapdHookScript, 0755},
+		})
+	case "diversion":
+		return b.divertFile("/usr/bin/snap", "/bin/false")
+	case "profile":
+		return b.writeFile("/etc/profile.d/block-snapd.sh", snapdProfile, 0755)
+	case "motd":
+		return b.writeFile("/etc/update-motd.d/99-snapd-blocked", snapdMotd, 0755)
+	case "marker":
+		return b.writeFile("/etc/snapd-blocked", "Snapd is permanently suppressed on this system.\n", 0644)
+	}
+	return fmt.Errorf("unknown snapd suppression layer '%s'", layer)
+}
+
+// purgeSnapd removes whatever snapd packages the bootstrap installed along
+// with their state.
+func (b *Builder) purgeSnapd() error {
+	installed, err := b.installedPackages()
+	if err != nil {
+		return fmt.Errorf("failed to read installed packages: %v", err)
+	}
+
+	present := make(map[string]bool)
+	for _, p := range installed {
+		present[p.Name] = true
+	}
+
+	var purge []string
+	for _, pkg := range snapdPackages {
+		if present[pkg] {
+			purge = append(purge, pkg)
+		}
+	}
+	if len(purge) > 0 {
+		if err := b.chrootExec("DEBIAN_FRONTEND=noninteractive apt-get purge -y --autoremove " + strings.Join(purge, " ")); err != nil {
+			return err
+		}
+	}
+
+	return b.chrootExec("rm -rf /var/cache/snapd /var/lib/snapd /var/snap /snap ~/snap")
+}
+
+func (b *Builder) blockSnapd() error {
+	if !b.snapdBlocked() {
+		return nil
+	}
+
+	layers := b.snapdLayers()
+	fmt.Printf("[INFO] Applying snapd suppression layers: %s\n", strings.Join(layers, ", "))
+
+	if err := b.purgeSnapd(); err != nil {
+		return fmt.Errorf("failed to purge snapd: %v", err)
+	}
+
+	if err := b.writeSnapdLayers(layers); err != nil {
+		return err
+	}
+
+	fmt.Printf("[OK] Snapd suppression applied (%d of %d layers); %s reverses it\n", len(layers), len(config.SnapdLayers), snapdUnblockScript)
+	return nil
+}
+
+// writeSnapdLayers applies the layers and records them for the unblock
+// script.
+func (b *Builder) writeSnapdLayers(layers []string) error {
+	for _, layer := range layers {
+		if err := b.applySnapdLayer(layer); err != nil {
+			return fmt.Errorf("snapd suppression layer %s failed: %v", layer, err)
+		}
+		b.snapdApplied = append(b.snapdApplied, layer)
+	}
+
+	files := []chrootFile{
+		{snapdLayersRecord, strings.Join(layers, "\n") + "\n", 0644},
+		{snapdUnblockScript, snapdUnblockContent, 0755},
+	}
+	return b.writeFiles(files)
+}
+
+// SnapdLayers returns the snapd suppression layers applied to the image.
+func (b *Builder) SnapdLayers() []string {
+	return append([]string(nil), b.snapdApplied...)
+}
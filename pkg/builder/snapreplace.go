@@ -0,0 +1,330 @@
+package builder
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"kagami/pkg/apt"
+	"kagami/pkg/config"
+)
+
+// SnapSubstitution records a snap transitional package that was replaced.
+type SnapSubstitution struct {
+	Package string `json:"package"`
+	Group   string `json:"group"`
+	Via     string `json:"via,omitempty"`
+	Deb     string `json:"deb,omitempty"`
+	Repo    string `json:"repo,omitempty"`
+	Flatpak string `json:"flatpak,omitempty"`
+}
+
+func (s SnapSubstitution) String() string {
+	var str string
+	switch {
+	case s.Flatpak != "":
+		str = fmt.Sprintf("%s -> Flatpak %s", s.Package, s.Flatpak)
+	case s.Repo != "":
+		str = fmt.Sprintf("%s -> deb %s from %s", s.Package, s.Deb, s.Repo)
+	default:
+		str = fmt.Sprintf("%s -> deb %s", s.Package, s.Deb)
+	}
+	if s.Via != "" {
+		str += fmt.Sprintf(" (pulled in by %s package %s)", s.Group, s.Via)
+	}
+	return str
+}
+
+var snapReplacementRepos = map[string]config.AdditionalRepo{
+	"mozilla": {
+		Name:       "mozilla",
+		URI:        "https://packages.mozilla.org/apt",
+		Suite:      "mozilla",
+		Components: []string{"main"},
+		Key:        "https://packages.mozilla.org/apt/repo-signing-key.gpg",
+	},
+}
+
+var (
+	firefoxDeb         = config.SnapReplacement{Deb: "firefox", Repo: "mozilla"}
+	chromiumFlatpak    = config.SnapReplacement{Flatpak: "org.chromium.Chromium"}
+	thunderbirdFlatpak = config.SnapReplacement{Flatpak: "org.mozilla.Thunderbird"}
+)
+
+// snapReplacements lists, per Ubuntu release, the packages that only install
+// a snap and what replaces them when snapd is blocked.
+var snapReplacements = map[string]map[string]config.SnapReplacement{
+	"focal": {
+		"chromium-browser": chromiumFlatpak,
+	},
+	"jammy": {
+		"firefox":          firefoxDeb,
+		"chromium-browser": chromiumFlatpak,
+	},
+	"noble": {
+		"firefox":          firefoxDeb,
+		"thunderbird":      thunderbirdFlatpak,
+		"chromium-browser": chromiumFlatpak,
+	},
+	"resolute": {
+		"firefox":          firefoxDeb,
+		"thunderbird":      thunderbirdFlatpak,
+		"chromium-browser": chromiumFlatpak,
+	},
+	"devel": {
+		"firefox":          firefoxDeb,
+		"thunderbird":      thunderbirdFlatpak,
+		"chromium-browser": chromiumFlatpak,
+	},
+}
+
+func (b *Builder) snapdBlocked() bool {
+	return b.Config.Security.BlockSnapdForever || b.Config.System.BlockSnapd
+}
+
+// snapReplacementTable merges packages.snap_replacements over the table of
+// the target release.
+func (b *Builder) snapReplacementTable() map[string]config.SnapReplacement {
+	table := make(map[string]config.SnapReplacement)
+	for pkg, r := range snapReplacements[b.Config.Release] {
+		table[pkg] = r
+	}
+	for pkg, r := range b.Config.Packages.SnapReplacements {
+		table[pkg] = r
+	}
+	return table
+}
+
+// snapReplacementRepo returns the repository providing a replacement deb,
+// adding a built-in one to the configuration when needed.
+func (b *Builder) snapReplacementRepo(name string) (config.AdditionalRepo, error) {
+	for _, repo := range b.Config.Repository.AdditionalRepos {
+		if repo.Name == name {
+			return repo, nil
+		}
+	}
+
+	repo, ok := snapReplacementRepos[name]
+	if !ok {
+		return config.AdditionalRepo{}, fmt.Errorf("snap replacement repository '%s' is neither in repository.additional_repos nor built in", name)
+	}
+	if b.isOffline() {
+		return config.AdditionalRepo{}, fmt.Errorf("snap replacement repository '%s' is not available offline; add a local copy to repository.additional_repos", name)
+	}
+	b.Config.Repository.AdditionalRepos = append(b.Config.Repository.AdditionalRepos, repo)
+	// A cached index predates the new source.
+	b.packageIndex = nil
+	return repo, nil
+}
+
+// applySnapReplacements keeps snap transitional packages from reaching apt
+// while snapd is blocked. Entries of the table are replaced wherever they are
+// listed or, outside dry runs, wherever apt would pull them in through the
+// dependencies and recommends of the essential, additional, desktop and
+// installer packages. The replaced package is pinned to -1, which keeps
+// recommends and later upgrades from pulling it back in.
+func (b *Builder) applySnapReplacements() error {
+	if b.snapResolved || b.isDebian() || !b.snapdBlocked() {
+		return nil
+	}
+	b.snapResolved = true
+
+	table := b.snapReplacementTable()
+	desktop, err := b.desktopPackages()
+	if err != nil {
+		return err
+	}
+	groups := []packageGroup{
+		{"essential", b.Config.Packages.Essential},
+		{"additional", b.Config.Packages.Additional},
+		{"desktop", desktop},
+		{"installer", b.installerPackages()},
+	}
+
+	pinned := make(map[string]bool)
+	for _, group := range groups {
+		for _, spec := range group.Packages {
+			name := packageName(spec)
+			if err := b.replaceSnap(table, name, group.Name, "", pinned); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !b.DryRun {
+		for _, dep := range b.snapDependents(table, groups) {
+			if err := b.replaceSnap(table, dep.Package, dep.Group, dep.Via, pinned); err != nil {
+				return err
+			}
+		}
+	}
+
+	b.Config.Packages.Essential = b.substituteSnaps("essential", b.Config.Packages.Essential)
+	b.Config.Packages.Additional = b.substituteSnaps("additional", b.Config.Packages.Additional)
+
+	var unused []string
+	for pkg := range b.Config.Packages.SnapReplacements {
+		if _, ok := snapReplacements[b.Config.Release][pkg]; !ok && !b.substituted(pkg) {
+			unused = append(unused, pkg)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		log.Printf("[WARNING] packages.snap_replacements entries no package group installs: %s", strings.Join(unused, ", "))
+	}
+	return nil
+}
+
+// replaceSnap records the replacement of name, pulled in by the group
+// directly or through via, when the table has an entry for it.
+func (b *Builder) replaceSnap(table map[string]config.SnapReplacement, name, group, via string, pinned map[string]bool) error {
+	r, ok := table[name]
+	if !ok || (r.Deb == "" && r.Flatpak == "") || b.substituted(name) {
+		return nil
+	}
+
+	pin := func(pref config.AptPreference) {
+		key := fmt.Sprintf("%v %s %s %d", pref.Packages, pref.Origin, pref.Version, pref.Priority)
+		if !pinned[key] {
+			pinned[key] = true
+			b.Config.AptPreferences = append(b.Config.AptPreferences, pref)
+		}
+	}
+
+	sub := SnapSubstitution{Package: name, Group: group, Via: via, Deb: r.Deb, Repo: r.Repo, Flatpak: r.Flatpak}
+
+	if r.Deb != "" {
+		if r.Repo != "" {
+			repo, err := b.snapReplacementRepo(r.Repo)
+			if err != nil {
+				return fmt.Errorf("cannot replace snap package %s: %v", name, err)
+			}
+			// The archive's transitional package carries an epoch, so
+			// only a pin above 990 lets the repository's version win.
+			pin(config.AptPreference{Packages: []string{r.Deb}, Origin: apt.SourceOrigin(repo.URI), Priority: 1000})
+		}
+	} else {
+		if b.isOffline() {
+			return fmt.Errorf("cannot replace snap package %s with Flatpak %s in an offline build; set packages.snap_replacements.%s", name, r.Flatpak, name)
+		}
+		if !b.Config.Packages.EnableFlatpak {
+			fmt.Printf("[INFO] Enabling Flatpak to replace snap package %s\n", name)
+			b.Config.Packages.EnableFlatpak = true
+		}
+		b.Config.Flatpak.Apps = dedupe(append(b.Config.Flatpak.Apps, r.Flatpak))
+	}
+
+	if r.Deb != name {
+		pin(config.AptPreference{Packages: []string{name}, Version: "*", Priority: -1})
+	}
+
+	fmt.Printf("[INFO] Replacing snap package: %s\n", sub)
+	b.snapSubstitutions = append(b.snapSubstitutions, sub)
+	return nil
+}
+
+// substituteSnaps drops every replaced snap package from pkgs and adds the
+// deb replacements recorded for the group.
+func (b *Builder) substituteSnaps(group string, pkgs []string) []string {
+	if len(b.snapSubstitutions) == 0 {
+		return pkgs
+	}
+
+	var out []string
+	for _, spec := range pkgs {
+		if !b.substituted(packageName(spec)) {
+			out = append(out, spec)
+		}
+	}
+	for _, sub := range b.snapSubstitutions {
+		if sub.Group == group && sub.Deb != "" {
+			out = append(out, sub.Deb)
+		}
+	}
+	return dedupe(out)
+}
+
+// snapDependents walks the package index the way apt resolves each group,
+// following the first alternative of every dependency and, where the
+// group installs them, recommends. It returns the table entries reached
+// that the groups do not list themselves.
+func (b *Builder) snapDependents(table map[string]config.SnapReplacement, groups []packageGroup) []SnapSubstitution {
+	idx, _, err := b.loadPackageIndex()
+	if err != nil {
+		log.Printf("[WARNING] Cannot resolve snap packages pulled in by dependencies: %v", err)
+		return nil
+	}
+
+	// A package reached while skipping recommends is walked again for a
+	// group that follows them.
+	type visit struct {
+		name       string
+		recommends bool
+	}
+
+	var found []SnapSubstitution
+	seen := make(map[visit]bool)
+	for _, group := range groups {
+		recommends := b.groupPolicy(group.Name).Recommends
+		for _, root := range group.Packages {
+			root = packageName(root)
+			queue := []string{root}
+			for len(queue) > 0 {
+				name := queue[0]
+				queue = queue[1:]
+				if name == "" || seen[visit{name, recommends}] {
+					continue
+				}
+				seen[visit{name, recommends}] = true
+
+				if _, ok := table[name]; ok {
+					if name != root {
+						found = append(found, SnapSubstitution{Package: name, Group: group.Name, Via: root})
+					}
+					continue
+				}
+
+				pkgs := idx.Lookup(name)
+				if len(pkgs) == 0 {
+					if providers := idx.Providers(name); len(providers) == 1 {
+						pkgs = providers
+					}
+				}
+				for _, p := range pkgs {
+					queue = append(queue, firstAlternatives(p.PreDepends)...)
+					queue = append(queue, firstAlternatives(p.Depends)...)
+					if recommends {
+						queue = append(queue, firstAlternatives(p.Recommends)...)
+					}
+				}
+			}
+		}
+	}
+	return found
+}
+
+// firstAlternatives returns the package apt tries first for each clause of
+// a relationship field.
+func firstAlternatives(field string) []string {
+	var names []string
+	for _, clause := range strings.Split(field, ",") {
+		names = append(names, apt.RelationNames(strings.SplitN(clause, "|", 2)[0])...)
+	}
+	return names
+}
+
+func (b *Builder) substituted(pkg string) bool {
+	for _, sub := range b.snapSubstitutions {
+		if sub.Package == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+// SnapSubstitutions returns the snap transitional packages replaced in this
+// build.
+func (b *Builder) SnapSubstitutions() []SnapSubstitution {
+	return append([]SnapSubstitution(nil), b.snapSubstitutions...)
+}
@@ -0,0 +1,122 @@
+package builder
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"kagami/pkg/config"
+)
+
+const (
+	snapshotAptConf       = "/etc/apt/apt.conf.d/01kagami-snapshot"
+	snapshotAptOption     = `Acquire::Check-Valid-Until "false"`
+	snapshotTimestampForm = "20060102T150405Z"
+)
+
+// snapshotTimestamp returns the configured snapshot in the archive URL form,
+// or an empty string when builds use the live archive.
+func (b *Builder) snapshotTimestamp() string {
+	if b.Config.Repository.Snapshot == "" || b.isOffline() {
+		return ""
+	}
+	t, err := config.ParseSnapshot(b.Config.Repository.Snapshot)
+	if err != nil {
+		return ""
+	}
+	return t.Format(snapshotTimestampForm)
+}
+
+// snapshotURI rewrites a Debian, Ubuntu or Launchpad PPA archive URI to the
+// matching snapshot service. It reports false for archives without one.
+func snapshotURI(uri, timestamp string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+
+	host := u.Hostname()
+	path := strings.Trim(u.Path, "/")
+	archive := path[strings.LastIndex(path, "/")+1:]
+
+	switch {
+	case strings.HasPrefix(host, "snapshot."):
+		return "", false
+	case host == "debian.org" || strings.HasSuffix(host, ".debian.org"):
+		return fmt.Sprintf("https://snapshot.debian.org/archive/%s/%s/", archive, timestamp), archive != ""
+	case host == "ppa.launchpadcontent.net" || host == "ppa.launchpad.net":
+		return fmt.Sprintf("https://snapshot.ppa.launchpadcontent.net/%s/%s/", path, timestamp), path != ""
+	case host == "ubuntu.com" || strings.HasSuffix(host, ".ubuntu.com"):
+		return fmt.Sprintf("https://snapshot.ubuntu.com/%s/%s/", archive, timestamp), archive != ""
+	}
+	return "", false
+}
+
+// snapshotOf returns uri rewritten to the configured snapshot, or uri itself
+// when no snapshot is configured or the archive has no snapshot service.
+// With an APT proxy, which only sees plain HTTP, the snapshot is fetched over
+// http://; its Release files are signed, so nothing is lost but transport
+// privacy.
+func (b *Builder) snapshotOf(uri string) string {
+	ts := b.snapshotTimestamp()
+	if ts == "" || isFileURI(uri) {
+		return uri
+	}
+	if snap, ok := snapshotURI(uri, ts); ok {
+		if b.proxyConfigured() {
+			snap = "http://" + strings.TrimPrefix(snap, "https://")
+		}
+		return snap
+	}
+	return uri
+}
+
+func (b *Builder) securityMirror() string {
+	return b.snapshotOf(defaultDebianSecurity)
+}
+
+func (b *Builder) repoURI(repo config.AdditionalRepo) string {
+	return b.snapshotOf(repo.URI)
+}
+
+// warnUnsnapshotted names the repositories a snapshot build still takes from
+// their live state, which makes the rebuild only partially reproducible.
+func (b *Builder) warnUnsnapshotted() {
+	if b.snapshotTimestamp() == "" {
+		return
+	}
+	if b.buildMirror() == b.archiveMirror() {
+		log.Printf("[WARNING] Mirror %s has no snapshot service; it is used at its current state", b.archiveMirror())
+	}
+	for _, repo := range b.Config.Repository.AdditionalRepos {
+		if !isFileURI(repo.URI) && b.repoURI(repo) == repo.URI {
+			log.Printf("[WARNING] Additional repository '%s' has no snapshot service; it is used at its current state", repo.Name)
+		}
+	}
+}
+
+// writeSnapshotAptConfig stops APT rejecting snapshot Release files whose
+// Valid-Until date has long passed. It is removed during chroot cleanup.
+func (b *Builder) writeSnapshotAptConfig() error {
+	if b.snapshotTimestamp() == "" {
+		return nil
+	}
+	return b.writeFile(snapshotAptConf, snapshotAptOption+";\n", 0644)
+}
+
+func (b *Builder) removeSnapshotAptConfig() error {
+	if b.snapshotTimestamp() == "" {
+		return nil
+	}
+	return b.removeFile(snapshotAptConf)
+}
+
+func additionalRepoLine(repo config.AdditionalRepo, uri string) string {
+	signedBy := ""
+	if repo.Key != "" {
+		signedBy = fmt.Sprintf("[signed-by=/etc/apt/keyrings/%s.gpg]", repo.Name)
+	}
+	line := fmt.Sprintf("deb %s %s %s %s", signedBy, uri, repo.Suite, strings.Join(repo.Components, " "))
+	return strings.ReplaceAll(line, "  ", " ") + "\n"
+}
@@ -0,0 +1,59 @@
+package builder
+
+import "testing"
+
+func TestSnapshotURI(t *testing.T) {
+	const ts = "20240601T000000Z"
+	cases := []struct {
+		uri  string
+		want string
+		ok   bool
+	}{
+		{"http://archive.ubuntu.com/ubuntu", "https://snapshot.ubuntu.com/ubuntu/20240601T000000Z/", true},
+		{"http://de.archive.ubuntu.com/ubuntu/", "https://snapshot.ubuntu.com/ubuntu/20240601T000000Z/", true},
+		{"http://ports.ubuntu.com/ubuntu-ports", "https://snapshot.ubuntu.com/ubuntu-ports/20240601T000000Z/", true},
+		{"http://deb.debian.org/debian", "https://snapshot.debian.org/archive/debian/20240601T000000Z/", true},
+		{"http://security.debian.org/debian-security", "https://snapshot.debian.org/archive/debian-security/20240601T000000Z/", true},
+		{"https://ppa.launchpadcontent.net/mozillateam/ppa/ubuntu", "https://snapshot.ppa.launchpadcontent.net/mozillateam/ppa/ubuntu/20240601T000000Z/", true},
+		{"http://ppa.launchpad.net/owner/name/ubuntu/", "https://snapshot.ppa.launchpadcontent.net/owner/name/ubuntu/20240601T000000Z/", true},
+		{"https://snapshot.ubuntu.com/ubuntu/20240101T000000Z/", "", false},
+		{"http://archive.ubuntu.com/", "", false},
+		{"https://packages.mozilla.org/apt", "", false},
+		{"https://notubuntu.com/ubuntu", "", false},
+		{"file:///srv/mirror", "", false},
+		{"not a uri", "", false},
+	}
+	for _, c := range cases {
+		got, ok := snapshotURI(c.uri, ts)
+		if ok != c.ok || (ok && got != c.want) {
+			t.Errorf("snapshotURI(%q) = %q, %v; want %q, %v", c.uri, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestSnapshotOf(t *testing.T) {
+	b := newTestBuilder(t)
+	mirror := "http://archive.ubuntu.com/ubuntu"
+
+	if got := b.snapshotOf(mirror); got != mirror {
+		t.Errorf("without a snapshot: %s", got)
+	}
+
+	b.Config.Repository.Snapshot = "2024-06-01"
+	if got := b.snapshotOf(mirror); got != "https://snapshot.ubuntu.com/ubuntu/20240601T000000Z/" {
+		t.Errorf("with a snapshot: %s", got)
+	}
+	if got := b.snapshotOf("https://packages.mozilla.org/apt"); got != "https://packages.mozilla.org/apt" {
+		t.Errorf("archive without a snapshot service rewritten to %s", got)
+	}
+
+	b.Config.Repository.Proxy.Enabled = true
+	if got := b.snapshotOf(mirror); got != "http://snapshot.ubuntu.com/ubuntu/20240601T000000Z/" {
+		t.Errorf("with a snapshot behind the proxy: %s", got)
+	}
+
+	b.Config.Build.Offline = true
+	if got := b.snapshotOf(mirror); got != mirror {
+		t.Errorf("offline build rewritten to %s", got)
+	}
+}
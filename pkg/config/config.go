@@ -3,8 +3,11 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -16,6 +19,11 @@ type Config struct {
 	Installer  InstallerConfig  `json:"installer"`
 	Network    NetworkConfig    `json:"network"`
 	Security   SecurityConfig   `json:"security"`
+	Firmware   FirmwareConfig   `json:"firmware"`
+	Flatpak    FlatpakConfig    `json:"flatpak"`
+	Build      BuildConfig      `json:"build"`
+
+	AptPreferences []AptPreference `json:"apt_preferences"`
 }
 
 type SystemConfig struct {
@@ -28,8 +36,17 @@ type SystemConfig struct {
 
 type RepositoryConfig struct {
 	Mirror          string           `json:"mirror"`
+	ImageMirror     string           `json:"image_mirror"`
 	UseProposed     bool             `json:"use_proposed"`
 	AdditionalRepos []AdditionalRepo `json:"additional_repos"`
+	Proxy           ProxyConfig      `json:"proxy"`
+	Snapshot        string           `json:"snapshot"`
+}
+
+type ProxyConfig struct {
+	Enabled  bool   `json:"enabled"`
+	URL      string `json:"url"`
+	CacheDir string `json:"cache_dir"`
 }
 
 type AdditionalRepo struct {
@@ -40,6 +57,16 @@ type AdditionalRepo struct {
 	Key        string   `json:"key"`
 }
 
+// AptPreference becomes one stanza in /etc/apt/preferences.d. Exactly one of
+// Origin, Release and Version selects what the packages are pinned to.
+type AptPreference struct {
+	Packages []string `json:"packages"`
+	Origin   string   `json:"origin"`
+	Release  string   `json:"release"`
+	Version  string   `json:"version"`
+	Priority int      `json:"priority"`
+}
+
 type InstallerConfig struct {
 	Type            string            `json:"type"`
 	Slideshow       string            `json:"slideshow"`
@@ -57,25 +84,170 @@ type BrandingConfig struct {
 }
 
 type PackageConfig struct {
-	Essential     []string `json:"essential"`
-	Additional    []string `json:"additional"`
-	Desktop       string   `json:"desktop"`
-	RemoveList    []string `json:"remove_list"`
-	Kernel        string   `json:"kernel"`
-	EnableFlatpak bool     `json:"enable_flatpak"`
-	WM            string   `json:"wm"`
+	Essential     []string   `json:"essential"`
+	Additional    []string   `json:"additional"`
+	LocalDebs     []string   `json:"local_debs"`
+	Desktop       string     `json:"desktop"`
+	RemoveList    []string   `json:"remove_list"`
+	Kernel        KernelList `json:"kernel"`
+	EnableFlatpak bool       `json:"enable_flatpak"`
+	WM            string     `json:"wm"`
+	Metapackage   bool       `json:"metapackage"`
+
+	Policies         map[string]GroupPolicy     `json:"policies"`
+	SnapReplacements map[string]SnapReplacement `json:"snap_replacements"`
+}
+
+// SnapReplacement swaps a snap transitional package for a deb or a Flatpak
+// when snapd is blocked. Deb may name a package from Repo, an
+// additional_repos entry that is then pinned above the archive. An empty
+// replacement keeps the package as it is.
+type SnapReplacement struct {
+	Deb     string `json:"deb,omitempty"`
+	Repo    string `json:"repo,omitempty"`
+	Flatpak string `json:"flatpak,omitempty"`
+}
+
+// KernelList holds the kernel packages to install. The first one boots by
+// default. It is written as a plain string when it holds a single kernel, so
+// configurations from before multi-kernel support keep their form.
+type KernelList []string
+
+func (k *KernelList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*k = nil
+		if single != "" {
+			*k = KernelList{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("packages.kernel must be a package name or a list of package names")
+	}
+	*k = KernelList(list)
+	return nil
+}
+
+func (k KernelList) MarshalJSON() ([]byte, error) {
+	switch len(k) {
+	case 0:
+		return json.Marshal("")
+	case 1:
+		return json.Marshal(k[0])
+	}
+	return json.Marshal([]string(k))
+}
+
+// GroupPolicy overrides how one package group is installed. Recommends is
+// a pointer so that an absent value keeps the group's default.
+type GroupPolicy struct {
+	Recommends *bool  `json:"recommends,omitempty"`
+	OnFailure  string `json:"on_failure,omitempty"`
+}
+
+const (
+	OnFailureFail = "fail"
+	OnFailureWarn = "warn"
+	OnFailureSkip = "skip-individually"
+)
+
+// InstallGroups are the package groups that accept a GroupPolicy.
+var InstallGroups = []string{"essential", "kernel", "firmware", "additional", "local", "desktop", "installer"}
+
+type BuildConfig struct {
+	Offline       bool            `json:"offline"`
+	AssetsDir     string          `json:"assets_dir"`
+	Backend       string          `json:"backend"`
+	Bootstrap     BootstrapConfig `json:"bootstrap"`
+	SkipPreflight bool            `json:"skip_preflight"`
+}
+
+type BootstrapConfig struct {
+	Tool             string   `json:"tool"`
+	Mode             string   `json:"mode"`
+	Format           string   `json:"format"`
+	Output           string   `json:"output"`
+	Mirrors          []string `json:"mirrors"`
+	Keyrings         []string `json:"keyrings"`
+	AptOptions       []string `json:"apt_options"`
+	IncludeEssential bool     `json:"include_essential"`
 }
 
 type NetworkConfig struct {
 	Manager string `json:"manager"`
 }
 
+// FirmwareConfig selects the firmware installed for real hardware. Packages
+// are installed in addition to the preset, and are the whole selection for
+// the vendor preset.
+type FirmwareConfig struct {
+	Preset       string   `json:"preset"`
+	Packages     []string `json:"packages"`
+	DetectAtBoot bool     `json:"detect_at_boot"`
+}
+
+const (
+	FirmwareNone     = "none"
+	FirmwareWireless = "wireless"
+	FirmwareFull     = "full"
+	FirmwareVendor   = "vendor"
+)
+
+// FlatpakConfig lists what is preinstalled system-wide when
+// packages.enable_flatpak is set. Apps and runtimes are refs such as
+// org.mozilla.firefox, optionally prefixed with a remote name and a colon;
+// without one they come from flathub.
+type FlatpakConfig struct {
+	Remotes  []FlatpakRemote `json:"remotes"`
+	Apps     []string        `json:"apps"`
+	Runtimes []string        `json:"runtimes"`
+	Bundles  []string        `json:"bundles"`
+}
+
+// FlatpakRemote is registered from a repository or .flatpakrepo URL, or from
+// a .flatpakrepo file on the build host. A bare repository URL carries no
+// signing key, so it needs GPGKey, a key file on the build host, or an
+// explicit GPGVerify of false.
+type FlatpakRemote struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	File      string `json:"file"`
+	GPGKey    string `json:"gpg_key"`
+	GPGVerify *bool  `json:"gpg_verify,omitempty"`
+}
+
+// HasRepoFile reports whether the remote is described by a .flatpakrepo
+// file, which carries its own signing key.
+func (r FlatpakRemote) HasRepoFile() bool {
+	return r.File != "" || strings.HasSuffix(r.URL, ".flatpakrepo")
+}
+
+// DefaultFlatpakRemote is registered on every image with Flatpak enabled
+// unless a remote of the same name is configured.
+const DefaultFlatpakRemote = "flathub"
+
+// FlatpakRef splits an app or runtime entry into its remote and ref.
+func FlatpakRef(entry string) (remote, ref string) {
+	if i := strings.Index(entry, ":"); i >= 0 {
+		return entry[:i], entry[i+1:]
+	}
+	return DefaultFlatpakRemote, entry
+}
+
 type SecurityConfig struct {
 	EnableFirewall    bool     `json:"enable_firewall"`
 	DisableServices   []string `json:"disable_services"`
 	BlockSnapdForever bool     `json:"block_snapd_forever"`
+	SnapdLayers       []string `json:"snapd_layers"`
 }
 
+// SnapdLayers are the snapd suppression layers, in the order they are
+// applied. An empty security.snapd_layers applies all of them.
+var SnapdLayers = []string{"pinning", "service-masks", "apt-hook", "diversion", "profile", "motd", "marker"}
+
 func inferDistro(cfg *Config) string {
 	debianCodenames := map[string]bool{
 		"stable": true, "testing": true, "unstable": true, "sid": true,
@@ -146,7 +318,7 @@ func NewDefaultConfig(release string) *Config {
 				"apport",
 				"popularity-contest",
 			},
-			Kernel: "linux-generic",
+			Kernel: KernelList{"linux-generic"},
 		},
 		Installer: InstallerConfig{
 			Type:      "ubiquity",
@@ -202,9 +374,198 @@ func (c *Config) Validate() error {
 		return errors.New("unsupported installer type; accepted values: ubiquity, calamares")
 	}
 
+	if c.Build.Backend != "" && c.Build.Backend != "chroot" && c.Build.Backend != "nspawn" {
+		return errors.New("unsupported build backend; accepted values: chroot, nspawn")
+	}
+
+	bs := c.Build.Bootstrap
+	if bs.Tool != "" && bs.Tool != "debootstrap" && bs.Tool != "mmdebstrap" {
+		return errors.New("unsupported bootstrap tool; accepted values: debootstrap, mmdebstrap")
+	}
+	if bs.Mode != "" && bs.Mode != "auto" && bs.Mode != "root" && bs.Mode != "unshare" {
+		return errors.New("unsupported bootstrap mode; accepted values: auto, root, unshare")
+	}
+	if bs.Format != "" && bs.Format != "directory" && bs.Format != "tar" {
+		return errors.New("unsupported bootstrap format; accepted values: directory, tar")
+	}
+
+	if c.Repository.Snapshot != "" {
+		if _, err := ParseSnapshot(c.Repository.Snapshot); err != nil {
+			return err
+		}
+		if c.Build.Offline {
+			return errors.New("repository.snapshot cannot be combined with offline builds")
+		}
+	}
+
+	switch c.Firmware.Preset {
+	case "", FirmwareNone, FirmwareWireless, FirmwareFull:
+	case FirmwareVendor:
+		if len(c.Firmware.Packages) == 0 {
+			return errors.New("firmware preset 'vendor' requires firmware.packages")
+		}
+	default:
+		return errors.New("unsupported firmware preset; accepted values: none, wireless, full, vendor")
+	}
+
+	for group, policy := range c.Packages.Policies {
+		known := false
+		for _, g := range InstallGroups {
+			known = known || g == group
+		}
+		if !known {
+			return fmt.Errorf("packages.policies: unknown group '%s'; accepted values: %s", group, strings.Join(InstallGroups, ", "))
+		}
+		switch policy.OnFailure {
+		case "", OnFailureFail, OnFailureWarn, OnFailureSkip:
+		default:
+			return fmt.Errorf("packages.policies.%s: unsupported on_failure; accepted values: fail, warn, skip-individually", group)
+		}
+	}
+
+	for _, layer := range c.Security.SnapdLayers {
+		known := false
+		for _, l := range SnapdLayers {
+			known = known || l == layer
+		}
+		if !known {
+			return fmt.Errorf("security.snapd_layers: unknown layer '%s'; accepted values: %s", layer, strings.Join(SnapdLayers, ", "))
+		}
+	}
+
+	for pkg, r := range c.Packages.SnapReplacements {
+		if r.Deb != "" && r.Flatpak != "" {
+			return fmt.Errorf("packages.snap_replacements.%s: set either deb or flatpak, not both", pkg)
+		}
+		if r.Repo != "" && r.Deb == "" {
+			return fmt.Errorf("packages.snap_replacements.%s: repo requires deb", pkg)
+		}
+	}
+
+	if c.Packages.Metapackage {
+		branding := c.Installer.Branding
+		if branding.ProductName == "" && branding.ShortProductName == "" {
+			return errors.New("packages.metapackage requires installer.branding.product_name or short_product_name")
+		}
+		if !debianVersion.MatchString(branding.Version) {
+			return errors.New("packages.metapackage requires installer.branding.version to be a Debian version starting with a digit")
+		}
+	}
+
+	if err := c.Flatpak.validate(c.Packages.EnableFlatpak, c.Build.Offline); err != nil {
+		return err
+	}
+
+	for i, pref := range c.AptPreferences {
+		if len(pref.Packages) == 0 {
+			return fmt.Errorf("apt_preferences[%d]: at least one package is required", i)
+		}
+		set := 0
+		for _, v := range []string{pref.Origin, pref.Release, pref.Version} {
+			if v != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("apt_preferences[%d]: exactly one of origin, release or version must be set", i)
+		}
+		if pref.Priority == 0 {
+			return fmt.Errorf("apt_preferences[%d]: priority must be non-zero", i)
+		}
+	}
+
 	return nil
 }
 
+func (f FlatpakConfig) validate(enabled, offline bool) error {
+	if !enabled {
+		if len(f.Remotes) > 0 || len(f.Apps) > 0 || len(f.Runtimes) > 0 || len(f.Bundles) > 0 {
+			return errors.New("the flatpak section requires packages.enable_flatpak")
+		}
+		return nil
+	}
+
+	remotes := map[string]bool{DefaultFlatpakRemote: true}
+	for i, remote := range f.Remotes {
+		if remote.Name == "" || strings.ContainsAny(remote.Name, ": /") {
+			return fmt.Errorf("flatpak.remotes[%d]: name must be set and contain no ':', '/' or spaces", i)
+		}
+		if (remote.URL == "") == (remote.File == "") {
+			return fmt.Errorf("flatpak.remotes[%d]: exactly one of url or file must be set", i)
+		}
+		if remote.URL != "" && offline {
+			return fmt.Errorf("flatpak.remotes[%d]: url remotes cannot be registered in offline builds; use file", i)
+		}
+		if remote.HasRepoFile() {
+			if remote.GPGKey != "" || remote.GPGVerify != nil {
+				return fmt.Errorf("flatpak.remotes[%d]: gpg_key and gpg_verify apply only to repository URLs; a .flatpakrepo carries its own key", i)
+			}
+		} else {
+			verify := remote.GPGVerify == nil || *remote.GPGVerify
+			if verify && remote.GPGKey == "" {
+				return fmt.Errorf("flatpak.remotes[%d]: repository URL %s carries no signing key; set gpg_key, or gpg_verify to false to skip verification", i, remote.URL)
+			}
+			if !verify && remote.GPGKey != "" {
+				return fmt.Errorf("flatpak.remotes[%d]: gpg_key and gpg_verify false are exclusive", i)
+			}
+		}
+		remotes[remote.Name] = true
+	}
+
+	if offline {
+		if err := f.CheckOfflineRefs(); err != nil {
+			return err
+		}
+	}
+
+	refs := append(append([]string(nil), f.Apps...), f.Runtimes...)
+	for _, entry := range refs {
+		remote, ref := FlatpakRef(entry)
+		if ref == "" {
+			return fmt.Errorf("flatpak: empty ref in '%s'", entry)
+		}
+		if !remotes[remote] {
+			return fmt.Errorf("flatpak: '%s' names unknown remote '%s'", entry, remote)
+		}
+	}
+
+	for _, bundle := range f.Bundles {
+		if !strings.HasSuffix(bundle, ".flatpak") {
+			return fmt.Errorf("flatpak.bundles: %s is not a .flatpak file", bundle)
+		}
+	}
+	return nil
+}
+
+// CheckOfflineRefs rejects apps and runtimes from url remotes, including the
+// default flathub, which offline builds do not register.
+func (f FlatpakConfig) CheckOfflineRefs() error {
+	urlRemotes := map[string]bool{DefaultFlatpakRemote: true}
+	for _, remote := range f.Remotes {
+		urlRemotes[remote.Name] = remote.URL != ""
+	}
+
+	for _, entry := range append(append([]string(nil), f.Runtimes...), f.Apps...) {
+		if remote, _ := FlatpakRef(entry); urlRemotes[remote] {
+			return fmt.Errorf("flatpak: '%s' comes from url remote '%s', which offline builds do not register; use a file remote or flatpak.bundles", entry, remote)
+		}
+	}
+	return nil
+}
+
+var debianVersion = regexp.MustCompile(`^[0-9][A-Za-z0-9.+~-]*$`)
+
+// ParseSnapshot accepts an archive snapshot timestamp as 20240115T120000Z,
+// RFC 3339 or a plain date, and returns it in UTC.
+func ParseSnapshot(s string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid repository.snapshot %q; use 20240115T120000Z, 2024-01-15T12:00:00Z or 2024-01-15", s)
+}
+
 func LoadFromFile(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metaSuffix = ".kagami-meta"
+
+// Server is a minimal caching HTTP forward proxy for APT. Package files and
+// by-hash indices are immutable and cached indefinitely; Release files and
+// other indices are revalidated upstream on every request.
+type Server struct {
+	CacheDir string
+	Client   *http.Client
+	OnLog    func(msg string)
+
+	mu       sync.Mutex
+	inflight map[string]*keyLock
+	listener net.Listener
+	srv      *http.Server
+}
+
+type entryMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+func NewServer(cacheDir string) *Server {
+	return &Server{
+		CacheDir: cacheDir,
+		Client: &http.Client{
+			Timeout: 30 * time.Minute,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 10 {
+					return errors.New("too many redirects")
+				}
+				return nil
+			},
+		},
+		inflight: make(map[string]*keyLock),
+	}
+}
+
+func (s *Server) Start(addr string) (string, error) {
+	if err := os.MkdirAll(s.CacheDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create proxy cache directory: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	s.listener = ln
+	s.srv = &http.Server{Handler: s}
+	go s.srv.Serve(ln)
+
+	return ln.Addr().String(), nil
+}
+
+func (s *Server) Close() error {
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Close()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		http.Error(w, "CONNECT is not supported; only plain HTTP repositories are cached", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		http.Error(w, "absolute http:// request URI required", http.StatusBadRequest)
+		return
+	}
+
+	cachePath, err := s.cachePath(r.URL.Host, r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unlock := s.lockKey(cachePath)
+	defer unlock()
+
+	upstream := r.URL.String()
+
+	if IsImmutable(r.URL.Path) {
+		if _, meta, err := readEntry(cachePath); err == nil {
+			s.serveEntry(w, r, cachePath, meta)
+			return
+		}
+		s.fetch(w, r, upstream, cachePath, nil)
+		return
+	}
+
+	_, meta, err := readEntry(cachePath)
+	if err != nil {
+		meta = nil
+	}
+	s.fetch(w, r, upstream, cachePath, meta)
+}
+
+// IsImmutable reports whether an archive path never changes content once
+// published, which makes it safe to serve from cache without revalidation.
+func IsImmutable(urlPath string) bool {
+	if strings.Contains(urlPath, "/by-hash/") {
+		return true
+	}
+
+	base := path.Base(urlPath)
+	switch base {
+	case "InRelease", "Release", "Release.gpg":
+		return false
+	}
+
+	for _, ext := range []string{".deb", ".udeb", ".ddeb", ".dsc", ".diff.gz", ".debian.tar.xz", ".orig.tar.gz", ".orig.tar.xz"} {
+		if strings.HasSuffix(base, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) fetch(w http.ResponseWriter, r *http.Request, upstream, cachePath string, cached *entryMeta) {
+	req, err := http.NewRequest(http.MethodGet, upstream, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		if cached != nil {
+			s.log(fmt.Sprintf("[WARNING] Upstream unreachable; serving cached %s: %v\n", upstream, err))
+			s.serveEntry(w, r, cachePath, cached)
+			return
+		}
+		http.Error(w, fmt.Sprintf("upstream request failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		s.serveEntry(w, r, cachePath, cached)
+		return
+	case resp.StatusCode != http.StatusOK:
+		if cached != nil && resp.StatusCode >= 500 {
+			s.log(fmt.Sprintf("[WARNING] Upstream returned %s; serving cached %s\n", resp.Status, upstream))
+			s.serveEntry(w, r, cachePath, cached)
+			return
+		}
+		copyHeaders(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		if r.Method != http.MethodHead {
+			io.Copy(w, resp.Body)
+		}
+		return
+	}
+
+	meta := &entryMeta{
+		URL:          upstream,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ContentType:  resp.Header.Get("Content-Type"),
+		Fetched:      time.Now().UTC(),
+	}
+
+	if err := storeEntry(cachePath, resp.Body, meta); err != nil {
+		http.Error(w, fmt.Sprintf("cache write failed: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	s.serveEntry(w, r, cachePath, meta)
+}
+
+func (s *Server) serveEntry(w http.ResponseWriter, r *http.Request, cachePath string, meta *entryMeta) {
+	f, err := os.Open(cachePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	var modTime time.Time
+	if meta.LastModified != "" {
+		if t, err := http.ParseTime(meta.LastModified); err == nil {
+			modTime = t
+		}
+	}
+	if meta.ETag != "" {
+		w.Header().Set("ETag", meta.ETag)
+	}
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	http.ServeContent(w, r, path.Base(cachePath), modTime, f)
+}
+
+func (s *Server) cachePath(host, urlPath string) (string, error) {
+	if host == "" || strings.ContainsAny(host, `/\`) || host == "." || host == ".." {
+		return "", fmt.Errorf("invalid upstream host %q", host)
+	}
+
+	cleaned := path.Clean("/" + urlPath)
+	if strings.HasSuffix(urlPath, "/") || cleaned == "/" {
+		return "", fmt.Errorf("directory listings are not cached")
+	}
+	if strings.Contains(path.Base(cleaned), metaSuffix) {
+		return "", fmt.Errorf("reserved path suffix")
+	}
+
+	host = strings.ReplaceAll(host, ":", "_")
+	return filepath.Join(s.CacheDir, host, filepath.FromSlash(cleaned)), nil
+}
+
+// keyLock serialises requests for one cache entry. refs counts holders and
+// waiters, so the entry can be dropped once nobody needs it.
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockKey locks the cache entry key and returns the function releasing it.
+func (s *Server) lockKey(key string) func() {
+	s.mu.Lock()
+	if s.inflight == nil {
+		s.inflight = make(map[string]*keyLock)
+	}
+	l, ok := s.inflight[key]
+	if !ok {
+		l = &keyLock{}
+		s.inflight[key] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(s.inflight, key)
+		}
+	}
+}
+
+func (s *Server) log(msg string) {
+	if s.OnLog != nil {
+		s.OnLog(msg)
+	}
+}
+
+func readEntry(cachePath string) (os.FileInfo, *entryMeta, error) {
+	info, err := os.Stat(cachePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(cachePath + metaSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta entryMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, nil, err
+	}
+	return info, &meta, nil
+}
+
+func storeEntry(cachePath string, body io.Reader, meta *entryMeta) error {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), ".partial-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	// The body goes in place first. The old metadata is dropped beforehand,
+	// so a crash at any point leaves either no entry or a complete body whose
+	// metadata is missing, which readEntry treats as a cache miss.
+	if err := os.Remove(cachePath + metaSuffix); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, cachePath); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	metaTmp := cachePath + metaSuffix + ".partial"
+	if err := os.WriteFile(metaTmp, data, 0644); err != nil {
+		os.Remove(metaTmp)
+		return err
+	}
+	return os.Rename(metaTmp, cachePath+metaSuffix)
+}
+
+func copyHeaders(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
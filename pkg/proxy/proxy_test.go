@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeArchive serves files from a map and counts the requests it receives,
+// along with the conditional headers of each.
+type fakeArchive struct {
+	mu       sync.Mutex
+	files    map[string]string
+	etags    map[string]string
+	modTimes map[string]time.Time
+	requests []*http.Request
+}
+
+func (a *fakeArchive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	a.requests = append(a.requests, r)
+	body, ok := a.files[r.URL.Path]
+	etag := a.etags[r.URL.Path]
+	modTime := a.modTimes[r.URL.Path]
+	a.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeContent(w, r, r.URL.Path, modTime, strings.NewReader(body))
+}
+
+func (a *fakeArchive) set(p, body, etag string, modTime time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.files[p] = body
+	a.etags[p] = etag
+	a.modTimes[p] = modTime
+}
+
+func (a *fakeArchive) hits(p string) []*http.Request {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var reqs []*http.Request
+	for _, r := range a.requests {
+		if r.URL.Path == p {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+func newFakeArchive(t *testing.T) (*fakeArchive, *httptest.Server) {
+	archive := &fakeArchive{
+		files:    make(map[string]string),
+		etags:    make(map[string]string),
+		modTimes: make(map[string]time.Time),
+	}
+	upstream := httptest.NewServer(archive)
+	t.Cleanup(upstream.Close)
+	return archive, upstream
+}
+
+// newProxyClient starts a proxy with a fresh cache and returns a client
+// that sends every request through it.
+func newProxyClient(t *testing.T) (*Server, *http.Client) {
+	s := NewServer(t.TempDir())
+	addr, err := s.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	proxyURL, _ := url.Parse("http://" + addr)
+	return s, &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+}
+
+func get(t *testing.T, client *http.Client, u string) string {
+	t.Helper()
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", u, resp.Status)
+	}
+	return string(body)
+}
+
+func TestImmutableFilesAreServedFromCache(t *testing.T) {
+	archive, upstream := newFakeArchive(t)
+	_, client := newProxyClient(t)
+
+	paths := []string{
+		"/ubuntu/pool/main/h/hello/hello_2.10-3_amd64.deb",
+		"/ubuntu/dists/noble/main/binary-amd64/by-hash/SHA256/0123abcd",
+	}
+	for _, p := range paths {
+		archive.set(p, "content of "+p, "", time.Time{})
+	}
+
+	for _, p := range paths {
+		for i := 0; i < 3; i++ {
+			if got := get(t, client, upstream.URL+p); got != "content of "+p {
+				t.Fatalf("GET %s returned %q", p, got)
+			}
+		}
+		if n := len(archive.hits(p)); n != 1 {
+			t.Errorf("%s reached upstream %d times, want 1", p, n)
+		}
+	}
+}
+
+func TestReleaseIsRevalidatedWithETag(t *testing.T) {
+	archive, upstream := newFakeArchive(t)
+	_, client := newProxyClient(t)
+
+	p := "/ubuntu/dists/noble/InRelease"
+	archive.set(p, "release v1", `"v1"`, time.Time{})
+
+	if got := get(t, client, upstream.URL+p); got != "release v1" {
+		t.Fatalf("first GET returned %q", got)
+	}
+	if got := get(t, client, upstream.URL+p); got != "release v1" {
+		t.Fatalf("second GET returned %q", got)
+	}
+
+	hits := archive.hits(p)
+	if len(hits) != 2 {
+		t.Fatalf("InRelease reached upstream %d times, want 2", len(hits))
+	}
+	if got := hits[1].Header.Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("revalidation sent If-None-Match %q, want %q", got, `"v1"`)
+	}
+
+	archive.set(p, "release v2", `"v2"`, time.Time{})
+	if got := get(t, client, upstream.URL+p); got != "release v2" {
+		t.Fatalf("GET after upstream change returned %q", got)
+	}
+}
+
+func TestReleaseIsRevalidatedWithLastModified(t *testing.T) {
+	archive, upstream := newFakeArchive(t)
+	_, client := newProxyClient(t)
+
+	p := "/debian/dists/bookworm/Release"
+	modified := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	archive.set(p, "release v1", "", modified)
+
+	get(t, client, upstream.URL+p)
+	if got := get(t, client, upstream.URL+p); got != "release v1" {
+		t.Fatalf("second GET returned %q", got)
+	}
+
+	hits := archive.hits(p)
+	if len(hits) != 2 {
+		t.Fatalf("Release reached upstream %d times, want 2", len(hits))
+	}
+	if got := hits[1].Header.Get("If-Modified-Since"); got != modified.Format(http.TimeFormat) {
+		t.Errorf("revalidation sent If-Modified-Since %q, want %q", got, modified.Format(http.TimeFormat))
+	}
+
+	archive.set(p, "release v2", "", modified.Add(time.Hour))
+	if got := get(t, client, upstream.URL+p); got != "release v2" {
+		t.Fatalf("GET after upstream change returned %q", got)
+	}
+}
+
+func TestStoreEntryWithoutMetadataIsAMiss(t *testing.T) {
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "archive", "pool", "hello.deb")
+
+	meta := &entryMeta{URL: "http://archive/pool/hello.deb", ETag: `"x"`}
+	if err := storeEntry(cachePath, bytes.NewReader([]byte("body")), meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := readEntry(cachePath); err != nil || got.ETag != `"x"` {
+		t.Fatalf("readEntry after store: %v, %+v", err, got)
+	}
+
+	// A crash between placing the body and writing its metadata.
+	if err := os.Remove(cachePath + metaSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readEntry(cachePath); err == nil {
+		t.Fatal("readEntry succeeded without metadata")
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(cachePath))
+	for _, e := range entries {
+		if strings.Contains(e.Name(), "partial") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
+
+func TestEntryLocksAreReleased(t *testing.T) {
+	archive, upstream := newFakeArchive(t)
+	s, client := newProxyClient(t)
+
+	var paths []string
+	for i := 0; i < 5; i++ {
+		p := fmt.Sprintf("/ubuntu/pool/main/p/pkg%d/pkg%d_1.0_amd64.deb", i, i)
+		archive.set(p, "content of "+p, "", time.Time{})
+		paths = append(paths, p)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		for _, p := range paths {
+			wg.Add(1)
+			go func(p string) {
+				defer wg.Done()
+				resp, err := client.Get(upstream.URL + p)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}(p)
+		}
+	}
+	wg.Wait()
+
+	for _, p := range paths {
+		if n := len(archive.hits(p)); n != 1 {
+			t.Errorf("%s reached upstream %d times, want 1", p, n)
+		}
+	}
+
+	// A handler may still be returning after its client read the body.
+	left := -1
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		left = len(s.inflight)
+		s.mu.Unlock()
+		if left == 0 {
+			break
+		}
+	}
+	if left != 0 {
+		t.Errorf("%d entry locks left after all requests finished", left)
+	}
+}
@@ -0,0 +1,203 @@
+package system
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"kagami/pkg/config"
+)
+
+// toolPackages maps every host command or file the builder relies on to the
+// Debian package that provides it. Both --check-deps/--install-deps and the
+// builder's prerequisite step resolve requirements through this table.
+var toolPackages = map[string]string{
+	"debootstrap":       "debootstrap",
+	"mmdebstrap":        "mmdebstrap",
+	"tar":               "tar",
+	"mksquashfs":        "squashfs-tools",
+	"unsquashfs":        "squashfs-tools",
+	"xorriso":           "xorriso",
+	"grub-mkstandalone": "grub-common",
+	"mkfs.vfat":         "dosfstools",
+	"mmd":               "mtools",
+	"mcopy":             "mtools",
+	"wget":              "wget",
+	"gpg":               "gpg",
+	"dpkg-deb":          "dpkg",
+	"systemd-nspawn":    "systemd-container",
+	"newuidmap":         "uidmap",
+	"newgidmap":         "uidmap",
+
+	"/usr/lib/grub/i386-pc/cdboot.img":                   "grub-pc-bin",
+	"/usr/lib/grub/i386-pc/boot_hybrid.img":              "grub-pc-bin",
+	"/usr/lib/grub/x86_64-efi/monolithic/grubx64.efi":    "grub-efi-amd64-bin",
+	"/usr/lib/grub/x86_64-efi-signed/grubx64.efi.signed": "grub-efi-amd64-signed",
+	"/usr/lib/shim/shimx64.efi.signed":                   "shim-signed",
+	"qemu-x86_64-static":                                 "qemu-user-static",
+	"qemu-i386-static":                                   "qemu-user-static",
+	"qemu-aarch64-static":                                "qemu-user-static",
+	"qemu-arm-static":                                    "qemu-user-static",
+}
+
+var qemuBinaries = map[string]string{
+	"amd64": "qemu-x86_64-static",
+	"i386":  "qemu-i386-static",
+	"arm64": "qemu-aarch64-static",
+	"armhf": "qemu-arm-static",
+}
+
+// Requirement is a host command (or, for data such as GRUB images, an
+// absolute file path) needed by a build. Optional requirements are installed
+// by --install-deps but their absence does not stop a build.
+type Requirement struct {
+	Name     string
+	Package  string
+	Reason   string
+	Optional bool
+}
+
+func requirement(name, reason string) Requirement {
+	return Requirement{Name: name, Package: toolPackages[name], Reason: reason}
+}
+
+func optional(name, reason string) Requirement {
+	r := requirement(name, reason)
+	r.Optional = true
+	return r
+}
+
+func (r Requirement) Present() bool {
+	if filepath.IsAbs(r.Name) {
+		_, err := os.Stat(r.Name)
+		return err == nil
+	}
+	return lookTool(r.Name)
+}
+
+// lookTool also searches the sbin directories, which are missing from the
+// PATH of unprivileged users that rootless builds run as.
+func lookTool(name string) bool {
+	if _, err := exec.LookPath(name); err == nil {
+		return true
+	}
+	for _, dir := range []string{"/usr/sbin", "/sbin"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && info.Mode()&0111 != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiredTools computes the host requirements of building cfg from its
+// architecture, bootstrapper, backend, rootless mode, offline mirror, local
+// packages and repository keys. The other settings need nothing on the host:
+// installer, kernel and firmware packages go into the target, the squashfs
+// is always xz compressed, which every mksquashfs supports, and the output is
+// always a hybrid ISO. Secure Boot loaders are copied from the target when
+// the host lacks them, so they are only ever optional.
+func RequiredTools(cfg *config.Config, rootless bool) []Requirement {
+	arch := cfg.System.Architecture
+	if arch == "" {
+		arch = "amd64"
+	}
+	bootstrap := cfg.Build.Bootstrap
+
+	var reqs []Requirement
+
+	switch {
+	case rootless:
+		reqs = append(reqs,
+			requirement("mmdebstrap", "rootless bootstrap"),
+			requirement("newuidmap", "rootless uid mapping"),
+			requirement("newgidmap", "rootless gid mapping"),
+		)
+	case bootstrap.Tool == "mmdebstrap":
+		reqs = append(reqs,
+			optional("mmdebstrap", "bootstrapper (debootstrap is used when absent)"),
+			requirement("debootstrap", "fallback bootstrapper"),
+		)
+	default:
+		reqs = append(reqs, requirement("debootstrap", "bootstrapper"))
+	}
+
+	if (rootless || bootstrap.Tool == "mmdebstrap") && (bootstrap.Format == "tar" || (bootstrap.Mode == "unshare" && !rootless)) {
+		reqs = append(reqs, requirement("tar", "bootstrap tarball extraction"))
+	}
+
+	if qemu, ok := qemuBinaries[arch]; ok && arch != HostArchitecture() {
+		reqs = append(reqs, requirement(qemu, "running "+arch+" binaries in the target"))
+	}
+
+	if cfg.Build.Backend == "nspawn" {
+		reqs = append(reqs, requirement("systemd-nspawn", "nspawn execution backend"))
+	}
+
+	reqs = append(reqs,
+		requirement("mksquashfs", "root filesystem image"),
+		requirement("unsquashfs", "squashfs leftover verification"),
+		requirement("xorriso", "ISO synthesis"),
+		requirement("mkfs.vfat", "EFI boot image"),
+		requirement("mmd", "EFI boot image"),
+		requirement("mcopy", "EFI boot image"),
+	)
+
+	// An offline build from a file:// mirror fetches nothing; Memtest86+ is
+	// then taken from the assets directory or left out.
+	if !cfg.Build.Offline || !strings.HasPrefix(cfg.Repository.Mirror, "file:") {
+		reqs = append(reqs, requirement("wget", "downloads and local HTTP mirrors"))
+	}
+
+	// createISO always builds the x86 BIOS and EFI boot images, whatever the
+	// target architecture.
+	reqs = append(reqs,
+		requirement("grub-mkstandalone", "GRUB BIOS image"),
+		requirement("/usr/lib/grub/i386-pc/cdboot.img", "GRUB BIOS image"),
+		optional("/usr/lib/grub/i386-pc/boot_hybrid.img", "hybrid MBR (otherwise the ISO boots from optical media only)"),
+		requirement("/usr/lib/grub/x86_64-efi/monolithic/grubx64.efi", "EFI loader"),
+		optional("/usr/lib/grub/x86_64-efi-signed/grubx64.efi.signed", "Secure Boot loader (otherwise taken from the target)"),
+		optional("/usr/lib/shim/shimx64.efi.signed", "Secure Boot shim (otherwise taken from the target)"),
+	)
+
+	if len(cfg.Packages.LocalDebs) > 0 {
+		reqs = append(reqs, requirement("dpkg-deb", "indexing local .deb files"))
+	} else if cfg.Packages.Metapackage {
+		reqs = append(reqs, requirement("dpkg-deb", "building the baseline metapackage"))
+	}
+
+	// Keys published as .gpg are only dearmored when they turn out to be
+	// ASCII-armored; any other key always is.
+	var gpg *Requirement
+	for _, repo := range cfg.Repository.AdditionalRepos {
+		switch {
+		case repo.Key == "":
+		case !strings.HasSuffix(repo.Key, ".gpg"):
+			r := requirement("gpg", "dearmoring repository keys")
+			gpg = &r
+		case gpg == nil:
+			r := optional("gpg", "dearmoring ASCII-armored .gpg repository keys")
+			gpg = &r
+		}
+	}
+	if gpg != nil {
+		reqs = append(reqs, *gpg)
+	}
+
+	return reqs
+}
+
+// HostArchitecture returns the Debian architecture name of the host.
+func HostArchitecture() string {
+	if output, err := exec.Command("dpkg", "--print-architecture").Output(); err == nil {
+		return strings.TrimSpace(string(output))
+	}
+	switch runtime.GOARCH {
+	case "386":
+		return "i386"
+	case "arm":
+		return "armhf"
+	}
+	return runtime.GOARCH
+}
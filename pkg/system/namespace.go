@@ -0,0 +1,335 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const mountNamespaceEnv = "KAGAMI_MOUNT_NAMESPACE"
+
+// InPrivateMountNamespace reports whether this process was started by
+// RunInMountNamespace.
+func InPrivateMountNamespace() bool {
+	return os.Getenv(mountNamespaceEnv) == "private"
+}
+
+// RunInMountNamespace re-executes the current command in a new mount
+// namespace with private propagation, so every mount made by the build is
+// released by the kernel when the build exits, however it exits. It returns
+// the child's exit code and true once the child has finished, or false when
+// the caller should carry on in the current process.
+func RunInMountNamespace() (int, bool) {
+	if os.Getenv(mountNamespaceEnv) != "" {
+		return 0, false
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("[WARNING] Private mount namespace unavailable: %v", err)
+		return 0, false
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), mountNamespaceEnv+"=private")
+	// The Go runtime remounts / with MS_REC|MS_PRIVATE after unsharing
+	// CLONE_NEWNS, so nothing mounted by the child propagates to the host.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWNS}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+
+	if err := cmd.Start(); err != nil {
+		log.Printf("[WARNING] Private mount namespace unavailable (%v); mounts will be made in the host namespace", err)
+		os.Setenv(mountNamespaceEnv, "host")
+		return 0, false
+	}
+
+	// The terminal already delivers SIGINT to the whole process group, so
+	// only signals aimed at this process are forwarded to the build.
+	go func() {
+		for sig := range sigChan {
+			if sig != os.Interrupt {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	return waitExitCode(cmd)
+}
+
+func waitExitCode(cmd *exec.Cmd) (int, bool) {
+	err := cmd.Wait()
+	if err == nil {
+		return 0, true
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), true
+		}
+		return exitErr.ExitCode(), true
+	}
+
+	log.Printf("[ERROR] Build process failed: %v", err)
+	return 1, true
+}
+
+const (
+	rootlessEnv     = "KAGAMI_ROOTLESS"
+	rootlessInitEnv = "KAGAMI_ROOTLESS_INIT"
+	hostPIDEnv      = "KAGAMI_HOST_PID"
+	userNSSyncFDEnv = "KAGAMI_USERNS_SYNC_FD"
+)
+
+// IsRootless reports whether this process is the rootless build started by
+// RunRootless, running as uid 0 inside its own user namespace.
+func IsRootless() bool {
+	return os.Getenv(rootlessEnv) == "1"
+}
+
+type subIDRange struct {
+	Start int
+	Count int
+}
+
+// subIDs returns the first /etc/subuid or /etc/subgid range delegated to
+// the given user name or numeric id.
+func subIDs(file, name string, id int) (subIDRange, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return subIDRange{}, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != strconv.Itoa(id)) {
+			continue
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		count, err2 := strconv.Atoi(fields[2])
+		if err1 == nil && err2 == nil && count > 0 {
+			return subIDRange{start, count}, nil
+		}
+	}
+
+	return subIDRange{}, fmt.Errorf("no subordinate id range for %s in %s", name, file)
+}
+
+// RunRootless re-executes the current command as uid 0 inside new user, mount
+// and PID namespaces. Root inside maps to the invoking user and uids 1..n map
+// to the user's /etc/subuid range via newuidmap, so files created by package
+// scripts keep distinct owners that mksquashfs records as seen from inside.
+// It returns like RunInMountNamespace. In the namespace it completes the
+// setup and runs as init; the build it starts there returns false.
+func RunRootless() (int, bool) {
+	if IsRootless() {
+		if os.Getenv(rootlessInitEnv) != "" {
+			return 0, false
+		}
+		if err := finishRootlessSetup(); err != nil {
+			log.Printf("[ERROR] Rootless namespace setup failed: %v", err)
+			return 1, true
+		}
+		return runInit(), true
+	}
+
+	for _, tool := range []string{"newuidmap", "newgidmap"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			log.Printf("[ERROR] Rootless builds require '%s'; install with: sudo apt-get install uidmap", tool)
+			return 1, true
+		}
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		log.Printf("[ERROR] Cannot determine the invoking user: %v", err)
+		return 1, true
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+
+	subuid, err := subIDs("/etc/subuid", u.Username, uid)
+	if err != nil {
+		log.Printf("[ERROR] %v; add one with: sudo usermod --add-subuids 100000-165535 %s", err, u.Username)
+		return 1, true
+	}
+	subgid, err := subIDs("/etc/subgid", u.Username, uid)
+	if err != nil {
+		log.Printf("[ERROR] %v; add one with: sudo usermod --add-subgids 100000-165535 %s", err, u.Username)
+		return 1, true
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("[ERROR] Cannot locate the kagami executable: %v", err)
+		return 1, true
+	}
+
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+		return 1, true
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{syncR}
+	cmd.Env = append(os.Environ(),
+		rootlessEnv+"=1",
+		hostPIDEnv+"="+strconv.Itoa(os.Getpid()),
+		mountNamespaceEnv+"=private",
+		userNSSyncFDEnv+"=3",
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID,
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+
+	if err := cmd.Start(); err != nil {
+		log.Printf("[ERROR] Cannot create user namespace: %v", err)
+		log.Printf("[TIP] Check that kernel.unprivileged_userns_clone (or the AppArmor userns restriction) permits unprivileged user namespaces")
+		return 1, true
+	}
+	syncR.Close()
+
+	pid := strconv.Itoa(cmd.Process.Pid)
+	mapErr := exec.Command("newuidmap", pid,
+		"0", strconv.Itoa(uid), "1",
+		"1", strconv.Itoa(subuid.Start), strconv.Itoa(subuid.Count)).Run()
+	if mapErr == nil {
+		mapErr = exec.Command("newgidmap", pid,
+			"0", strconv.Itoa(gid), "1",
+			"1", strconv.Itoa(subgid.Start), strconv.Itoa(subgid.Count)).Run()
+	}
+	if mapErr != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		syncW.Close()
+		log.Printf("[ERROR] Mapping subordinate ids into the user namespace failed: %v", mapErr)
+		return 1, true
+	}
+
+	syncW.Write([]byte{1})
+	syncW.Close()
+
+	go func() {
+		for sig := range sigChan {
+			if sig != os.Interrupt {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	return waitExitCode(cmd)
+}
+
+// runInit is PID 1 of the rootless PID namespace. The kernel delivers no
+// signal to PID 1 that it has no handler for, and every orphaned process of
+// the build is reparented to it, so it starts the build as its child,
+// forwards signals to it and reaps whatever exits until the build does.
+// Leaving tears down the namespace, killing anything still running there.
+func runInit() int {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("[ERROR] Cannot locate the kagami executable: %v", err)
+		return 1
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), rootlessInitEnv+"=1")
+
+	sigChan := make(chan os.Signal, 4)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(sigChan)
+
+	if err := cmd.Start(); err != nil {
+		log.Printf("[ERROR] Cannot start the rootless build: %v", err)
+		return 1
+	}
+
+	// As in RunInMountNamespace, the terminal delivers SIGINT to the whole
+	// process group itself.
+	go func() {
+		for sig := range sigChan {
+			if sig != os.Interrupt {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Printf("[ERROR] Waiting for the rootless build failed: %v", err)
+			return 1
+		}
+		if pid != cmd.Process.Pid {
+			continue
+		}
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+}
+
+// HostPID returns the PID under which the build is visible on the host. In
+// the rootless PID namespace that is the kagami process that created it.
+func HostPID() int {
+	if pid, err := strconv.Atoi(os.Getenv(hostPIDEnv)); err == nil && pid > 0 {
+		return pid
+	}
+	return os.Getpid()
+}
+
+// finishRootlessSetup blocks until the parent has written the id maps, then
+// makes every mount private so nothing propagates back to the host.
+func finishRootlessSetup() error {
+	fdStr := os.Getenv(userNSSyncFDEnv)
+	if fdStr == "" {
+		return nil
+	}
+	os.Unsetenv(userNSSyncFDEnv)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return err
+	}
+	sync := os.NewFile(uintptr(fd), "userns-sync")
+	buf := make([]byte, 1)
+	n, _ := sync.Read(buf)
+	sync.Close()
+	if n != 1 {
+		return fmt.Errorf("parent did not complete the id mapping")
+	}
+
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("expected uid 0 inside the user namespace, got %d", os.Geteuid())
+	}
+
+	return exec.Command("mount", "--make-rprivate", "/").Run()
+}
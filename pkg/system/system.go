@@ -6,6 +6,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+
+	"kagami/pkg/config"
 )
 
 func GetAppPaths() (configDir, workDir string) {
@@ -34,22 +36,28 @@ func GetAppPaths() (configDir, workDir string) {
 }
 
 type Dependencies struct {
-	Required  []string
-	Missing   []string
-	Installed []string
+	Required        []Requirement
+	Missing         []Requirement
+	MissingOptional []Requirement
 }
 
-var requiredPackages = []string{
-	"debootstrap",
-	"squashfs-tools",
-	"xorriso",
-	"grub-pc-bin",
-	"grub-efi-amd64-bin",
-	"mtools",
-	"dosfstools",
-	"isolinux",
-	"syslinux",
-	"syslinux-common",
+// MissingPackages lists the packages providing missing requirements, with
+// optional ones included when withOptional is set.
+func (d Dependencies) MissingPackages(withOptional bool) []string {
+	missing := d.Missing
+	if withOptional {
+		missing = append(append([]Requirement{}, missing...), d.MissingOptional...)
+	}
+
+	seen := make(map[string]bool)
+	var packages []string
+	for _, req := range missing {
+		if req.Package != "" && !seen[req.Package] {
+			seen[req.Package] = true
+			packages = append(packages, req.Package)
+		}
+	}
+	return packages
 }
 
 func IsAPTBased() bool {
@@ -104,46 +112,37 @@ func IsContainer() bool {
 	return false
 }
 
-func CheckDependencies() Dependencies {
-	deps := Dependencies{
-		Required:  requiredPackages,
-		Missing:   []string{},
-		Installed: []string{},
-	}
+func CheckDependencies(cfg *config.Config, rootless bool) Dependencies {
+	deps := Dependencies{Required: RequiredTools(cfg, rootless)}
 
-	for _, pkg := range requiredPackages {
-		if isPackageInstalled(pkg) {
-			deps.Installed = append(deps.Installed, pkg)
+	for _, req := range deps.Required {
+		if req.Present() {
+			continue
+		}
+		if req.Optional {
+			deps.MissingOptional = append(deps.MissingOptional, req)
 		} else {
-			deps.Missing = append(deps.Missing, pkg)
+			deps.Missing = append(deps.Missing, req)
 		}
 	}
 
 	return deps
 }
 
-func isPackageInstalled(packageName string) bool {
-	cmd := exec.Command("dpkg", "-s", packageName)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return false
-	}
-	return strings.Contains(string(output), "Status: install ok installed")
-}
-
 func GetInstallCommand(packages []string) string {
 	return strings.Join(packages, " ")
 }
 
-func InstallDependencies() error {
-	deps := CheckDependencies()
+func InstallDependencies(cfg *config.Config, rootless bool) error {
+	deps := CheckDependencies(cfg, rootless)
+	packages := deps.MissingPackages(true)
 
-	if len(deps.Missing) == 0 {
+	if len(packages) == 0 {
 		fmt.Println("[OK] All build dependencies are already present")
 		return nil
 	}
 
-	fmt.Printf("[INFO] Installing %d packages: %s\n", len(deps.Missing), strings.Join(deps.Missing, ", "))
+	fmt.Printf("[INFO] Installing %d packages: %s\n", len(packages), strings.Join(packages, ", "))
 
 	fmt.Println("[INFO] Updating package index...")
 	updateCmd := exec.Command("apt-get", "update")
@@ -154,7 +153,7 @@ func InstallDependencies() error {
 	}
 
 	fmt.Println("[INFO] Installing required packages...")
-	installArgs := append([]string{"install", "-y"}, deps.Missing...)
+	installArgs := append([]string{"install", "-y"}, packages...)
 	installCmd := exec.Command("apt-get", installArgs...)
 	installCmd.Stdout = os.Stdout
 	installCmd.Stderr = os.Stderr
@@ -165,9 +164,9 @@ func InstallDependencies() error {
 	}
 
 	fmt.Println("[INFO] Verifying installation...")
-	afterDeps := CheckDependencies()
+	afterDeps := CheckDependencies(cfg, rootless)
 	if len(afterDeps.Missing) > 0 {
-		return fmt.Errorf("the following packages failed to install: %s", strings.Join(afterDeps.Missing, ", "))
+		return fmt.Errorf("the following packages failed to install: %s", strings.Join(afterDeps.MissingPackages(false), ", "))
 	}
 
 	return nil
@@ -200,7 +199,7 @@ func GetSystemInfo() (map[string]string, error) {
 }
 
 func CheckMinimumRequirements() error {
-	if os.Geteuid() != 0 {
+	if os.Geteuid() != 0 && !IsRootless() {
 		return fmt.Errorf("elevated privileges are required")
 	}
 	return nil
@@ -264,7 +264,7 @@ func RunCLI() (*config.Config, string, string, error) {
 		Packages: config.PackageConfig{
 			Desktop:       desktop,
 			Additional:    additionalPkgs,
-			Kernel:        kernel,
+			Kernel:        config.KernelList{kernel},
 			EnableFlatpak: enableFlatpak,
 			WM:            wmChoice,
 		},
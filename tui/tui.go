@@ -749,7 +749,7 @@ func (m model) buildConfig() *config.Config {
 		Packages: config.PackageConfig{
 			Desktop:       m.choices["desktop"],
 			Additional:    m.additionalPkgs,
-			Kernel:        m.choices["kernel"],
+			Kernel:        config.KernelList{m.choices["kernel"]},
 			EnableFlatpak: m.choices["flatpak"] == "y",
 			WM:            m.choices["wm"],
 		},